@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/log"
+	"github.com/mindtastic/koda/reverse"
+)
+
+// adminHandlerFunc handles an authenticated admin request. actor is the name of the token used.
+type adminHandlerFunc func(w http.ResponseWriter, r *http.Request, actor string)
+
+// adminToken is a named bearer token for the admin API.
+type adminToken struct {
+	name  string
+	token string
+}
+
+// loadAdminTokens reads bearer tokens for the admin API from path. Each line holds a token as <name>:<token>.
+// The name identifies the actor in the audit log. Empty lines and lines starting with # are ignored.
+func loadAdminTokens(path string) ([]adminToken, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening admin tokens: %v", err)
+	}
+	defer f.Close()
+
+	var tokens []adminToken
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, token, ok := strings.Cut(line, ":")
+		if !ok || name == "" || len(token) < 16 {
+			return nil, fmt.Errorf("invalid admin token %q: must be <name>:<token> with at least 16 characters", name)
+		}
+		tokens = append(tokens, adminToken{name: name, token: token})
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("error reading admin tokens %s: %v", path, err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no admin tokens found in %s", path)
+	}
+	return tokens, nil
+}
+
+// reverseIndexKeyEnv is the environment variable the reverse index key is read from if no key file is configured.
+const reverseIndexKeyEnv = "KODA_REVERSE_INDEX_KEY"
+
+// configureAdmin sets up the admin API and the reverse index as configured by the command line flags.
+// The reverse index can only be enabled together with the admin API and an audit log.
+func (a *application) configureAdmin() error {
+	if *adminAddr == "" {
+		if *reverseIndexPath != "" {
+			return errors.New("reverse index requires the admin API to be enabled")
+		}
+		return nil
+	}
+	if *adminTokens == "" {
+		return errors.New("admin API requires admin tokens")
+	}
+	tokens, err := loadAdminTokens(*adminTokens)
+	if err != nil {
+		return err
+	}
+	a.adminTokens = tokens
+
+	if *reverseIndexPath != "" {
+		if *auditLogPath == "" {
+			return errors.New("reverse index requires an audit log")
+		}
+		key, err := loadReverseIndexKey()
+		if err != nil {
+			return err
+		}
+		if a.reverseIndex, err = reverse.Open(*reverseIndexPath, key); err != nil {
+			return fmt.Errorf("error opening reverse index: %v", err)
+		}
+		a.store = reverse.NewIndexedStore(a.store, a.reverseIndex)
+		log.Warnf("reverse index enabled, ServiceKeys can be resolved to AccountKeys on the admin API")
+	}
+	if *auditLogPath != "" {
+		if a.audit, err = openAuditLog(*auditLogPath); err != nil {
+			return err
+		}
+	}
+
+	a.adminServer = &http.Server{
+		Addr:    *adminAddr,
+		Handler: a.initializeAdminMux(),
+	}
+	return nil
+}
+
+// loadReverseIndexKey reads the base64 encoded reverse index key from the key file or, if not set, the environment.
+func loadReverseIndexKey() ([]byte, error) {
+	encoded := os.Getenv(reverseIndexKeyEnv)
+	if *reverseIndexKeyFile != "" {
+		b, err := os.ReadFile(*reverseIndexKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading reverse index key: %v", err)
+		}
+		encoded = string(b)
+	}
+	if encoded == "" {
+		return nil, errors.New("reverse index requires a key")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding reverse index key: %v", err)
+	}
+	return key, nil
+}
+
+func (a *application) initializeAdminMux() *http.ServeMux {
+	mux := new(http.ServeMux)
+	mux.Handle("/accounts", a.requireAdmin(a.handleListAccounts()))
+	mux.Handle("/accounts/", a.requireAdmin(a.handleAccount()))
+	mux.Handle("/services", a.requireAdmin(a.handleServiceCounts()))
+	mux.Handle("/provisioning", a.requireAdmin(a.handleProvisioningStats()))
+	if a.migration != nil {
+		mux.Handle("/migration", a.requireAdmin(a.handleMigration()))
+		mux.Handle("/migration/flip", a.requireAdmin(a.handleMigration()))
+	}
+	if a.cache != nil {
+		mux.Handle("/cache", a.requireAdmin(a.handleCacheStats()))
+	}
+	if a.reverseIndex != nil {
+		mux.Handle("/reverse-lookup", a.requireAdmin(a.handleReverseLookup()))
+	}
+
+	return mux
+}
+
+// requireAdmin authenticates requests with a bearer token. Unauthenticated requests are rejected.
+func (a *application) requireAdmin(h adminHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		for _, t := range a.adminTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t.token)) == 1 {
+				h(w, r, t.name)
+				return
+			}
+		}
+		log.Warnf("rejected unauthenticated admin request from %s", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// handleReverseLookup resolves a ServiceKey to the AccountKey it belongs to. Every lookup requires a reason and is
+// written to the audit log before the result is returned. The audit entry only holds the keyed hash of the ServiceKey
+// and not the resolved AccountKey, so the audit log does not become an unencrypted copy of the reverse index.
+func (a *application) handleReverseLookup() adminHandlerFunc {
+	const action = "reverse-lookup"
+
+	type request struct {
+		ServiceKey koda.ServiceKey `json:"serviceKey"`
+		Reason     string          `json:"reason"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, actor string) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req request
+		d := json.NewDecoder(r.Body)
+		if err := d.Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("malformed request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.ServiceKey == "" || req.Reason == "" {
+			http.Error(w, "serviceKey and reason must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		entry := auditEntry{
+			Time:           time.Now().UTC(),
+			Actor:          actor,
+			RemoteAddr:     r.RemoteAddr,
+			Action:         action,
+			Reason:         req.Reason,
+			ServiceKeyHash: a.reverseIndex.Hash(req.ServiceKey),
+		}
+		result, err := a.reverseIndex.Lookup(req.ServiceKey)
+		switch {
+		case err == nil:
+			entry.Result = "found"
+		case errors.Is(err, koda.ErrNotFound):
+			entry.Result = "not found"
+		default:
+			entry.Result = "error"
+		}
+		if aerr := a.audit.write(entry); aerr != nil {
+			log.Errorf("error writing audit entry, denying reverse lookup: %v", aerr)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Infof("reverse lookup by %s: %s", actor, entry.Result)
+
+		if err != nil {
+			if errors.Is(err, koda.ErrNotFound) {
+				http.Error(w, "service key not found", http.StatusNotFound)
+				return
+			}
+			log.Errorf("error looking up service key: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		e := json.NewEncoder(w)
+		if err := e.Encode(result); err != nil {
+			log.Errorf("error encoding JSON response: %v", err)
+		}
+	}
+}
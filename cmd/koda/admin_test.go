@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/reverse"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAdminToken = "0123456789abcdef"
+
+func newTestAdminApplication(t *testing.T) (*application, string) {
+	a := newTestApplication(t)
+	a.adminTokens = []adminToken{{name: "support", token: testAdminToken}}
+
+	idx, err := reverse.Open(filepath.Join(t.TempDir(), "reverse.idx"), bytes.Repeat([]byte{1}, reverse.KeySize))
+	assert.NoError(t, err)
+	t.Cleanup(func() { idx.Close() })
+	a.reverseIndex = idx
+	a.store = reverse.NewIndexedStore(a.store, idx)
+
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	a.audit, err = openAuditLog(auditPath)
+	assert.NoError(t, err)
+	return a, auditPath
+}
+
+func (a *application) serveAdmin(method, path, token, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	a.initializeAdminMux().ServeHTTP(w, r)
+	return w
+}
+
+func TestLoadAdminTokens(t *testing.T) {
+	testCases := []struct {
+		name     string
+		content  string
+		expected []adminToken
+		err      string
+	}{
+		{name: "valid", content: "# admins\nsupport:" + testAdminToken + "\n\nops:fedcba9876543210\n", expected: []adminToken{{"support", testAdminToken}, {"ops", "fedcba9876543210"}}},
+		{name: "short token", content: "support:short", err: `invalid admin token "support": must be <name>:<token> with at least 16 characters`},
+		{name: "no name", content: testAdminToken, err: `invalid admin token "` + testAdminToken + `": must be <name>:<token> with at least 16 characters`},
+		{name: "empty", content: "# nobody\n", err: "no admin tokens found in %s"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tokens")
+			assert.NoError(t, os.WriteFile(path, []byte(tc.content), 0600))
+			tokens, err := loadAdminTokens(path)
+			if tc.err != "" {
+				assert.EqualError(t, err, strings.Replace(tc.err, "%s", path, 1))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, tokens)
+		})
+	}
+}
+
+func TestHandleReverseLookup(t *testing.T) {
+	a, auditPath := newTestAdminApplication(t)
+	r, err := a.store.GetOrCreateServiceKey(context.Background(), testAccountKey, "user-service", "service-key")
+	assert.NoError(t, err)
+	assert.Equal(t, koda.ServiceKey("service-key"), r.ServiceKeys["user-service"])
+
+	body := `{"serviceKey": "service-key", "reason": "DSR-42"}`
+	assert.Equal(t, http.StatusUnauthorized, a.serveAdmin(http.MethodPost, "/reverse-lookup", "", body).Code)
+	assert.Equal(t, http.StatusUnauthorized, a.serveAdmin(http.MethodPost, "/reverse-lookup", "wrong", body).Code)
+	assert.Equal(t, http.StatusBadRequest, a.serveAdmin(http.MethodPost, "/reverse-lookup", testAdminToken, `{"serviceKey": "service-key"}`).Code)
+
+	w := a.serveAdmin(http.MethodPost, "/reverse-lookup", testAdminToken, body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var e reverse.Entry
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&e))
+	assert.Equal(t, reverse.Entry{AccountKey: testAccountKey, Service: "user-service"}, e)
+
+	w = a.serveAdmin(http.MethodPost, "/reverse-lookup", testAdminToken, `{"serviceKey": "unknown", "reason": "DSR-43"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Every authenticated lookup is audited
+	data, err := os.ReadFile(auditPath)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 2)
+	var entry auditEntry
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "support", entry.Actor)
+	assert.Equal(t, "DSR-42", entry.Reason)
+	assert.Equal(t, a.reverseIndex.Hash("service-key"), entry.ServiceKeyHash)
+	assert.Equal(t, "found", entry.Result)
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, "not found", entry.Result)
+
+	// The audit log does not link the ServiceKey to the AccountKey
+	assert.NotContains(t, string(data), "service-key")
+	assert.NotContains(t, string(data), string(testAccountKey))
+
+	// Lookups are denied if they cannot be audited
+	assert.NoError(t, a.audit.Close())
+	w = a.serveAdmin(http.MethodPost, "/reverse-lookup", testAdminToken, body)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NotContains(t, w.Body.String(), string(testAccountKey))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mindtastic/koda"
+)
+
+// auditEntry records a single access to sensitive admin functionality. The audit log is never pruned, so an entry must
+// not link a ServiceKey to an AccountKey.
+type auditEntry struct {
+	Time           time.Time       `json:"time"`
+	Actor          string          `json:"actor"`
+	RemoteAddr     string          `json:"remoteAddr"`
+	Action         string          `json:"action"`
+	Reason         string          `json:"reason"`
+	ServiceKeyHash string          `json:"serviceKeyHash,omitempty"` // See reverse.Index.Hash
+	AccountKey     koda.AccountKey `json:"accountKey,omitempty"`
+	Service        string          `json:"service,omitempty"`
+	Result         string          `json:"result"`
+}
+
+// auditLog is an append-only file of JSON encoded auditEntries. It is safe for concurrent use.
+type auditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %v", err)
+	}
+	return &auditLog{f: f}, nil
+}
+
+// write appends e to the log and syncs it to disk. Callers must not reveal any data if write fails.
+func (l *auditLog) write(e auditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error encoding audit entry: %v", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("error writing audit log: %v", err)
+	}
+	if err := l.f.Sync(); err != nil {
+		return fmt.Errorf("error syncing audit log: %v", err)
+	}
+	return nil
+}
+
+// writeAudit writes e to the audit log of a, if one is configured.
+func (a *application) writeAudit(e auditEntry) error {
+	if a.audit == nil {
+		return nil
+	}
+	return a.audit.write(e)
+}
+
+func (l *auditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mindtastic/koda/log"
+	"github.com/mindtastic/koda/store/cache"
+)
+
+// configureCache puts a cache in front of the store if -cache-size is set. It must be called after
+// configureMigration, so the cache also covers the store being migrated to.
+func (a *application) configureCache() {
+	if *cacheSize == 0 {
+		return
+	}
+	a.cache = cache.New(a.store, cache.WithSize(*cacheSize), cache.WithTTL(*cacheTTL), cache.WithNegativeTTL(*cacheNegativeTTL))
+	a.store = a.cache
+	log.Infof("caching up to %d records for %v", *cacheSize, *cacheTTL)
+}
+
+// handleCacheStats returns the statistics of the cache.
+func (a *application) handleCacheStats() adminHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, actor string) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		e := json.NewEncoder(w)
+		if err := e.Encode(a.cache.Stats()); err != nil {
+			log.Errorf("error encoding JSON response: %v", err)
+		}
+	}
+}
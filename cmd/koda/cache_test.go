@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleCacheStats(t *testing.T) {
+	a, _ := newTestAdminApplication(t)
+	assert.Equal(t, http.StatusNotFound, a.serveAdmin(http.MethodGet, "/cache", testAdminToken, "").Code)
+
+	*cacheSize = 10
+	defer func() { *cacheSize = 0 }()
+	a.configureCache()
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, a.serve(http.MethodPost, "/", hydratorBody(testAccountKey)).Code)
+	}
+
+	w := a.serveAdmin(http.MethodGet, "/cache", testAdminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	// The unknown AccountKey misses, is created and invalidated. Only the last request hits the cached record.
+	assert.JSONEq(t, `{"hits": 1, "negativeHits": 0, "misses": 2, "loads": 2, "evictions": 0, "invalidations": 1, "entries": 1}`, w.Body.String())
+	assert.Equal(t, http.StatusUnauthorized, a.serveAdmin(http.MethodGet, "/cache", "", "").Code)
+}
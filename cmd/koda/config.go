@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/log"
+	"github.com/mindtastic/koda/store/localfile"
+	"gopkg.in/yaml.v3"
+)
+
+// Every flag can also be set by an environment variable and in the configuration file. The environment variable of a
+// flag is envPrefix followed by its name in upper case with dashes replaced by underscores, e.g. KODA_ADMIN_ADDR for
+// -admin-addr. The configuration file is a YAML or JSON object with flag names as keys.
+// Flags given on the command line take precedence over environment variables, which take precedence over the
+// configuration file.
+const envPrefix = "KODA_"
+
+// Sources of configuration values, in order of precedence.
+const (
+	sourceFlag    = "flag"
+	sourceEnv     = "env"
+	sourceFile    = "file"
+	sourceDefault = "default"
+)
+
+// sharedSchemes are the schemes of stores that several replicas write to. The cache of a replica is not invalidated by
+// writes of the others, so it would serve deactivated and deleted records until they expire.
+var sharedSchemes = []string{"postgres", "postgresql", "redis", "rediss", "raft"}
+
+// configFlag is the flag naming the configuration file. It cannot be set in the configuration file itself.
+const configFlag = "config"
+
+// secretEnvs are environment variables holding secrets, which are only read from the environment.
+var secretEnvs = []string{localfile.KeysEnv, reverseIndexKeyEnv, serviceKeySecretEnv, dumpKeyEnv}
+
+// effectiveConfig is the configuration loaded by main.
+var effectiveConfig *config
+
+// inlineServiceRules are the service rules given as a list in the configuration file instead of a file name.
+var inlineServiceRules []serviceRule
+
+// uriFlags hold URIs that may contain credentials.
+var uriFlags = map[string]bool{"store": true, "migrate-to": true}
+
+// config is the effective configuration after merging all sources.
+type config struct {
+	sources map[string]string // Source of each flag value
+}
+
+// envName returns the environment variable of the flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadConfig applies environment variables and the configuration file to all flags of fs that have not been set on
+// the command line. fs must have been parsed before.
+func loadConfig(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) (*config, error) {
+	c := &config{sources: make(map[string]string)}
+	fs.VisitAll(func(f *flag.Flag) { c.sources[f.Name] = sourceDefault })
+	fs.Visit(func(f *flag.Flag) { c.sources[f.Name] = sourceFlag })
+
+	var errs []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if c.sources[f.Name] != sourceDefault {
+			return
+		}
+		if v, ok := lookupEnv(envName(f.Name)); ok {
+			if err := fs.Set(f.Name, v); err != nil {
+				errs = append(errs, fmt.Sprintf("invalid value %q for %s: %v", v, envName(f.Name), err))
+				return
+			}
+			c.sources[f.Name] = sourceEnv
+		}
+	})
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+
+	path := fs.Lookup(configFlag).Value.String()
+	if path == "" {
+		return c, nil
+	}
+	values, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, name := range keys {
+		f := fs.Lookup(name)
+		if f == nil || name == configFlag {
+			errs = append(errs, fmt.Sprintf("unknown configuration key %q", name))
+			continue
+		}
+		if c.sources[name] != sourceDefault {
+			continue
+		}
+		if err := setFromFile(fs, name, values[name]); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid value for %s in %s: %v", name, path, err))
+			continue
+		}
+		c.sources[name] = sourceFile
+	}
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+	return c, nil
+}
+
+// readConfigFile reads a YAML or JSON configuration file.
+func readConfigFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading configuration file: %v", err)
+	}
+	values := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("error decoding configuration file %s: %v", path, err)
+	}
+	return values, nil
+}
+
+// setFromFile sets the flag name to a value of the configuration file. Service rules can be given inline as a list
+// instead of a file name.
+func setFromFile(fs *flag.FlagSet, name string, v interface{}) error {
+	switch v := v.(type) {
+	case []interface{}:
+		if name != "service-rules" {
+			return errors.New("must not be a list")
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var rules []serviceRule
+		if err := json.Unmarshal(b, &rules); err != nil {
+			return err
+		}
+		inlineServiceRules = rules
+		return nil
+	case map[string]interface{}:
+		return errors.New("must not be an object")
+	case nil:
+		return fs.Set(name, "")
+	default:
+		return fs.Set(name, fmt.Sprint(v))
+	}
+}
+
+// validateConfig checks the merged configuration for invalid values and combinations.
+func validateConfig() error {
+	var errs []string
+	if *inactiveStatus < 400 || *inactiveStatus > 599 {
+		errs = append(errs, fmt.Sprintf("inactive status must be a HTTP error status, got %d", *inactiveStatus))
+	}
+	if *serviceKeyMode != keyModeRandom && *serviceKeyMode != keyModeDerived {
+		errs = append(errs, fmt.Sprintf("unknown service key mode %q", *serviceKeyMode))
+	}
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		errs = append(errs, "TLS requires both a certificate and a key file")
+	}
+	if _, err := log.ParseLevel(*logLevel); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if *flushInterval < 0 {
+		errs = append(errs, "flush interval must not be negative")
+	}
+	if *cacheSize < 0 || *cacheTTL < 0 || *cacheNegativeTTL < 0 {
+		errs = append(errs, "cache size and TTLs must not be negative")
+	}
+	for _, uri := range []string{*storeURI, *migrateTo} {
+		if uri == "" {
+			continue
+		}
+		u, err := url.Parse(uri)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("invalid store URI %s", redactURI(uri)))
+			continue
+		}
+		if !contains(koda.Schemes(), u.Scheme) {
+			errs = append(errs, fmt.Sprintf("unknown store URI scheme %q, registered are %v", u.Scheme, koda.Schemes()))
+		}
+		if *cacheSize > 0 && contains(sharedSchemes, u.Scheme) {
+			errs = append(errs, fmt.Sprintf("cache cannot be used with the shared %s store, other replicas do not invalidate it", u.Scheme))
+		}
+	}
+	if rules, err := configuredServiceRules(); err != nil {
+		errs = append(errs, err.Error())
+	} else if _, err := newServiceResolver(parseServiceOrder(*serviceLookup), *serviceHeader, *serviceExtra, rules); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid service resolution: %v", err))
+	}
+	errs = append(errs, validateProvisioning()...)
+	if *adminAddr != "" && *adminTokens == "" {
+		errs = append(errs, "admin API requires admin tokens")
+	}
+	if *reverseIndexPath != "" && (*adminAddr == "" || *auditLogPath == "") {
+		errs = append(errs, "reverse index requires the admin API and an audit log")
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// configuredServiceRules returns the service rules given inline in the configuration file or in the file named by
+// -service-rules. It returns nil rules if neither is configured.
+func configuredServiceRules() ([]serviceRule, error) {
+	if inlineServiceRules != nil {
+		return inlineServiceRules, nil
+	}
+	if *serviceRules != "" {
+		return loadServiceRules(*serviceRules)
+	}
+	return nil, nil
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// print writes the effective configuration as YAML to w, annotated with the source of each value. The output can be
+// used as a configuration file. Credentials in URIs and secrets from the environment are masked.
+func (c *config) print(w io.Writer, fs *flag.FlagSet) error {
+	if path := fs.Lookup(configFlag).Value.String(); path != "" {
+		fmt.Fprintf(w, "# Configuration file: %s (%s)\n", path, c.sources[configFlag])
+	}
+	var doc yaml.Node
+	doc.Kind = yaml.MappingNode
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == configFlag {
+			return
+		}
+		value := &yaml.Node{Kind: yaml.ScalarNode, Value: f.Value.String(), LineComment: c.sources[f.Name]}
+		if uriFlags[f.Name] && value.Value != "" {
+			value.Value = redactURI(value.Value)
+		}
+		if f.Name == "service-rules" && inlineServiceRules != nil {
+			value = &yaml.Node{Kind: yaml.SequenceNode, LineComment: c.sources[f.Name]}
+			for _, r := range inlineServiceRules {
+				value.Content = append(value.Content, &yaml.Node{Kind: yaml.MappingNode, Style: yaml.FlowStyle, Content: []*yaml.Node{
+					{Kind: yaml.ScalarNode, Value: "match"}, {Kind: yaml.ScalarNode, Value: r.Match, Style: yaml.DoubleQuotedStyle},
+					{Kind: yaml.ScalarNode, Value: "service"}, {Kind: yaml.ScalarNode, Value: r.Service},
+				}})
+			}
+		}
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: f.Name}, value)
+	})
+	e := yaml.NewEncoder(w)
+	e.SetIndent(2)
+	if err := e.Encode(&doc); err != nil {
+		return err
+	}
+	if err := e.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "# Secrets read from the environment:")
+	for _, env := range secretEnvs {
+		state := "not set"
+		if os.Getenv(env) != "" {
+			state = "set (masked)"
+		}
+		fmt.Fprintf(w, "#   %s: %s\n", env, state)
+	}
+	return nil
+}
+
+// runConfig implements the config subcommand. config print writes the effective configuration to stdout and fails if
+// it is invalid.
+func runConfig(args []string) error {
+	if len(args) != 1 || args[0] != "print" {
+		return errors.New("usage: config print")
+	}
+	if err := effectiveConfig.print(os.Stdout, flag.CommandLine); err != nil {
+		return err
+	}
+	return validateConfig()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/dump"
+	"github.com/mindtastic/koda/log"
+)
+
+// dumpKeyEnv is the environment variable the dump key is read from if no key file is given.
+const dumpKeyEnv = "KODA_DUMP_KEY"
+
+// runExport implements the export subcommand. It writes all records of the configured store to a dump.
+// A file:// store is opened read-only and must not be in use by a running server.
+func runExport(args []string) (err error) {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := fs.String("o", "-", "File to write the dump to, - for stdout")
+	encrypt := fs.Bool("encrypt", false, "Encrypt the dump with the key from -key-file or "+dumpKeyEnv)
+	keyFile := fs.String("key-file", "", "File with the base64 encoded key to encrypt the dump with")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := checkOffline(*storeURI); err != nil {
+		return err
+	}
+
+	var key []byte
+	if *encrypt || *keyFile != "" {
+		k, err := loadDumpKey(*keyFile)
+		if err != nil {
+			return err
+		}
+		if k == nil {
+			return errors.New("encryption requires a key")
+		}
+		key = k
+	} else {
+		log.Warnf("exporting unencrypted dump, it holds every ServiceKey in plain text")
+	}
+
+	store, err := koda.Open(context.Background(), readOnly(*storeURI))
+	if err != nil {
+		return fmt.Errorf("error opening store: %v", err)
+	}
+	defer closeStore(store)
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return fmt.Errorf("error creating dump: %v", err)
+		}
+		defer func() {
+			f.Close()
+			if err != nil { // Do not leave an incomplete dump behind
+				os.Remove(*out)
+			}
+		}()
+		w = f
+	}
+	n, err := dump.Export(context.Background(), store, w, key)
+	if err != nil {
+		return err
+	}
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("error syncing dump: %v", err)
+		}
+	}
+	log.Infof("exported %d records", n)
+	return nil
+}
+
+// runImport implements the import subcommand. It loads all records of a dump into the configured store.
+// A dump read from a file is verified completely before any record is imported.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	in := fs.String("i", "-", "File to read the dump from, - for stdin")
+	keyFile := fs.String("key-file", "", "File with the base64 encoded key to decrypt the dump with")
+	overwrite := fs.Bool("overwrite", false, "Replace records that already exist in the store")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := checkOffline(*storeURI); err != nil {
+		return err
+	}
+
+	key, err := loadDumpKey(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	r := io.ReadSeeker(os.Stdin)
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return fmt.Errorf("error opening dump: %v", err)
+		}
+		defer f.Close()
+		n, err := dump.Verify(f, key)
+		if err != nil {
+			return fmt.Errorf("error verifying dump: %w", err)
+		}
+		log.Infof("verified dump with %d records", n)
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("error reading dump: %v", err)
+		}
+		r = f
+	} else {
+		log.Warnf("importing from stdin, records are imported before the dump is verified")
+	}
+
+	store, err := koda.Open(context.Background(), *storeURI)
+	if err != nil {
+		return fmt.Errorf("error opening store: %v", err)
+	}
+
+	stats, err := dump.Import(context.Background(), store, r, key, *overwrite)
+	log.Infof("imported %d records, skipped %d existing records", stats.Imported, stats.Skipped)
+	if cerr := closeStore(store); cerr != nil && err == nil {
+		err = fmt.Errorf("error closing store: %v", cerr)
+	}
+	return err
+}
+
+// loadDumpKey loads the base64 encoded dump key from path or, if path is empty, from the environment. It returns a nil
+// key if neither is configured.
+func loadDumpKey(path string) ([]byte, error) {
+	encoded := os.Getenv(dumpKeyEnv)
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading dump key: %v", err)
+		}
+		encoded = string(b)
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding dump key: %v", err)
+	}
+	if len(key) != dump.KeySize {
+		return nil, fmt.Errorf("dump key must be %d bytes, got %d", dump.KeySize, len(key))
+	}
+	return key, nil
+}
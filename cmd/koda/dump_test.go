@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/dump"
+	"github.com/mindtastic/koda/store/localfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImport(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "dump.key")
+	assert.NoError(t, os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, dump.KeySize))), 0600))
+	dumpFile := filepath.Join(dir, "koda.dump")
+
+	prev := *storeURI
+	t.Cleanup(func() { *storeURI = prev })
+
+	*storeURI = "bolt://" + filepath.Join(dir, "src.db")
+	src, err := koda.Open(context.Background(), *storeURI)
+	assert.NoError(t, err)
+	_, err = src.GetOrCreateServiceKey(context.Background(), testAccountKey, "user-service", "key")
+	assert.NoError(t, err)
+	assert.NoError(t, closeStore(src))
+
+	assert.NoError(t, runExport([]string{"-o", dumpFile, "-key-file", keyFile}))
+	assert.Error(t, runExport([]string{"-o", dumpFile, "-key-file", keyFile}), "existing dumps must not be overwritten")
+
+	*storeURI = "file://" + filepath.Join(dir, "dst.db")
+	assert.ErrorIs(t, runImport([]string{"-i", dumpFile}), dump.ErrNoKey)
+	assert.NoError(t, runImport([]string{"-i", dumpFile, "-key-file", keyFile}))
+
+	dst, err := koda.Open(context.Background(), *storeURI)
+	assert.NoError(t, err)
+	defer closeStore(dst)
+	r, err := dst.Get(context.Background(), testAccountKey)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]koda.ServiceKey{"user-service": "key"}, r.ServiceKeys)
+}
+
+func TestExport_FileStore(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "koda.db")
+
+	prev := *storeURI
+	t.Cleanup(func() { *storeURI = prev })
+	*storeURI = "file://" + dbPath
+
+	s, err := koda.Open(context.Background(), *storeURI)
+	assert.NoError(t, err)
+	_, err = s.GetOrCreateServiceKey(context.Background(), testAccountKey, "user-service", "key")
+	assert.NoError(t, err)
+
+	// The store is in use by a running server
+	err = runExport([]string{"-o", filepath.Join(dir, "running.dump")})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), localfile.ErrLocked.Error())
+	}
+	assert.NoError(t, closeStore(s))
+
+	files := func() map[string][]byte {
+		files := make(map[string][]byte)
+		for _, p := range []string{dbPath, dbPath + ".wal", dbPath + ".1", dbPath + ".2"} {
+			data, err := os.ReadFile(p)
+			if !os.IsNotExist(err) {
+				assert.NoError(t, err)
+			}
+			files[p] = data
+		}
+		return files
+	}
+	before := files()
+
+	// Exporting neither flushes the data file nor rotates its generations or compacts the write-ahead log
+	assert.NoError(t, runExport([]string{"-o", filepath.Join(dir, "koda.dump")}))
+	assert.Equal(t, before, files())
+}
+
+func TestExportImport_RaftStore(t *testing.T) {
+	prev := *storeURI
+	t.Cleanup(func() { *storeURI = prev })
+	*storeURI = "raft:///data/raft?id=koda-0&peers=koda-0@127.0.0.1:7000"
+
+	// A Raft node would be started and join the cluster
+	dumpFile := filepath.Join(t.TempDir(), "koda.dump")
+	assert.EqualError(t, runExport([]string{"-o", dumpFile}), "raft stores cannot be opened by subcommands, as that would start another Raft node")
+	assert.NoFileExists(t, dumpFile)
+	assert.EqualError(t, runImport([]string{"-i", dumpFile}), "raft stores cannot be opened by subcommands, as that would start another Raft node")
+}
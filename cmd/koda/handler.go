@@ -15,8 +15,6 @@ func (a *application) initializeMux() *http.ServeMux {
 	mux := new(http.ServeMux)
 	mux.Handle("/", a.handleRequest())
 	mux.Handle("/health", a.handleHealthcheck())
-	//TODO:
-	// PUT /{account_key}/rotate	<--- Rotates keys for a given ide
 
 	return mux
 }
@@ -27,24 +25,20 @@ func (a *application) handleHealthcheck() http.HandlerFunc {
 	}
 }
 
+// hydratorPayload is the authentication session sent and expected back by the Oathkeeper hydrator mutator.
+type hydratorPayload struct {
+	Subject      string                 `json:"subject"`
+	Extra        map[string]interface{} `json:"extra"`
+	Header       http.Header            `json:"header"`
+	MatchContext struct {
+		RegexpCaptureGroups []string `json:"regexp_capture_groups"`
+		URL                 url.URL  `json:"url"`
+	} `json:"match_context"`
+}
+
 func (a *application) handleRequest() http.HandlerFunc {
 	const userIdExtraKey = "userID"
 
-	type payload struct {
-		Subject      string                 `json:"subject"`
-		Extra        map[string]interface{} `json:"extra"`
-		Header       http.Header            `json:"header"`
-		MatchContext struct {
-			RegexpCaptureGroups []string `json:"regexp_capture_groups"`
-			URL                 url.URL  `json:"url"`
-		} `json:"match_context"`
-	}
-
-	var serviceName = func(p payload) string {
-		log.Warnf("Service extracted from payload is hardcoded to user-service")
-		return "user-service"
-	}
-
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			log.Errorf("received non-POST request")
@@ -52,7 +46,7 @@ func (a *application) handleRequest() http.HandlerFunc {
 			return
 		}
 
-		var requestPayload payload
+		var requestPayload hydratorPayload
 		d := json.NewDecoder(r.Body)
 		if err := d.Decode(&requestPayload); err != nil {
 			log.Errorf("error decoding JSON body: %v", err)
@@ -67,41 +61,56 @@ func (a *application) handleRequest() http.HandlerFunc {
 		}
 		accountKey := koda.AccountKey(requestPayload.Subject)
 
-		record, err := a.store.Get(accountKey)
-		if err != nil {
-			if !errors.Is(err, koda.ErrNotFound) {
-				log.Errorf("error getting record for AccountKey %q from store: %v", accountKey, err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			id, err := uuid.GenerateUUID()
-			if err != nil {
-				log.Errorf("error generating new AccountKey: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			record.AccountKey = koda.AccountKey(id)
-			record.ServiceKeys = make(map[string]koda.ServiceKey)
+		record, err := a.store.Get(r.Context(), accountKey)
+		if err != nil && !errors.Is(err, koda.ErrNotFound) {
+			log.Errorf("error getting record for AccountKey %q from store: %v", accountKey, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		unknown := err != nil
+
+		if record.Inactive {
+			log.Infof("denying request for inactive AccountKey %q", accountKey)
+			http.Error(w, "account inactive", a.inactiveStatus)
+			return
 		}
 
-		serviceName := serviceName(requestPayload)
-		serviceUserId, ok := record.ServiceKeys[serviceName]
-		if !ok {
-			id, err := uuid.GenerateUUID()
-			if err != nil {
-				log.Errorf("error generating new ServiceKey: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
+		serviceName, err := a.services.resolve(requestPayload)
+		if err != nil {
+			log.Errorf("error resolving service for %s%s: %v", requestPayload.MatchContext.URL.Host, requestPayload.MatchContext.URL.Path, err)
+			http.Error(w, "unknown service", http.StatusForbidden)
+			return
+		}
+		if unknown {
+			if err := a.provisioning.check(r.Context(), accountKey); err != nil {
+				if errors.Is(err, errUnknownAccount) {
+					http.Error(w, "account not found", a.provisioning.rejectStatus)
+					return
+				}
+				log.Errorf("error verifying unknown AccountKey %q: %v", accountKey, err)
+				http.Error(w, "account verification failed", http.StatusBadGateway)
 				return
 			}
-			serviceUserId = koda.ServiceKey(id)
-			record.ServiceKeys[serviceName] = serviceUserId
-			if err := a.store.Set(accountKey, record); err != nil {
-				log.Errorf("error saving record for AccountKey %q: %v", accountKey, err)
-				w.WriteHeader(http.StatusInternalServerError)
-			}
+		}
+		serviceUserId, record, err := a.serviceKey(r.Context(), accountKey, record, serviceName)
+		if err != nil {
+			log.Errorf("error creating ServiceKey for AccountKey %q: %v", accountKey, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if unknown {
+			a.provisioning.provision(accountKey, serviceName)
+		}
+		if record.Inactive {
+			log.Infof("denying request for inactive AccountKey %q", accountKey)
+			http.Error(w, "account inactive", a.inactiveStatus)
+			return
 		}
 
 		response := requestPayload
+		if response.Extra == nil {
+			response.Extra = make(map[string]interface{})
+		}
 		response.Extra[userIdExtraKey] = serviceUserId
 
 		e := json.NewEncoder(w)
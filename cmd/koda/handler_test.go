@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mindtastic/koda"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAccountKey = koda.AccountKey("f3e4a1a4-5a8e-4d47-9a4b-3c1b2c8a1b2e")
+
+func newTestApplication(t *testing.T) *application {
+	services, err := newServiceResolver([]string{sourceURL}, "", "", defaultServiceRules)
+	assert.NoError(t, err)
+	rk, err := loadReceiptKey("")
+	assert.NoError(t, err)
+	store, err := koda.Open(context.Background(), "memory://")
+	assert.NoError(t, err)
+
+	return &application{
+		store:          store,
+		keyHistory:     koda.DefaultKeyHistory,
+		services:       services,
+		receiptKey:     rk,
+		inactiveStatus: http.StatusForbidden,
+		provisioning:   &provisioner{policy: provisionAuto, rejectStatus: http.StatusNotFound, client: http.DefaultClient},
+		keyMode:        keyModeRandom,
+	}
+}
+
+func (a *application) serve(method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	a.initializeMux().ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func hydratorBody(accountKey koda.AccountKey) string {
+	return `{"subject": "` + string(accountKey) + `", "extra": {}}`
+}
+
+func TestAccountActionsNotPublic(t *testing.T) {
+	a := newTestApplication(t)
+	assert.NoError(t, a.store.Set(context.Background(), testAccountKey, koda.Record{
+		AccountKey:  testAccountKey,
+		ServiceKeys: map[string]koda.ServiceKey{"user-service": "key"},
+	}))
+
+	// Account actions are only served on the admin API
+	assert.Equal(t, http.StatusBadRequest, a.serve(http.MethodDelete, "/"+string(testAccountKey), "").Code)
+	assert.Equal(t, http.StatusBadRequest, a.serve(http.MethodPut, "/"+string(testAccountKey)+"/rotate", `{"reason": "leak"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, a.serve(http.MethodPut, "/"+string(testAccountKey)+"/deactivate", `{"reason": "fraud"}`).Code)
+	r, err := a.store.Get(context.Background(), testAccountKey)
+	assert.NoError(t, err)
+	assert.False(t, r.Inactive)
+	assert.Equal(t, koda.ServiceKey("key"), r.ServiceKeys["user-service"])
+}
+
+func TestHandleRequest_Concurrent(t *testing.T) {
+	a := newTestApplication(t)
+	const workers = 32
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		keys = make(map[string]bool)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := a.serve(http.MethodPost, "/", hydratorBody(testAccountKey))
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var response hydratorPayload
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+			mu.Lock()
+			keys[response.Extra["userID"].(string)] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, keys, 1, "more than one ServiceKey issued: %v", keys)
+
+	r, err := a.store.Get(context.Background(), testAccountKey)
+	assert.NoError(t, err)
+	assert.Equal(t, testAccountKey, r.AccountKey)
+}
+
+func TestHandleRequest_Derived(t *testing.T) {
+	a := newTestApplication(t)
+	a.keyMode = keyModeDerived
+	a.keySecret = bytes.Repeat([]byte{1}, minServiceKeySecretSize)
+
+	userID := func() string {
+		w := a.serve(http.MethodPost, "/", hydratorBody(testAccountKey))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response hydratorPayload
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		return response.Extra["userID"].(string)
+	}
+
+	key := userID()
+	assert.Equal(t, key, userID())
+	r, err := a.store.Get(context.Background(), testAccountKey)
+	assert.NoError(t, err)
+	assert.Empty(t, r.ServiceKeys)
+	assert.Len(t, r.Salt, koda.SaltSize)
+	derived, err := koda.DeriveServiceKey(a.keySecret, r, "user-service")
+	assert.NoError(t, err)
+	assert.Equal(t, string(derived), key)
+
+	a.adminTokens = []adminToken{{name: "support", token: testAdminToken}}
+	w := a.serveAdmin(http.MethodPut, "/accounts/"+string(testAccountKey)+"/rotate", testAdminToken, `{"reason": "leak"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	rotated := userID()
+	assert.NotEqual(t, key, rotated)
+
+	// A removed derived ServiceKey is never derived again
+	w = a.serveAdmin(http.MethodDelete, "/accounts/"+string(testAccountKey)+"/services/user-service", testAdminToken, `{"reason": "cleanup"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	r, err = a.store.Get(context.Background(), testAccountKey)
+	assert.NoError(t, err)
+	assert.Len(t, r.KeyHistory, 1)
+	reprovisioned := userID()
+	assert.NotEqual(t, key, reprovisioned)
+	assert.NotEqual(t, rotated, reprovisioned)
+	rotated = reprovisioned
+
+	// Erasing the salt shreds every derived ServiceKey
+	w = a.serveAdmin(http.MethodDelete, "/accounts/"+string(testAccountKey)+"?reason=DSR-1", testAdminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var receipt deletionReceipt
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&receipt))
+	assert.Equal(t, []string{"user-service"}, receipt.Services)
+	assert.NotEqual(t, rotated, userID())
+
+	// Stored ServiceKeys take precedence over derived ones
+	assert.NoError(t, a.store.Set(context.Background(), testAccountKey, koda.Record{
+		AccountKey:  testAccountKey,
+		ServiceKeys: map[string]koda.ServiceKey{"user-service": "stored"},
+	}))
+	assert.Equal(t, "stored", userID())
+}
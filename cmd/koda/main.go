@@ -2,53 +2,205 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/reverse"
+	"github.com/mindtastic/koda/store/cache"
 	"github.com/mindtastic/koda/store/localfile"
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/mindtastic/koda/log"
 )
 
+var configPath = flag.String(configFlag, "", "YAML or JSON file to read configuration from. Flags take precedence over environment variables, which take precedence over the file")
 var addr = flag.String("addr", ":8000", "Address to listen on for API connections")
-var dbpath = flag.String("db", "/data/db/koda.db", "File to store database")
+var tlsCertFile = flag.String("tls-cert-file", "", "PEM encoded certificate to serve the API and admin API with TLS. TLS is disabled if empty")
+var tlsKeyFile = flag.String("tls-key-file", "", "PEM encoded private key of the TLS certificate")
+var logLevel = flag.String("log-level", "info", "Minimum level of log messages (debug, info, warning, error, fatal)")
+var storeURI = flag.String("store", defaultStoreURI, "URI of the store to use. The scheme selects the backend (file, memory, bolt, postgres, redis, raft)")
+var flushInterval = flag.Duration("flush-interval", 0, "Interval in which file stores are written to their data file. The store default is used if 0")
+var keyHistory = flag.Int("key-history", koda.DefaultKeyHistory, "Number of previous ServiceKeys kept per service after rotation")
+var serviceLookup = flag.String("service-lookup", sourceURL, "Comma separated order of sources to resolve the service from (url, capture, header, extra)")
+var serviceHeader = flag.String("service-header", "X-Koda-Service", "Request header to resolve the service from")
+var serviceExtra = flag.String("service-extra", "service", "Field of extra to resolve the service from")
+var serviceRules = flag.String("service-rules", "", "JSON file with rules mapping match patterns to service names")
+var receiptKey = flag.String("receipt-key", "", "PEM encoded ed25519 private key to sign deletion receipts with")
+var adminAddr = flag.String("admin-addr", "", "Address to listen on for admin API connections, which also serves account rotation, deactivation and deletion. The admin API is disabled if empty")
+var adminTokens = flag.String("admin-tokens", "", "File with bearer tokens for the admin API, one <name>:<token> per line")
+var auditLogPath = flag.String("audit-log", "", "File to append audit entries of sensitive admin operations to")
+var reverseIndexPath = flag.String("reverse-index", "", "File to store the reverse index from ServiceKeys to AccountKeys. The reverse index is disabled if empty")
+var reverseIndexKeyFile = flag.String("reverse-index-key-file", "", "File with the base64 encoded key of the reverse index")
+var serviceKeyMode = flag.String("service-keys", keyModeRandom, "How new ServiceKeys are issued (random, derived). Derived keys are computed from a per-account salt and are not stored")
+var serviceKeySecretFile = flag.String("service-key-secret-file", "", "File with the base64 encoded secret to derive ServiceKeys with")
+var migrateTo = flag.String("migrate-to", "", "URI of a store to migrate to in the background. All writes go to both stores during the migration")
+var cacheSize = flag.Int("cache-size", 0, "Number of records cached in memory in front of the store. The cache is disabled if 0. Only writes of this process invalidate it, so it cannot be used with stores shared by several replicas (postgres, redis, raft), neither as -store nor as -migrate-to")
+var cacheTTL = flag.Duration("cache-ttl", cache.DefaultTTL, "Time records are cached for. Cached records only expire when they are evicted if 0")
+var cacheNegativeTTL = flag.Duration("cache-negative-ttl", cache.DefaultNegativeTTL, "Time unknown AccountKeys are cached for. Unknown AccountKeys are not cached if 0")
+var provisioning = flag.String("provisioning", provisionAuto, "How records are created for unknown AccountKeys (auto, reject, verify)")
+var provisioningRejectStatus = flag.Int("provisioning-reject-status", http.StatusNotFound, "HTTP status unknown AccountKeys are rejected with (401, 404)")
+var provisioningWebhook = flag.String("provisioning-webhook", "", "URL of the account verification webhook asked before creating records with the verify policy")
+var provisioningWebhookTokenFile = flag.String("provisioning-webhook-token-file", "", "File with a bearer token for the account verification webhook")
+var inactiveStatus = flag.Int("inactive-status", http.StatusForbidden, "HTTP status the hydrator answers with for inactive accounts")
 
 type application struct {
-	mu         sync.RWMutex
-	store      koda.Store
-	httpServer *http.Server
+	store          koda.Store
+	httpServer     *http.Server
+	keyHistory     int
+	services       *serviceResolver
+	receiptKey     ed25519.PrivateKey
+	inactiveStatus int
+	provisioning   *provisioner
+	keyMode        string
+	keySecret      []byte // Only set if keyMode is keyModeDerived
+
+	adminServer  *http.Server
+	adminTokens  []adminToken
+	audit        *auditLog
+	reverseIndex *reverse.Index
+	migration    *migration   // Only set if a migration is running
+	cache        *cache.Store // Only set if the cache is enabled
+}
+
+// commands are the subcommands of koda. Without a subcommand, koda runs the server.
+var commands = map[string]func(args []string) error{
+	"config":  runConfig,
+	"export":  runExport,
+	"import":  runImport,
+	"migrate": runMigrate,
 }
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [config|export|import|migrate [command flags]]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "Every flag can also be set in the environment as %s<FLAG_NAME>, e.g. %s, or in the configuration file.\n", envPrefix, envName("admin-addr"))
+	}
 	flag.Parse()
 
-	lfs := localfile.New()
-	if err := lfs.InitializePersistence(*dbpath); err != nil {
+	c, err := loadConfig(flag.CommandLine, os.LookupEnv)
+	if err != nil {
+		log.Fatalf("error loading configuration: %v", err)
+	}
+	effectiveConfig = c
+	logger, err := log.New(*logLevel, os.Stdout)
+	if err != nil {
+		log.Fatalf("error configuring logger: %v", err)
+	}
+	log.Set(logger)
+	if *configPath != "" {
+		log.Infof("loaded configuration from %s", *configPath)
+	}
+
+	if flag.NArg() > 0 {
+		cmd, ok := commands[flag.Arg(0)]
+		if !ok {
+			flag.Usage()
+			log.Fatalf("unknown command %q", flag.Arg(0))
+		}
+		if err := cmd(flag.Args()[1:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+			log.Fatalf("error running %s: %v", flag.Arg(0), err)
+		}
+		return
+	}
+
+	if err := validateConfig(); err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+
+	store, err := koda.Open(context.Background(), withFlushInterval(*storeURI, *flushInterval))
+	if err != nil {
 		log.Fatalf("error initializing database: %v", err)
 	}
 
+	rules, err := configuredServiceRules()
+	if err != nil {
+		log.Fatalf("error loading service rules: %v", err)
+	}
+	if rules == nil {
+		rules = defaultServiceRules
+		log.Warnf("no service rules configured, every request is resolved to the user-service")
+	}
+	services, err := newServiceResolver(parseServiceOrder(*serviceLookup), *serviceHeader, *serviceExtra, rules)
+	if err != nil {
+		log.Fatalf("error configuring service resolution: %v", err)
+	}
+
+	var keySecret []byte
+	if *serviceKeyMode == keyModeDerived {
+		if keySecret, err = loadServiceKeySecret(); err != nil {
+			log.Fatalf("error loading service key secret: %v", err)
+		}
+		if *reverseIndexPath != "" {
+			log.Warnf("derived ServiceKeys are not stored and cannot be resolved with the reverse index")
+		}
+	}
+
+	prov, err := newProvisioner()
+	if err != nil {
+		log.Fatalf("error configuring provisioning: %v", err)
+	}
+
+	if *receiptKey == "" {
+		log.Warnf("no receipt key configured, deletion receipts are signed with an ephemeral key")
+	}
+	rk, err := loadReceiptKey(*receiptKey)
+	if err != nil {
+		log.Fatalf("error loading receipt key: %v", err)
+	}
+
 	app := &application{
 		httpServer: &http.Server{
 			Addr: *addr,
 		},
-		store: lfs,
+		store:          store,
+		keyHistory:     *keyHistory,
+		services:       services,
+		receiptKey:     rk,
+		inactiveStatus: *inactiveStatus,
+		provisioning:   prov,
+		keyMode:        *serviceKeyMode,
+		keySecret:      keySecret,
+	}
+
+	if err := app.configureMigration(); err != nil {
+		log.Fatalf("error configuring migration: %v", err)
+	}
+	app.configureCache()
+	if err := app.configureAdmin(); err != nil {
+		log.Fatalf("error configuring admin API: %v", err)
 	}
 
 	app.httpServer.Handler = app.initializeMux()
-	shutdown := make(chan os.Signal)
+	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
-		if err := app.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := listenAndServe(app.httpServer); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("error listening on address %q: %v", app.httpServer.Addr, err)
 		}
 	}()
 	log.Infof("listening on address %q", app.httpServer.Addr)
+
+	if app.adminServer != nil {
+		go func() {
+			if err := listenAndServe(app.adminServer); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("error listening on admin address %q: %v", app.adminServer.Addr, err)
+			}
+		}()
+		log.Infof("listening for admin API on address %q", app.adminServer.Addr)
+	}
+
+	if lfs, ok := store.(*localfile.LocalFileStore); ok {
+		go reloadKeysOnSignal(lfs, *storeURI)
+	}
+
 	<-shutdown
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -57,7 +209,35 @@ func main() {
 	if err := app.httpServer.Shutdown(ctx); err != nil {
 		log.Errorf("error shutting down server: %v", err)
 	}
-	if err := lfs.Shutdown(); err != nil {
+	if app.adminServer != nil {
+		if err := app.adminServer.Shutdown(ctx); err != nil {
+			log.Errorf("error shutting down admin server: %v", err)
+		}
+	}
+	if app.reverseIndex != nil {
+		if err := app.reverseIndex.Close(); err != nil {
+			log.Errorf("error closing reverse index: %v", err)
+		}
+	}
+	if app.audit != nil {
+		if err := app.audit.Close(); err != nil {
+			log.Errorf("error closing audit log: %v", err)
+		}
+	}
+	if err := closeStore(store); err != nil {
 		log.Errorf("error shutting down database: %v", err)
 	}
+	if app.migration != nil {
+		if err := closeStore(app.migration.target); err != nil {
+			log.Errorf("error shutting down migration target: %v", err)
+		}
+	}
+}
+
+// listenAndServe serves s with TLS, if a certificate is configured.
+func listenAndServe(s *http.Server) error {
+	if *tlsCertFile != "" {
+		return s.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile)
+	}
+	return s.ListenAndServe()
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/log"
+	"github.com/mindtastic/koda/store/dual"
+)
+
+// migrationProgressInterval is the interval in which the progress of a running migration is logged.
+const migrationProgressInterval = 10 * time.Second
+
+// migration is a migration from the store of the server to another store, running in the background.
+type migration struct {
+	store  *dual.Store
+	target koda.Store
+
+	mu     sync.Mutex
+	done   bool
+	err    error
+	report *dual.Report
+}
+
+// migrationStatus is the state of a migration as returned by the admin API.
+type migrationStatus struct {
+	dual.Progress
+	Done   bool         `json:"done"`
+	Error  string       `json:"error,omitempty"`
+	Report *dual.Report `json:"report,omitempty"`
+}
+
+// run copies all records to the target store and verifies them afterwards, logging the progress.
+func (m *migration) run(ctx context.Context) {
+	stop := logProgress(m.store)
+	err := m.store.Copy(ctx)
+	stop()
+	var report *dual.Report
+	if err == nil {
+		var r dual.Report
+		if r, err = m.store.Verify(ctx); err == nil {
+			report = &r
+			logReport(r)
+		}
+	}
+	if err != nil {
+		log.Errorf("error migrating store: %v", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.done, m.err, m.report = true, err, report
+}
+
+func (m *migration) status() migrationStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := migrationStatus{Progress: m.store.Progress(), Done: m.done, Report: m.report}
+	if m.err != nil {
+		s.Error = m.err.Error()
+	}
+	return s
+}
+
+// logProgress logs the progress of s until the returned function is called.
+func logProgress(s *dual.Store) func() {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(migrationProgressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				p := s.Progress()
+				log.Infof("migrated %d of %d records, %d mirror errors, %d records unmirrored", p.Copied, p.Total, p.MirrorErrors, p.Unmirrored)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func logReport(r dual.Report) {
+	if r.OK() {
+		log.Infof("verified %d migrated records", r.Checked)
+		return
+	}
+	log.Warnf("verified %d migrated records: %d missing, %d mismatched, %d extra", r.Checked, len(r.Missing), len(r.Mismatched), len(r.Extra))
+}
+
+// configureMigration starts a background migration of the store to the store at -migrate-to, if configured.
+// Until the server is restarted on the target store, all writes go to both stores.
+func (a *application) configureMigration() error {
+	if *migrateTo == "" {
+		return nil
+	}
+	target, err := koda.Open(context.Background(), *migrateTo)
+	if err != nil {
+		return fmt.Errorf("error opening migration target: %v", err)
+	}
+	a.migration = &migration{store: dual.New(a.store, target), target: target}
+	a.store = a.migration.store
+	go a.migration.run(context.Background())
+	log.Infof("migrating store to %s", redactURI(*migrateTo))
+	return nil
+}
+
+// handleMigration returns the status of the running migration. A POST to /migration/flip makes the target store serve
+// reads. Writes that failed to be mirrored to the target store are retried first, reads are not flipped if that fails.
+func (a *application) handleMigration() adminHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, actor string) {
+		switch {
+		case r.URL.Path == "/migration" && r.Method == http.MethodGet:
+		case r.URL.Path == "/migration/flip" && r.Method == http.MethodPost:
+			if err := a.migration.store.RetryMirrors(r.Context()); err != nil {
+				log.Errorf("error retrying mirrors, denying flip of migration reads: %v", err)
+				http.Error(w, fmt.Sprintf("reads cannot be flipped: %v", err), http.StatusConflict)
+				return
+			}
+			err := a.writeAudit(auditEntry{
+				Time:       time.Now().UTC(),
+				Actor:      actor,
+				RemoteAddr: r.RemoteAddr,
+				Action:     "flip-migration-reads",
+				Result:     "accepted",
+			})
+			if err != nil {
+				log.Errorf("error writing audit entry, denying flip of migration reads: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if err := a.migration.store.FlipReads(); err != nil {
+				log.Errorf("error flipping migration reads: %v", err)
+				http.Error(w, fmt.Sprintf("reads cannot be flipped: %v", err), http.StatusConflict)
+				return
+			}
+			if a.cache != nil {
+				a.cache.Purge()
+			}
+			log.Infof("reads flipped to migration target by %s", actor)
+		default:
+			http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		e := json.NewEncoder(w)
+		if err := e.Encode(a.migration.status()); err != nil {
+			log.Errorf("error encoding JSON response: %v", err)
+		}
+	}
+}
+
+// runMigrate implements the migrate subcommand. It copies all records from one store to another and verifies them.
+// Stores that cannot be shared between processes, like file:// and bolt:// stores, must not be in use by a running
+// server. A file:// store is opened read-only if it is not written to.
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	from := fs.String("from", "", "URI of the store to migrate from")
+	to := fs.String("to", "", "URI of the store to migrate to")
+	verifyOnly := fs.Bool("verify-only", false, "Only compare both stores without copying")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		return errors.New("-from and -to are required")
+	}
+	for _, uri := range []string{*from, *to} {
+		if err := checkOffline(uri); err != nil {
+			return err
+		}
+	}
+
+	src, err := koda.Open(context.Background(), readOnly(*from))
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", redactURI(*from), err)
+	}
+	defer closeStore(src)
+	target := *to
+	if *verifyOnly {
+		target = readOnly(target)
+	}
+	dst, err := koda.Open(context.Background(), target)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", redactURI(*to), err)
+	}
+
+	s := dual.New(src, dst)
+	ctx := context.Background()
+	if !*verifyOnly {
+		stop := logProgress(s)
+		err = s.Copy(ctx)
+		stop()
+		if err != nil {
+			closeStore(dst)
+			return err
+		}
+		log.Infof("copied %d records", s.Progress().Copied)
+	}
+	report, err := s.Verify(ctx)
+	if cerr := closeStore(dst); cerr != nil && err == nil {
+		err = fmt.Errorf("error closing %s: %v", redactURI(*to), cerr)
+	}
+	if err != nil {
+		return err
+	}
+	logReport(report)
+	if !report.OK() {
+		return errors.New("stores differ")
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/store/dual"
+	"github.com/mindtastic/koda/store/localfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunMigrate(t *testing.T) {
+	dir := t.TempDir()
+	from := "bolt://" + filepath.Join(dir, "koda.bolt")
+	to := "file://" + filepath.Join(dir, "koda.db")
+
+	src, err := koda.Open(context.Background(), from)
+	assert.NoError(t, err)
+	_, err = src.GetOrCreateServiceKey(context.Background(), testAccountKey, "user-service", "key")
+	assert.NoError(t, err)
+	assert.NoError(t, closeStore(src))
+
+	assert.Error(t, runMigrate([]string{"-from", from}))
+	assert.Error(t, runMigrate([]string{"-from", from, "-to", to, "-verify-only"}), "read-only stores are never created")
+	assert.NoError(t, runMigrate([]string{"-from", from, "-to", to}))
+	assert.NoError(t, runMigrate([]string{"-from", from, "-to", to, "-verify-only"}))
+	assert.EqualError(t, runMigrate([]string{"-from", to, "-to", "memory://", "-verify-only"}), "stores differ")
+	assert.Error(t, runMigrate([]string{"-from", "raft:///data/raft?id=koda-0&peers=koda-0@127.0.0.1:7000", "-to", to}))
+	assert.Error(t, runMigrate([]string{"-from", from, "-to", "raft:///data/raft?id=koda-0&peers=koda-0@127.0.0.1:7000"}))
+
+	dst, err := koda.Open(context.Background(), to)
+	assert.NoError(t, err)
+	defer closeStore(dst)
+	r, err := dst.Get(context.Background(), testAccountKey)
+	assert.NoError(t, err)
+	assert.Equal(t, koda.ServiceKey("key"), r.ServiceKeys["user-service"])
+}
+
+func TestHandleMigration(t *testing.T) {
+	a, _ := newTestAdminApplication(t)
+	target := localfile.New()
+	_, err := a.store.GetOrCreateServiceKey(context.Background(), testAccountKey, "user-service", "key")
+	assert.NoError(t, err)
+	a.migration = &migration{store: dual.New(a.store, target), target: target}
+	a.store = a.migration.store
+	a.migration.run(context.Background())
+
+	w := a.serveAdmin(http.MethodGet, "/migration", testAdminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var status migrationStatus
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	assert.True(t, status.Done)
+	assert.Equal(t, int64(1), status.Copied)
+	assert.True(t, status.Report.OK())
+
+	// The hydrator writes to both stores
+	w = a.serve(http.MethodPost, "/", hydratorBody("3f2b1a9c-0000-4000-8000-000000000001"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, err = target.Get(context.Background(), "3f2b1a9c-0000-4000-8000-000000000001")
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, a.serveAdmin(http.MethodGet, "/migration/flip", testAdminToken, "").Code)
+	w = a.serveAdmin(http.MethodPost, "/migration/flip", testAdminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	status = migrationStatus{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	assert.True(t, status.ReadsFlipped)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/log"
+)
+
+// Provisioning policies for accounts the store does not know yet.
+const (
+	// provisionAuto creates a record for every unknown AccountKey.
+	provisionAuto = "auto"
+	// provisionReject denies requests for unknown AccountKeys. Records must be created otherwise, e.g. by an import.
+	provisionReject = "reject"
+	// provisionVerify creates a record only if the account verification webhook confirms the AccountKey.
+	provisionVerify = "verify"
+
+	// provisionWebhookTimeout bounds a single request to the account verification webhook.
+	provisionWebhookTimeout = 5 * time.Second
+)
+
+// errUnknownAccount is returned by provisioner.check if an unknown AccountKey must not be provisioned.
+var errUnknownAccount = errors.New("unknown account")
+
+// provisioner decides whether records are created for unknown AccountKeys, as configured by the provisioning policy.
+type provisioner struct {
+	policy       string
+	rejectStatus int    // Status unknown accounts are rejected with
+	webhook      string // Only set for provisionVerify
+	token        string // Bearer token for the webhook, optional
+	client       *http.Client
+
+	// Provisioning events, accessed atomically
+	provisioned  int64
+	rejected     int64
+	verifyErrors int64
+}
+
+// provisioningStats are the provisioning events counted since the start, as returned by the admin API.
+type provisioningStats struct {
+	Policy             string `json:"policy"`
+	Provisioned        int64  `json:"provisioned"`
+	Rejected           int64  `json:"rejected"`
+	VerificationErrors int64  `json:"verificationErrors"`
+}
+
+// newProvisioner creates a provisioner from the command line flags.
+func newProvisioner() (*provisioner, error) {
+	p := &provisioner{
+		policy:       *provisioning,
+		rejectStatus: *provisioningRejectStatus,
+		client:       &http.Client{Timeout: provisionWebhookTimeout},
+	}
+	if p.policy != provisionVerify {
+		return p, nil
+	}
+	p.webhook = strings.TrimSuffix(*provisioningWebhook, "/")
+	if *provisioningWebhookTokenFile != "" {
+		b, err := os.ReadFile(*provisioningWebhookTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading provisioning webhook token: %v", err)
+		}
+		p.token = strings.TrimSpace(string(b))
+	}
+	return p, nil
+}
+
+// validateProvisioning checks the provisioning flags.
+func validateProvisioning() []string {
+	var errs []string
+	switch *provisioning {
+	case provisionAuto, provisionReject:
+	case provisionVerify:
+		u, err := url.Parse(*provisioningWebhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, "provisioning policy verify requires a http or https webhook URL")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown provisioning policy %q", *provisioning))
+	}
+	if *provisioningRejectStatus != http.StatusNotFound && *provisioningRejectStatus != http.StatusUnauthorized {
+		errs = append(errs, fmt.Sprintf("provisioning reject status must be 401 or 404, got %d", *provisioningRejectStatus))
+	}
+	return errs
+}
+
+// check returns nil if a record may be created for the unknown accountKey. It returns errUnknownAccount if the
+// account must be rejected, and any other error if the account could not be verified.
+func (p *provisioner) check(ctx context.Context, accountKey koda.AccountKey) error {
+	switch p.policy {
+	case provisionAuto:
+		return nil
+	case provisionVerify:
+		err := p.verify(ctx, accountKey)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, errUnknownAccount) {
+			atomic.AddInt64(&p.verifyErrors, 1)
+			return err
+		}
+	}
+	atomic.AddInt64(&p.rejected, 1)
+	log.Infof("rejecting request for unknown AccountKey %q", accountKey)
+	return errUnknownAccount
+}
+
+// verify asks the account verification webhook whether accountKey belongs to an existing account. The webhook is
+// called as GET <webhook>/<account_key> and must answer 200 for existing and 404 or 410 for unknown accounts, as the
+// account endpoint of bouncer does.
+func (p *provisioner) verify(ctx context.Context, accountKey koda.AccountKey) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.webhook+"/"+url.PathEscape(string(accountKey)), nil)
+	if err != nil {
+		return fmt.Errorf("error creating verification request: %v", err)
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling verification webhook: %v", err)
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound, http.StatusGone:
+		return errUnknownAccount
+	}
+	return fmt.Errorf("verification webhook answered with status %d", res.StatusCode)
+}
+
+// provision counts and logs that a record was created for accountKey.
+func (p *provisioner) provision(accountKey koda.AccountKey, service string) {
+	atomic.AddInt64(&p.provisioned, 1)
+	log.Infof("provisioned AccountKey %q for service %q with policy %s", accountKey, service, p.policy)
+}
+
+func (p *provisioner) stats() provisioningStats {
+	return provisioningStats{
+		Policy:             p.policy,
+		Provisioned:        atomic.LoadInt64(&p.provisioned),
+		Rejected:           atomic.LoadInt64(&p.rejected),
+		VerificationErrors: atomic.LoadInt64(&p.verifyErrors),
+	}
+}
+
+// handleProvisioningStats returns the provisioning events counted since the start.
+func (a *application) handleProvisioningStats() adminHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, actor string) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		e := json.NewEncoder(w)
+		if err := e.Encode(a.provisioning.stats()); err != nil {
+			log.Errorf("error encoding JSON response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mindtastic/koda"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleRequest_Provisioning(t *testing.T) {
+	const knownKey = koda.AccountKey("3f2b1a9c-0000-4000-8000-000000000001")
+	const failingKey = koda.AccountKey("3f2b1a9c-0000-4000-8000-000000000002")
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer webhook-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/accounts/" + string(knownKey):
+			w.WriteHeader(http.StatusOK)
+		case "/accounts/" + string(failingKey):
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer webhook.Close()
+
+	testCases := []struct {
+		name       string
+		policy     string
+		status     int
+		accountKey koda.AccountKey
+		expected   int
+		stats      provisioningStats
+	}{
+		{name: "auto", policy: provisionAuto, accountKey: testAccountKey, expected: http.StatusOK, stats: provisioningStats{Provisioned: 1}},
+		{name: "reject", policy: provisionReject, status: http.StatusNotFound, accountKey: testAccountKey, expected: http.StatusNotFound, stats: provisioningStats{Rejected: 1}},
+		{name: "reject unauthorized", policy: provisionReject, status: http.StatusUnauthorized, accountKey: testAccountKey, expected: http.StatusUnauthorized, stats: provisioningStats{Rejected: 1}},
+		{name: "verify known", policy: provisionVerify, status: http.StatusNotFound, accountKey: knownKey, expected: http.StatusOK, stats: provisioningStats{Provisioned: 1}},
+		{name: "verify unknown", policy: provisionVerify, status: http.StatusNotFound, accountKey: testAccountKey, expected: http.StatusNotFound, stats: provisioningStats{Rejected: 1}},
+		{name: "verify error", policy: provisionVerify, status: http.StatusNotFound, accountKey: failingKey, expected: http.StatusBadGateway, stats: provisioningStats{VerificationErrors: 1}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newTestApplication(t)
+			a.provisioning = &provisioner{policy: tc.policy, rejectStatus: tc.status, webhook: webhook.URL + "/accounts", token: "webhook-token", client: webhook.Client()}
+
+			w := a.serve(http.MethodPost, "/", hydratorBody(tc.accountKey))
+			assert.Equal(t, tc.expected, w.Code)
+			tc.stats.Policy = tc.policy
+			assert.Equal(t, tc.stats, a.provisioning.stats())
+
+			record, err := a.store.Get(context.Background(), tc.accountKey)
+			if tc.expected != http.StatusOK {
+				assert.ErrorIs(t, err, koda.ErrNotFound)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.accountKey, record.AccountKey)
+			assert.Len(t, record.ServiceKeys, 1)
+
+			// Known accounts are not provisioned again
+			assert.Equal(t, http.StatusOK, a.serve(http.MethodPost, "/", hydratorBody(tc.accountKey)).Code)
+			assert.Equal(t, int64(1), a.provisioning.stats().Provisioned)
+		})
+	}
+}
+
+func TestProvisioner_Verify(t *testing.T) {
+	status := http.StatusOK
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Authorization"))
+		w.WriteHeader(status)
+	}))
+	defer webhook.Close()
+	p := &provisioner{policy: provisionVerify, webhook: webhook.URL, client: webhook.Client()}
+
+	testCases := []struct {
+		status int
+		err    error
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusNotFound, err: errUnknownAccount},
+		{status: http.StatusGone, err: errUnknownAccount},
+		{status: http.StatusForbidden, err: errors.New("verification webhook answered with status 403")},
+	}
+	for _, tc := range testCases {
+		t.Run(http.StatusText(tc.status), func(t *testing.T) {
+			status = tc.status
+			assert.Equal(t, tc.err, p.verify(context.Background(), testAccountKey))
+		})
+	}
+
+	webhook.Close()
+	assert.Error(t, p.verify(context.Background(), testAccountKey))
+}
+
+func TestHandleProvisioningStats(t *testing.T) {
+	a, _ := newTestAdminApplication(t)
+	assert.Equal(t, http.StatusOK, a.serve(http.MethodPost, "/", hydratorBody(testAccountKey)).Code)
+
+	w := a.serveAdmin(http.MethodGet, "/provisioning", testAdminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"policy": "auto", "provisioned": 1, "rejected": 0, "verificationErrors": 0}`, w.Body.String())
+	assert.Equal(t, http.StatusUnauthorized, a.serveAdmin(http.MethodGet, "/provisioning", "", "").Code)
+}
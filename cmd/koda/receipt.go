@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mindtastic/koda"
+)
+
+// deletionReceipt proves that koda deleted all ServiceKeys of an account. It is signed with ed25519, so it can be
+// verified by anyone knowing the public key of the koda instance.
+type deletionReceipt struct {
+	ID         string          `json:"id"`
+	AccountKey koda.AccountKey `json:"accountKey"`
+	Services   []string        `json:"services"`
+	DeletedAt  time.Time       `json:"deletedAt"`
+	PublicKey  string          `json:"publicKey"`
+	Signature  string          `json:"signature,omitempty"`
+}
+
+// signedContent returns the canonical byte representation of r that is covered by the signature.
+func (r deletionReceipt) signedContent() ([]byte, error) {
+	r.Signature = ""
+	return json.Marshal(r)
+}
+
+// sign sets the public key and signature of r.
+func (r *deletionReceipt) sign(key ed25519.PrivateKey) error {
+	r.PublicKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	c, err := r.signedContent()
+	if err != nil {
+		return fmt.Errorf("error encoding receipt: %v", err)
+	}
+	r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, c))
+	return nil
+}
+
+// verify checks the signature of r against its public key.
+// Callers must check that the public key belongs to a trusted koda instance.
+func (r deletionReceipt) verify() error {
+	pub, err := base64.StdEncoding.DecodeString(r.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("invalid public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return errors.New("invalid signature encoding")
+	}
+	c, err := r.signedContent()
+	if err != nil {
+		return fmt.Errorf("error encoding receipt: %v", err)
+	}
+	if !ed25519.Verify(pub, c, sig) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// loadReceiptKey reads a PEM encoded PKCS #8 ed25519 private key from path.
+// If path is empty, a new key is generated which is only valid for the lifetime of the process.
+func loadReceiptKey(path string) (ed25519.PrivateKey, error) {
+	if path == "" {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("error generating receipt key: %v", err)
+		}
+		return key, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading receipt key: %v", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing receipt key %s: %v", path, err)
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("receipt key %s is not an ed25519 key", path)
+	}
+	return key, nil
+}
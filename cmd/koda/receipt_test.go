@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeletionReceipt(t *testing.T) {
+	key, err := loadReceiptKey("")
+	assert.NoError(t, err)
+
+	r := deletionReceipt{
+		ID:         "c0ffee",
+		AccountKey: "f3e4a1a4-5a8e-4d47-9a4b-3c1b2c8a1b2e",
+		Services:   []string{"diary-service", "user-service"},
+		DeletedAt:  time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+	assert.NoError(t, r.sign(key))
+	assert.NoError(t, r.verify())
+
+	tampered := r
+	tampered.Services = []string{"user-service"}
+	assert.EqualError(t, tampered.verify(), "signature mismatch")
+
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	forged := r
+	assert.NoError(t, forged.sign(other))
+	assert.NotEqual(t, r.PublicKey, forged.PublicKey)
+}
+
+func TestLoadReceiptKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "receipt.pem")
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	loaded, err := loadReceiptKey(path)
+	assert.NoError(t, err)
+	assert.True(t, key.Equal(loaded))
+
+	invalid := filepath.Join(t.TempDir(), "invalid.pem")
+	assert.NoError(t, os.WriteFile(invalid, []byte("not a key"), 0600))
+	_, err = loadReceiptKey(invalid)
+	assert.EqualError(t, err, "no PEM data found in "+invalid)
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/log"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// handleListAccounts lists AccountKeys in ascending order. The page size is given by the limit query parameter, the
+// next page is requested by passing the next AccountKey of the response as the after query parameter.
+func (a *application) handleListAccounts() adminHandlerFunc {
+	type response struct {
+		AccountKeys []koda.AccountKey `json:"accountKeys"`
+		Next        koda.AccountKey   `json:"next,omitempty"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, actor string) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		limit := defaultListLimit
+		if l := r.URL.Query().Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 || n > maxListLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		keys, err := a.store.List(r.Context(), koda.AccountKey(r.URL.Query().Get("after")), limit)
+		if err != nil {
+			log.Errorf("error listing AccountKeys: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		res := response{AccountKeys: keys}
+		if res.AccountKeys == nil {
+			res.AccountKeys = []koda.AccountKey{}
+		}
+		if len(keys) == limit {
+			res.Next = keys[len(keys)-1]
+		}
+
+		e := json.NewEncoder(w)
+		if err := e.Encode(res); err != nil {
+			log.Errorf("error encoding JSON response: %v", err)
+		}
+	}
+}
+
+// handleServiceCounts counts the accounts holding a ServiceKey for each service. It walks the whole store.
+func (a *application) handleServiceCounts() adminHandlerFunc {
+	type response struct {
+		Accounts int            `json:"accounts"`
+		Services map[string]int `json:"services"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, actor string) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		res := response{Services: make(map[string]int)}
+		err := koda.Walk(r.Context(), a.store, maxListLimit, func(record koda.Record) error {
+			res.Accounts++
+			for _, s := range record.Services() {
+				res.Services[s]++
+			}
+			return nil
+		})
+		if err != nil {
+			log.Errorf("error walking records: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		e := json.NewEncoder(w)
+		if err := e.Encode(res); err != nil {
+			log.Errorf("error encoding JSON response: %v", err)
+		}
+	}
+}
+
+// accountHandlerFunc handles an authenticated admin request on a resource below /accounts/{account_key}.
+type accountHandlerFunc func(w http.ResponseWriter, r *http.Request, actor string, accountKey koda.AccountKey)
+
+// handleAccount dispatches requests on /accounts/{account_key}, /accounts/{account_key}/{action} and
+// /accounts/{account_key}/services/{service}.
+func (a *application) handleAccount() adminHandlerFunc {
+	view := a.handleViewRecord()
+	del := a.handleDelete()
+	mapping := a.handleServiceMapping()
+	actions := map[string]accountHandlerFunc{
+		"rotate":     a.handleRotate(),
+		"deactivate": a.handleSetInactive(true),
+		"reactivate": a.handleSetInactive(false),
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, actor string) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/accounts/"), "/")
+		if _, err := uuid.ParseUUID(parts[0]); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		accountKey := koda.AccountKey(parts[0])
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			del(w, r, actor, accountKey)
+		case len(parts) == 1:
+			view(w, r, actor, accountKey)
+		case len(parts) == 2 && actions[parts[1]] != nil:
+			actions[parts[1]](w, r, actor, accountKey)
+		case len(parts) == 3 && parts[1] == "services" && parts[2] != "":
+			mapping(w, r, actor, accountKey, parts[2])
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// handleViewRecord returns the record of an account. As the record links the account to its ServiceKeys, every view
+// requires a reason and is written to the audit log, if configured, before the record is returned.
+func (a *application) handleViewRecord() accountHandlerFunc {
+	const action = "view-record"
+
+	return func(w http.ResponseWriter, r *http.Request, actor string, accountKey koda.AccountKey) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+			return
+		}
+		reason := r.URL.Query().Get("reason")
+		if reason == "" {
+			http.Error(w, "reason must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		entry := auditEntry{
+			Time:       time.Now().UTC(),
+			Actor:      actor,
+			RemoteAddr: r.RemoteAddr,
+			Action:     action,
+			Reason:     reason,
+			AccountKey: accountKey,
+		}
+		record, err := a.store.Get(r.Context(), accountKey)
+		switch {
+		case err == nil:
+			entry.Result = "found"
+		case errors.Is(err, koda.ErrNotFound):
+			entry.Result = "not found"
+		default:
+			entry.Result = "error"
+		}
+		if aerr := a.writeAudit(entry); aerr != nil {
+			log.Errorf("error writing audit entry, denying record view: %v", aerr)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if err != nil {
+			if errors.Is(err, koda.ErrNotFound) {
+				http.Error(w, "account not found", http.StatusNotFound)
+				return
+			}
+			log.Errorf("error getting record for AccountKey %q from store: %v", accountKey, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		e := json.NewEncoder(w)
+		if err := e.Encode(record); err != nil {
+			log.Errorf("error encoding JSON response: %v", err)
+		}
+	}
+}
+
+// changeError is returned by a record change that cannot be applied. It is answered with status and msg.
+type changeError struct {
+	status int
+	msg    string
+}
+
+func (e changeError) Error() string {
+	return e.msg
+}
+
+// updateRecord applies change to the record of accountKey with a single atomic koda.Store.Update, so concurrent
+// writes, including ServiceKeys issued by the hydrator meanwhile, are never overwritten. change is tried on the
+// current record first, so invalid changes are rejected before entry is written to the audit log. Errors are written
+// to w. It reports false if the record has not been updated.
+func (a *application) updateRecord(w http.ResponseWriter, r *http.Request, accountKey koda.AccountKey, entry auditEntry, change func(koda.Record) (koda.Record, error)) (koda.Record, bool) {
+	record, err := a.store.Get(r.Context(), accountKey)
+	if err == nil {
+		_, err = change(record.Clone())
+	}
+	if err != nil {
+		writeChangeError(w, accountKey, err)
+		return koda.Record{}, false
+	}
+
+	if err := a.writeAudit(entry); err != nil {
+		log.Errorf("error writing audit entry, denying %s: %v", entry.Action, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return koda.Record{}, false
+	}
+
+	record, err = a.store.Update(r.Context(), accountKey, change)
+	if err != nil {
+		writeChangeError(w, accountKey, err)
+		return koda.Record{}, false
+	}
+	return record, true
+}
+
+// writeChangeError answers a request whose change of the record of accountKey failed with err.
+func writeChangeError(w http.ResponseWriter, accountKey koda.AccountKey, err error) {
+	var ce changeError
+	switch {
+	case errors.As(err, &ce):
+		http.Error(w, ce.msg, ce.status)
+	case errors.Is(err, koda.ErrNotFound):
+		http.Error(w, "account not found", http.StatusNotFound)
+	default:
+		log.Errorf("error updating record for AccountKey %q: %v", accountKey, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// handleServiceMapping adds a ServiceKey for a service to an account with PUT, or removes the ServiceKey of a service
+// from an account with DELETE. A ServiceKey that is already mapped is never replaced, rotate it instead.
+// A derived ServiceKey is removed by moving the service on to its next epoch without keeping the removed key in the
+// KeyHistory, so the removed key can never be derived again and the service gets a new one on its next request.
+// Every change requires a reason and is written to the audit log, if configured, before it is applied. The audit entry
+// only names the service, not the ServiceKey.
+func (a *application) handleServiceMapping() func(w http.ResponseWriter, r *http.Request, actor string, accountKey koda.AccountKey, service string) {
+	type request struct {
+		ServiceKey koda.ServiceKey `json:"serviceKey"`
+		Reason     string          `json:"reason"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, actor string, accountKey koda.AccountKey, service string) {
+		if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+			return
+		}
+		add := r.Method == http.MethodPut
+
+		var req request
+		d := json.NewDecoder(r.Body)
+		if err := d.Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("malformed request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Reason == "" || (add && req.ServiceKey == "") {
+			http.Error(w, "serviceKey and reason must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		entry := auditEntry{
+			Time:       time.Now().UTC(),
+			Actor:      actor,
+			RemoteAddr: r.RemoteAddr,
+			Action:     "remove-service-key",
+			Reason:     req.Reason,
+			AccountKey: accountKey,
+			Service:    service,
+			Result:     "accepted",
+		}
+		change := func(record koda.Record) (koda.Record, error) {
+			_, stored := record.ServiceKeys[service]
+			_, derived := record.Epochs[service]
+			if !stored && !derived {
+				return record, changeError{status: http.StatusNotFound, msg: fmt.Sprintf("service %q not found", service)}
+			}
+			serviceKeys := make(map[string]koda.ServiceKey, len(record.ServiceKeys))
+			for s, k := range record.ServiceKeys {
+				if s != service {
+					serviceKeys[s] = k
+				}
+			}
+			// The epoch of a derived ServiceKey is kept and moved on instead, as the same key would be derived again
+			// from epoch 0 otherwise.
+			epochs := make(map[string]uint32, len(record.Epochs))
+			for s, e := range record.Epochs {
+				if s == service {
+					e++
+				}
+				epochs[s] = e
+			}
+			record.ServiceKeys, record.Epochs = serviceKeys, epochs
+			return record, nil
+		}
+		if add {
+			entry.Action = "add-service-key"
+			change = func(record koda.Record) (koda.Record, error) {
+				if _, ok := record.ServiceKeys[service]; ok {
+					return record, changeError{status: http.StatusConflict, msg: fmt.Sprintf("service %q already has a ServiceKey", service)}
+				}
+				serviceKeys := make(map[string]koda.ServiceKey, len(record.ServiceKeys)+1)
+				for s, k := range record.ServiceKeys {
+					serviceKeys[s] = k
+				}
+				serviceKeys[service] = req.ServiceKey
+				record.ServiceKeys = serviceKeys
+				return record, nil
+			}
+		}
+
+		record, ok := a.updateRecord(w, r, accountKey, entry, change)
+		if !ok {
+			return
+		}
+		log.Infof("%s of service %q for AccountKey %q by %s: %s", entry.Action, service, accountKey, actor, req.Reason)
+
+		e := json.NewEncoder(w)
+		if err := e.Encode(record); err != nil {
+			log.Errorf("error encoding JSON response: %v", err)
+		}
+	}
+}
+
+// handleRotate issues fresh ServiceKeys for an account. If no service is given in the request, all ServiceKeys of the
+// account are rotated. Previous keys are kept in the KeyHistory of the record.
+// Every rotation requires a reason and is written to the audit log, if configured, before it is applied.
+func (a *application) handleRotate() accountHandlerFunc {
+	const action = "rotate-service-keys"
+
+	type request struct {
+		Service string `json:"service"`
+		Reason  string `json:"reason"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, actor string, accountKey koda.AccountKey) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req request
+		d := json.NewDecoder(r.Body)
+		if err := d.Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("malformed request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Reason == "" {
+			http.Error(w, "reason must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now().UTC()
+		entry := auditEntry{
+			Time:       now,
+			Actor:      actor,
+			RemoteAddr: r.RemoteAddr,
+			Action:     action,
+			Reason:     req.Reason,
+			AccountKey: accountKey,
+			Service:    req.Service,
+			Result:     "accepted",
+		}
+		var rotated int
+		record, ok := a.updateRecord(w, r, accountKey, entry, func(record koda.Record) (koda.Record, error) {
+			services := []string{req.Service}
+			if req.Service == "" {
+				services = record.Services()
+			}
+			for _, service := range services {
+				if err := a.rotateServiceKey(&record, service, req.Reason, now); err != nil {
+					if errors.Is(err, koda.ErrNotFound) {
+						return record, changeError{status: http.StatusNotFound, msg: fmt.Sprintf("service %q not found", service)}
+					}
+					return record, fmt.Errorf("error rotating ServiceKey %q: %v", service, err)
+				}
+			}
+			rotated = len(services)
+			return record, nil
+		})
+		if !ok {
+			return
+		}
+		log.Infof("rotated %d service keys for AccountKey %q by %s: %s", rotated, accountKey, actor, req.Reason)
+
+		e := json.NewEncoder(w)
+		if err := e.Encode(record); err != nil {
+			log.Errorf("error encoding JSON response: %v", err)
+		}
+	}
+}
+
+// handleDelete deletes the record of an account. Without the ServiceKeys, any data downstream services stored for the
+// account can no longer be linked to it. The response is a signed deletionReceipt. Whether copies of the record remain
+// on disk depends on the store, see koda.Store.Delete.
+// The account is deactivated before it is deleted, so no ServiceKey can be issued that the receipt does not list.
+// Every deletion requires a reason and is written to the audit log, if configured, before it is applied.
+func (a *application) handleDelete() accountHandlerFunc {
+	const action = "delete-account"
+
+	return func(w http.ResponseWriter, r *http.Request, actor string, accountKey koda.AccountKey) {
+		reason := r.URL.Query().Get("reason")
+		if reason == "" {
+			http.Error(w, "reason must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		id, err := uuid.GenerateUUID()
+		if err != nil {
+			log.Errorf("error generating receipt id: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		receipt := deletionReceipt{
+			ID:         id,
+			AccountKey: accountKey,
+			DeletedAt:  time.Now().UTC(),
+		}
+
+		entry := auditEntry{
+			Time:       receipt.DeletedAt,
+			Actor:      actor,
+			RemoteAddr: r.RemoteAddr,
+			Action:     action,
+			Reason:     reason,
+			AccountKey: accountKey,
+			Result:     "accepted",
+		}
+		record, ok := a.updateRecord(w, r, accountKey, entry, func(record koda.Record) (koda.Record, error) {
+			record.Deactivate(reason, receipt.DeletedAt)
+			return record, nil
+		})
+		if !ok {
+			return
+		}
+		receipt.Services = record.Services()
+
+		if err := a.store.Delete(r.Context(), accountKey); err != nil {
+			log.Errorf("error deleting deactivated record for AccountKey %q: %v", accountKey, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := receipt.sign(a.receiptKey); err != nil {
+			log.Errorf("error signing deletion receipt %s: %v", receipt.ID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Infof("deleted record for AccountKey %q by %s, receipt %s: %s", accountKey, actor, receipt.ID, reason)
+
+		e := json.NewEncoder(w)
+		if err := e.Encode(receipt); err != nil {
+			log.Errorf("error encoding JSON response: %v", err)
+		}
+	}
+}
+
+// handleSetInactive deactivates or reactivates an account. While an account is inactive, the hydrator denies any
+// request for it. Every change requires a reason and is written to the audit log, if configured, before it is applied.
+func (a *application) handleSetInactive(inactive bool) accountHandlerFunc {
+	action := "reactivate-account"
+	if inactive {
+		action = "deactivate-account"
+	}
+
+	type request struct {
+		Reason string `json:"reason"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, actor string, accountKey koda.AccountKey) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req request
+		d := json.NewDecoder(r.Body)
+		if err := d.Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("malformed request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Reason == "" {
+			http.Error(w, "reason must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now().UTC()
+		entry := auditEntry{
+			Time:       now,
+			Actor:      actor,
+			RemoteAddr: r.RemoteAddr,
+			Action:     action,
+			Reason:     req.Reason,
+			AccountKey: accountKey,
+			Result:     "accepted",
+		}
+		record, ok := a.updateRecord(w, r, accountKey, entry, func(record koda.Record) (koda.Record, error) {
+			if inactive {
+				record.Deactivate(req.Reason, now)
+			} else {
+				record.Reactivate()
+			}
+			return record, nil
+		})
+		if !ok {
+			return
+		}
+		log.Infof("%s of AccountKey %q by %s: %s", action, accountKey, actor, req.Reason)
+
+		e := json.NewEncoder(w)
+		if err := e.Encode(record); err != nil {
+			log.Errorf("error encoding JSON response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mindtastic/koda"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleListAccounts(t *testing.T) {
+	a, _ := newTestAdminApplication(t)
+	keys := []koda.AccountKey{
+		"3f2b1a9c-0000-4000-8000-000000000001",
+		"3f2b1a9c-0000-4000-8000-000000000002",
+		"3f2b1a9c-0000-4000-8000-000000000003",
+	}
+	for _, k := range keys {
+		assert.NoError(t, a.store.Set(context.Background(), k, koda.Record{AccountKey: k}))
+	}
+
+	type page struct {
+		AccountKeys []koda.AccountKey `json:"accountKeys"`
+		Next        koda.AccountKey   `json:"next"`
+	}
+	assert.Equal(t, http.StatusUnauthorized, a.serveAdmin(http.MethodGet, "/accounts", "", "").Code)
+	assert.Equal(t, http.StatusBadRequest, a.serveAdmin(http.MethodGet, "/accounts?limit=0", testAdminToken, "").Code)
+
+	w := a.serveAdmin(http.MethodGet, "/accounts?limit=2", testAdminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var p page
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&p))
+	assert.Equal(t, keys[:2], p.AccountKeys)
+	assert.Equal(t, keys[1], p.Next)
+
+	w = a.serveAdmin(http.MethodGet, "/accounts?limit=2&after="+string(p.Next), testAdminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	p = page{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&p))
+	assert.Equal(t, keys[2:], p.AccountKeys)
+	assert.Empty(t, p.Next)
+}
+
+func TestHandleServiceCounts(t *testing.T) {
+	a, _ := newTestAdminApplication(t)
+	assert.NoError(t, a.store.Set(context.Background(), testAccountKey, koda.Record{
+		AccountKey:  testAccountKey,
+		ServiceKeys: map[string]koda.ServiceKey{"user-service": "a", "diary-service": "b"},
+	}))
+	_, err := a.store.GetOrCreateServiceKey(context.Background(), "3f2b1a9c-0000-4000-8000-000000000001", "user-service", "c")
+	assert.NoError(t, err)
+
+	w := a.serveAdmin(http.MethodGet, "/services", testAdminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"accounts": 2, "services": {"user-service": 2, "diary-service": 1}}`, w.Body.String())
+}
+
+func TestHandleAccount(t *testing.T) {
+	a, auditPath := newTestAdminApplication(t)
+	path := "/accounts/" + string(testAccountKey)
+
+	assert.Equal(t, http.StatusBadRequest, a.serveAdmin(http.MethodGet, path, testAdminToken, "").Code)
+	assert.Equal(t, http.StatusNotFound, a.serveAdmin(http.MethodGet, path+"?reason=DSR-1", testAdminToken, "").Code)
+	assert.Equal(t, http.StatusNotFound, a.serveAdmin(http.MethodGet, "/accounts/not-a-uuid", testAdminToken, "").Code)
+
+	_, err := a.store.GetOrCreateServiceKey(context.Background(), testAccountKey, "user-service", "user-key")
+	assert.NoError(t, err)
+
+	w := a.serveAdmin(http.MethodGet, path+"?reason=DSR-1", testAdminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var r koda.Record
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&r))
+	assert.Equal(t, koda.ServiceKey("user-key"), r.ServiceKeys["user-service"])
+
+	w = a.serveAdmin(http.MethodPut, path+"/services/diary-service", testAdminToken, `{"serviceKey": "diary-key"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = a.serveAdmin(http.MethodPut, path+"/services/user-service", testAdminToken, `{"serviceKey": "other", "reason": "import"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = a.serveAdmin(http.MethodPut, path+"/services/diary-service", testAdminToken, `{"serviceKey": "diary-key", "reason": "import"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	r, err = a.store.Get(context.Background(), testAccountKey)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]koda.ServiceKey{"user-service": "user-key", "diary-service": "diary-key"}, r.ServiceKeys)
+
+	w = a.serveAdmin(http.MethodDelete, path+"/services/chat-service", testAdminToken, `{"reason": "cleanup"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = a.serveAdmin(http.MethodDelete, path+"/services/user-service", testAdminToken, `{"reason": "cleanup"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	r, err = a.store.Get(context.Background(), testAccountKey)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]koda.ServiceKey{"diary-service": "diary-key"}, r.ServiceKeys)
+
+	// The removed ServiceKey can no longer be resolved
+	w = a.serveAdmin(http.MethodPost, "/reverse-lookup", testAdminToken, `{"serviceKey": "user-key", "reason": "DSR-2"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	data, err := os.ReadFile(auditPath)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 5)
+	var entry auditEntry
+	assert.NoError(t, json.Unmarshal([]byte(lines[3]), &entry))
+	assert.Equal(t, "remove-service-key", entry.Action)
+	assert.Equal(t, "user-service", entry.Service)
+	assert.Equal(t, "cleanup", entry.Reason)
+	assert.NoError(t, json.Unmarshal([]byte(lines[2]), &entry))
+	assert.Equal(t, "add-service-key", entry.Action)
+	assert.Equal(t, "diary-service", entry.Service)
+
+	// Mapped ServiceKeys are not recorded next to the AccountKey
+	assert.NotContains(t, string(data), "diary-key")
+}
+
+// auditEntries reads the entries of the audit log at path.
+func auditEntries(t *testing.T, path string) []auditEntry {
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	var entries []auditEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var e auditEntry
+		assert.NoError(t, json.Unmarshal([]byte(line), &e))
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestHandleRotate(t *testing.T) {
+	a, auditPath := newTestAdminApplication(t)
+	assert.NoError(t, a.store.Set(context.Background(), testAccountKey, koda.Record{
+		AccountKey:  testAccountKey,
+		ServiceKeys: map[string]koda.ServiceKey{"user-service": "old-user", "diary-service": "old-diary"},
+	}))
+	path := "/accounts/" + string(testAccountKey) + "/rotate"
+
+	assert.Equal(t, http.StatusUnauthorized, a.serveAdmin(http.MethodPut, path, "", `{"reason": "leak"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, a.serveAdmin(http.MethodPut, path, testAdminToken, `{"service": "user-service"}`).Code)
+	assert.Equal(t, http.StatusNotFound, a.serveAdmin(http.MethodPut, path, testAdminToken, `{"service": "unknown", "reason": "test"}`).Code)
+
+	w := a.serveAdmin(http.MethodPut, path, testAdminToken, `{"service": "user-service", "reason": "leak"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	r, err := a.store.Get(context.Background(), testAccountKey)
+	assert.NoError(t, err)
+	assert.NotEqual(t, koda.ServiceKey("old-user"), r.ServiceKeys["user-service"])
+	assert.Equal(t, koda.ServiceKey("old-diary"), r.ServiceKeys["diary-service"])
+	assert.Len(t, r.KeyHistory, 1)
+
+	w = a.serveAdmin(http.MethodPut, path, testAdminToken, `{"reason": "all"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	r, err = a.store.Get(context.Background(), testAccountKey)
+	assert.NoError(t, err)
+	assert.NotEqual(t, koda.ServiceKey("old-diary"), r.ServiceKeys["diary-service"])
+	assert.Len(t, r.KeyHistory, 3)
+
+	entries := auditEntries(t, auditPath)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "rotate-service-keys", entries[0].Action)
+		assert.Equal(t, "support", entries[0].Actor)
+		assert.Equal(t, "leak", entries[0].Reason)
+		assert.Equal(t, "user-service", entries[0].Service)
+		assert.Equal(t, testAccountKey, entries[1].AccountKey)
+	}
+}
+
+// racingStore issues a ServiceKey for service, as the hydrator would, right before each Update of the record.
+type racingStore struct {
+	koda.Store
+	service string
+}
+
+func (s racingStore) Update(ctx context.Context, key koda.AccountKey, fn func(koda.Record) (koda.Record, error)) (koda.Record, error) {
+	if _, err := s.Store.GetOrCreateServiceKey(ctx, key, s.service, "hydrator-key"); err != nil {
+		return koda.Record{}, err
+	}
+	return s.Store.Update(ctx, key, fn)
+}
+
+func TestHandleRotate_ConcurrentServiceKey(t *testing.T) {
+	a, _ := newTestAdminApplication(t)
+	assert.NoError(t, a.store.Set(context.Background(), testAccountKey, koda.Record{
+		AccountKey:  testAccountKey,
+		ServiceKeys: map[string]koda.ServiceKey{"user-service": "old-user"},
+	}))
+	a.store = racingStore{Store: a.store, service: "diary-service"}
+
+	w := a.serveAdmin(http.MethodPut, "/accounts/"+string(testAccountKey)+"/rotate", testAdminToken, `{"service": "user-service", "reason": "leak"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	r, err := a.store.Get(context.Background(), testAccountKey)
+	assert.NoError(t, err)
+	assert.NotEqual(t, koda.ServiceKey("old-user"), r.ServiceKeys["user-service"])
+	assert.Equal(t, koda.ServiceKey("hydrator-key"), r.ServiceKeys["diary-service"])
+}
+
+func TestHandleDelete(t *testing.T) {
+	a, auditPath := newTestAdminApplication(t)
+	path := "/accounts/" + string(testAccountKey) + "?reason=DSR-1"
+
+	assert.Equal(t, http.StatusNotFound, a.serveAdmin(http.MethodDelete, path, testAdminToken, "").Code)
+
+	assert.NoError(t, a.store.Set(context.Background(), testAccountKey, koda.Record{
+		AccountKey:  testAccountKey,
+		ServiceKeys: map[string]koda.ServiceKey{"user-service": "key"},
+	}))
+	assert.Equal(t, http.StatusUnauthorized, a.serveAdmin(http.MethodDelete, path, "", "").Code)
+	assert.Equal(t, http.StatusBadRequest, a.serveAdmin(http.MethodDelete, "/accounts/"+string(testAccountKey), testAdminToken, "").Code)
+
+	w := a.serveAdmin(http.MethodDelete, path, testAdminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var receipt deletionReceipt
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&receipt))
+	assert.NoError(t, receipt.verify())
+	assert.Equal(t, testAccountKey, receipt.AccountKey)
+	assert.Equal(t, []string{"user-service"}, receipt.Services)
+
+	_, err := a.store.Get(context.Background(), testAccountKey)
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+
+	entries := auditEntries(t, auditPath)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "delete-account", entries[0].Action)
+		assert.Equal(t, "DSR-1", entries[0].Reason)
+		assert.Equal(t, testAccountKey, entries[0].AccountKey)
+	}
+
+	// Deletions are denied if they cannot be audited
+	assert.NoError(t, a.store.Set(context.Background(), testAccountKey, koda.Record{AccountKey: testAccountKey}))
+	assert.NoError(t, a.audit.Close())
+	assert.Equal(t, http.StatusInternalServerError, a.serveAdmin(http.MethodDelete, path, testAdminToken, "").Code)
+	_, err = a.store.Get(context.Background(), testAccountKey)
+	assert.NoError(t, err)
+}
+
+func TestHandleSetInactive(t *testing.T) {
+	a, auditPath := newTestAdminApplication(t)
+	assert.NoError(t, a.store.Set(context.Background(), testAccountKey, koda.Record{
+		AccountKey:  testAccountKey,
+		ServiceKeys: map[string]koda.ServiceKey{"user-service": "key"},
+	}))
+	path := "/accounts/" + string(testAccountKey)
+
+	w := a.serve(http.MethodPost, "/", hydratorBody(testAccountKey))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, http.StatusUnauthorized, a.serveAdmin(http.MethodPut, path+"/deactivate", "", `{"reason": "fraud"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, a.serveAdmin(http.MethodPut, path+"/deactivate", testAdminToken, `{}`).Code)
+
+	w = a.serveAdmin(http.MethodPut, path+"/deactivate", testAdminToken, `{"reason": "fraud"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	r, err := a.store.Get(context.Background(), testAccountKey)
+	assert.NoError(t, err)
+	assert.True(t, r.Inactive)
+	assert.Equal(t, "fraud", r.DeactivationReason)
+
+	w = a.serve(http.MethodPost, "/", hydratorBody(testAccountKey))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	assert.Equal(t, http.StatusBadRequest, a.serveAdmin(http.MethodPut, path+"/reactivate", testAdminToken, "").Code)
+	w = a.serveAdmin(http.MethodPut, path+"/reactivate", testAdminToken, `{"reason": "resolved"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = a.serve(http.MethodPost, "/", hydratorBody(testAccountKey))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	entries := auditEntries(t, auditPath)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "deactivate-account", entries[0].Action)
+		assert.Equal(t, "reactivate-account", entries[1].Action)
+		assert.Equal(t, "resolved", entries[1].Reason)
+	}
+}
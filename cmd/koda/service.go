@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Sources a service name can be resolved from.
+const (
+	sourceURL     = "url"     // Host and path of match_context.url
+	sourceCapture = "capture" // Each of match_context.regexp_capture_groups
+	sourceHeader  = "header"  // A configured request header
+	sourceExtra   = "extra"   // A configured string field of extra
+)
+
+var errUnknownService = errors.New("unknown service")
+
+// serviceRule maps candidates matching the regular expression Match to Service.
+type serviceRule struct {
+	Match   string `json:"match"`
+	Service string `json:"service"`
+
+	re *regexp.Regexp
+}
+
+// defaultServiceRules maps every request to the user-service. It is used if no rules are configured.
+var defaultServiceRules = []serviceRule{{Match: ".*", Service: "user-service"}}
+
+// serviceResolver derives the name of the service a hydrator request is meant for.
+// Candidates are taken from the sources in order and matched against the rules table. The first rule matching the
+// first candidate that matches any rule wins. Requests without any matching candidate belong to an unknown service.
+type serviceResolver struct {
+	order    []string
+	header   string
+	extraKey string
+	rules    []serviceRule
+}
+
+// newServiceResolver creates a serviceResolver. It validates the lookup order and compiles all rules.
+func newServiceResolver(order []string, header, extraKey string, rules []serviceRule) (*serviceResolver, error) {
+	for _, s := range order {
+		switch s {
+		case sourceURL, sourceCapture, sourceHeader, sourceExtra:
+		default:
+			return nil, fmt.Errorf("invalid service source %q", s)
+		}
+	}
+	if len(order) == 0 {
+		return nil, errors.New("no service source configured")
+	}
+
+	compiled := make([]serviceRule, len(rules))
+	for i, r := range rules {
+		if r.Service == "" {
+			return nil, fmt.Errorf("rule %d: service must not be empty", i)
+		}
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: error compiling match %q: %v", i, r.Match, err)
+		}
+		r.re = re
+		compiled[i] = r
+	}
+
+	return &serviceResolver{
+		order:    order,
+		header:   header,
+		extraKey: extraKey,
+		rules:    compiled,
+	}, nil
+}
+
+// loadServiceRules reads a JSON encoded list of serviceRules from path.
+func loadServiceRules(path string) ([]serviceRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening service rules: %v", err)
+	}
+	defer f.Close()
+
+	var rules []serviceRule
+	if err := json.NewDecoder(f).Decode(&rules); err != nil {
+		return nil, fmt.Errorf("error decoding service rules %s: %v", path, err)
+	}
+	return rules, nil
+}
+
+// parseServiceOrder parses a comma separated list of sources.
+func parseServiceOrder(s string) []string {
+	var order []string
+	for _, src := range strings.Split(s, ",") {
+		if src = strings.TrimSpace(src); src != "" {
+			order = append(order, src)
+		}
+	}
+	return order
+}
+
+// resolve returns the name of the service p is meant for. It returns errUnknownService if no rule matches.
+func (sr *serviceResolver) resolve(p hydratorPayload) (string, error) {
+	for _, src := range sr.order {
+		for _, c := range sr.candidates(src, p) {
+			for _, r := range sr.rules {
+				if r.re.MatchString(c) {
+					return r.Service, nil
+				}
+			}
+		}
+	}
+	return "", errUnknownService
+}
+
+func (sr *serviceResolver) candidates(src string, p hydratorPayload) []string {
+	switch src {
+	case sourceURL:
+		u := p.MatchContext.URL
+		return []string{u.Host + u.Path}
+	case sourceCapture:
+		return p.MatchContext.RegexpCaptureGroups
+	case sourceHeader:
+		if v := http.Header(p.Header).Get(sr.header); v != "" {
+			return []string{v}
+		}
+	case sourceExtra:
+		if v, ok := p.Extra[sr.extraKey].(string); ok && v != "" {
+			return []string{v}
+		}
+	}
+	return nil
+}
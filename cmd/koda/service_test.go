@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceResolver_Resolve(t *testing.T) {
+	rules := []serviceRule{
+		{Match: `^api\.example\.com/diary(/|$)`, Service: "diary-service"},
+		{Match: `^api\.example\.com/users(/|$)`, Service: "user-service"},
+		{Match: `^diary-service$`, Service: "diary-service"},
+	}
+
+	payload := func(host, path string, captures []string, header http.Header, extra map[string]interface{}) hydratorPayload {
+		var p hydratorPayload
+		p.MatchContext.URL = url.URL{Host: host, Path: path}
+		p.MatchContext.RegexpCaptureGroups = captures
+		p.Header = header
+		p.Extra = extra
+		return p
+	}
+
+	testCases := []struct {
+		name     string
+		order    []string
+		payload  hydratorPayload
+		expected string
+		err      error
+	}{
+		{name: "url", order: []string{sourceURL}, payload: payload("api.example.com", "/diary/entries", nil, nil, nil), expected: "diary-service"},
+		{name: "url prefix only", order: []string{sourceURL}, payload: payload("api.example.com", "/diaryx", nil, nil, nil), err: errUnknownService},
+		{name: "capture group", order: []string{sourceCapture}, payload: payload("", "", []string{"foo", "diary-service"}, nil, nil), expected: "diary-service"},
+		{name: "header", order: []string{sourceHeader}, payload: payload("", "", nil, http.Header{"X-Koda-Service": {"diary-service"}}, nil), expected: "diary-service"},
+		{name: "extra", order: []string{sourceExtra}, payload: payload("", "", nil, nil, map[string]interface{}{"service": "diary-service"}), expected: "diary-service"},
+		{name: "extra not a string", order: []string{sourceExtra}, payload: payload("", "", nil, nil, map[string]interface{}{"service": 42}), err: errUnknownService},
+		{name: "order", order: []string{sourceHeader, sourceURL}, payload: payload("api.example.com", "/users", nil, http.Header{"X-Koda-Service": {"diary-service"}}, nil), expected: "diary-service"},
+		{name: "fallthrough", order: []string{sourceHeader, sourceURL}, payload: payload("api.example.com", "/users", nil, nil, nil), expected: "user-service"},
+		{name: "unknown service", order: []string{sourceHeader, sourceURL}, payload: payload("api.example.com", "/", nil, http.Header{"X-Koda-Service": {"evil-service"}}, nil), err: errUnknownService},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sr, err := newServiceResolver(tc.order, "X-Koda-Service", "service", rules)
+			assert.NoError(t, err)
+
+			service, err := sr.resolve(tc.payload)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, service)
+		})
+	}
+}
+
+func TestNewServiceResolver(t *testing.T) {
+	testCases := []struct {
+		name  string
+		order []string
+		rules []serviceRule
+		err   string
+	}{
+		{name: "valid", order: []string{sourceURL, sourceExtra}, rules: defaultServiceRules},
+		{name: "invalid source", order: []string{"cookie"}, err: `invalid service source "cookie"`},
+		{name: "no source", order: nil, err: "no service source configured"},
+		{name: "invalid pattern", order: []string{sourceURL}, rules: []serviceRule{{Match: "(", Service: "a"}}, err: "rule 0: error compiling match \"(\": error parsing regexp: missing closing ): `(`"},
+		{name: "empty service", order: []string{sourceURL}, rules: []serviceRule{{Match: ".*"}}, err: "rule 0: service must not be empty"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newServiceResolver(tc.order, "", "", tc.rules)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
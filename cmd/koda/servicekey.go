@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-uuid"
+	"github.com/mindtastic/koda"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	keyModeRandom  = "random"
+	keyModeDerived = "derived"
+
+	serviceKeySecretEnv = "KODA_SERVICE_KEY_SECRET"
+
+	// minServiceKeySecretSize is the minimum size of the secret derived ServiceKeys are computed with.
+	minServiceKeySecretSize = 32
+)
+
+// loadServiceKeySecret loads the base64 encoded secret to derive ServiceKeys with from the file given by
+// -service-key-secret-file, or from the environment if no file is given.
+func loadServiceKeySecret() ([]byte, error) {
+	encoded := os.Getenv(serviceKeySecretEnv)
+	if *serviceKeySecretFile != "" {
+		b, err := os.ReadFile(*serviceKeySecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading service key secret: %v", err)
+		}
+		encoded = string(b)
+	}
+	if encoded == "" {
+		return nil, errors.New("derived service keys require a secret")
+	}
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding service key secret: %v", err)
+	}
+	if len(secret) < minServiceKeySecretSize {
+		return nil, fmt.Errorf("service key secret must be at least %d bytes, got %d", minServiceKeySecretSize, len(secret))
+	}
+	return secret, nil
+}
+
+// serviceKey returns the ServiceKey of service for the record of accountKey, creating the record and whatever the
+// configured key mode needs if necessary. A ServiceKey stored in the record always takes precedence, so records
+// created in random mode keep their keys after switching to derived mode.
+// The returned record is the current one from the store. Callers must check whether it is inactive, in which case the
+// returned ServiceKey is empty.
+func (a *application) serviceKey(ctx context.Context, accountKey koda.AccountKey, record koda.Record, service string) (koda.ServiceKey, koda.Record, error) {
+	if k, ok := record.ServiceKeys[service]; ok {
+		return k, record, nil
+	}
+	if a.keyMode == keyModeDerived {
+		if _, ok := record.Epochs[service]; !ok || len(record.Salt) == 0 {
+			salt, err := koda.NewSalt()
+			if err != nil {
+				return "", koda.Record{}, err
+			}
+			// A concurrent request might have created a salt in the meantime, which is returned instead.
+			if record, err = a.store.GetOrCreateSalt(ctx, accountKey, service, salt); err != nil {
+				return "", koda.Record{}, err
+			}
+			if record.Inactive {
+				return "", record, nil
+			}
+		}
+		k, err := koda.DeriveServiceKey(a.keySecret, record, service)
+		return k, record, err
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", koda.Record{}, fmt.Errorf("error generating new ServiceKey: %v", err)
+	}
+	// A concurrent request might have created a ServiceKey in the meantime, which is returned instead.
+	record, err = a.store.GetOrCreateServiceKey(ctx, accountKey, service, koda.ServiceKey(id))
+	if err != nil {
+		return "", koda.Record{}, err
+	}
+	return record.ServiceKeys[service], record, nil
+}
+
+// rotateServiceKey rotates the ServiceKey of service in record. Stored ServiceKeys are replaced by a fresh random
+// UUID, derived ServiceKeys move on to the next epoch.
+func (a *application) rotateServiceKey(record *koda.Record, service, reason string, at time.Time) error {
+	if _, ok := record.ServiceKeys[service]; ok || a.keyMode != keyModeDerived {
+		id, err := uuid.GenerateUUID()
+		if err != nil {
+			return fmt.Errorf("error generating new ServiceKey: %v", err)
+		}
+		return record.RotateServiceKey(service, koda.ServiceKey(id), reason, at, a.keyHistory)
+	}
+	return record.RotateDerivedServiceKey(a.keySecret, service, reason, at, a.keyHistory)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/log"
+	"github.com/mindtastic/koda/store/localfile"
+
+	// Store backends selectable with -store, registered with koda.Register
+	_ "github.com/mindtastic/koda/store/bolt"
+	_ "github.com/mindtastic/koda/store/postgres"
+	_ "github.com/mindtastic/koda/store/raft"
+	_ "github.com/mindtastic/koda/store/redis"
+)
+
+// defaultStoreURI is the store used if -store is not set.
+const defaultStoreURI = "file:///data/db/koda.db"
+
+// closeStore gracefully shuts down store, if supported by the backend.
+func closeStore(store koda.Store) error {
+	switch s := store.(type) {
+	case interface{ Shutdown() error }:
+		return s.Shutdown()
+	case io.Closer:
+		return s.Close()
+	}
+	return nil
+}
+
+// withFlushInterval returns the file:// store URI uri with its flush interval set to d, unless d is 0 or uri already
+// sets a flush interval. Other stores do not flush and ignore d.
+func withFlushInterval(uri string, d time.Duration) string {
+	if d == 0 {
+		return uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	if u.Scheme != "file" {
+		log.Warnf("flush interval is ignored by %s stores", u.Scheme)
+		return uri
+	}
+	q := u.Query()
+	if q.Get("flushinterval") == "" {
+		q.Set("flushinterval", d.String())
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// readOnly returns the file:// store URI uri with the store opened read-only, so it is neither flushed nor compacted.
+// Other stores are returned unchanged.
+func readOnly(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	q := u.Query()
+	q.Set("readonly", "true")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// checkOffline returns an error if the store URI uri cannot be opened by a subcommand. Opening a raft:// store starts a
+// Raft node that takes part in the cluster, so it can neither be exported from nor written to offline.
+func checkOffline(uri string) error {
+	if u, err := url.Parse(uri); err == nil && u.Scheme == "raft" {
+		return errors.New("raft stores cannot be opened by subcommands, as that would start another Raft node")
+	}
+	return nil
+}
+
+// redactURI returns uri with any password replaced, to be logged. A user without a password is replaced as well, as
+// URIs like redis://password@host pass the password as the user.
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "<invalid URI>"
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); !ok {
+			u.User = url.User("xxxxx")
+		}
+	}
+	return u.Redacted()
+}
+
+// reloadKeysOnSignal reloads the database keys configured by the store URI on SIGHUP and re-encrypts lfs with the new
+// primary key.
+func reloadKeysOnSignal(lfs *localfile.LocalFileStore, uri string) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		log.Errorf("error parsing store URI, database keys cannot be reloaded: %v", err)
+		return
+	}
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	for range reload {
+		keys, err := localfile.LoadKeyringForURL(u)
+		if err != nil {
+			log.Errorf("error reloading database keys: %v", err)
+			continue
+		}
+		if keys == nil {
+			log.Warnf("no database keys configured, keeping current keys")
+			continue
+		}
+		if err := lfs.SetKeyring(keys); err != nil {
+			log.Errorf("error re-encrypting database: %v", err)
+			continue
+		}
+		log.Infof("re-encrypted database with key version %d", keys.PrimaryVersion())
+	}
+}
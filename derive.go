@@ -0,0 +1,50 @@
+package koda
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// SaltSize is the size of the per-account salt used to derive ServiceKeys.
+const SaltSize = 32
+
+var ErrNoSalt = errors.New("record has no salt")
+
+// NewSalt returns a new random salt to derive ServiceKeys with.
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("error generating salt: %v", err)
+	}
+	return salt, nil
+}
+
+// DeriveServiceKey derives the ServiceKey of service for r as HMAC-SHA256(secret, Salt || AccountKey || service ||
+// epoch), formatted as a version 8 UUID. The key can be recomputed at any time from the record, so it does not need
+// to be stored. Erasing the Salt of a record irreversibly destroys all its derived ServiceKeys.
+// It returns ErrNoSalt if r has no Salt.
+func DeriveServiceKey(secret []byte, r Record, service string) (ServiceKey, error) {
+	if len(r.Salt) == 0 {
+		return "", ErrNoSalt
+	}
+	m := hmac.New(sha256.New, secret)
+	// Length prefixes keep the encoding unambiguous.
+	for _, field := range [][]byte{r.Salt, []byte(r.AccountKey), []byte(service)} {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(field)))
+		m.Write(l[:])
+		m.Write(field)
+	}
+	var epoch [4]byte
+	binary.BigEndian.PutUint32(epoch[:], r.Epochs[service])
+	m.Write(epoch[:])
+
+	b := m.Sum(nil)[:16]
+	b[6] = (b[6] & 0x0f) | 0x80 // Version 8
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return ServiceKey(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])), nil
+}
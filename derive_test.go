@@ -0,0 +1,76 @@
+package koda
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeriveServiceKey(t *testing.T) {
+	secret := bytes.Repeat([]byte{1}, 32)
+	r := Record{AccountKey: "account", Salt: bytes.Repeat([]byte{2}, SaltSize)}
+
+	key, err := DeriveServiceKey(secret, r, "user-service")
+	assert.NoError(t, err)
+	_, err = uuid.ParseUUID(string(key))
+	assert.NoError(t, err)
+	assert.Equal(t, byte('8'), key[14], "version of %s", key)
+
+	again, err := DeriveServiceKey(secret, r, "user-service")
+	assert.NoError(t, err)
+	assert.Equal(t, key, again)
+
+	testCases := []struct {
+		name    string
+		secret  []byte
+		record  Record
+		service string
+	}{
+		{name: "secret", secret: bytes.Repeat([]byte{3}, 32), record: r, service: "user-service"},
+		{name: "service", secret: secret, record: r, service: "diary-service"},
+		{name: "account", secret: secret, record: Record{AccountKey: "other", Salt: r.Salt}, service: "user-service"},
+		{name: "salt", secret: secret, record: Record{AccountKey: "account", Salt: bytes.Repeat([]byte{3}, SaltSize)}, service: "user-service"},
+		{name: "epoch", secret: secret, record: Record{AccountKey: "account", Salt: r.Salt, Epochs: map[string]uint32{"user-service": 1}}, service: "user-service"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			other, err := DeriveServiceKey(tc.secret, tc.record, tc.service)
+			assert.NoError(t, err)
+			assert.NotEqual(t, key, other)
+		})
+	}
+
+	_, err = DeriveServiceKey(secret, Record{AccountKey: "account"}, "user-service")
+	assert.ErrorIs(t, err, ErrNoSalt)
+}
+
+func TestRotateDerivedServiceKey(t *testing.T) {
+	secret := bytes.Repeat([]byte{1}, 32)
+	salt, err := NewSalt()
+	assert.NoError(t, err)
+	r, changed := EnsureSalt(Record{AccountKey: "account"}, "user-service", salt)
+	assert.True(t, changed)
+
+	assert.ErrorIs(t, r.RotateDerivedServiceKey(secret, "diary-service", "test", time.Now(), DefaultKeyHistory), ErrNotFound)
+
+	prev, err := DeriveServiceKey(secret, r, "user-service")
+	assert.NoError(t, err)
+	assert.NoError(t, r.RotateDerivedServiceKey(secret, "user-service", "leak", time.Now(), DefaultKeyHistory))
+	next, err := DeriveServiceKey(secret, r, "user-service")
+	assert.NoError(t, err)
+	assert.NotEqual(t, prev, next)
+	assert.Equal(t, uint32(1), r.Epochs["user-service"])
+	assert.Len(t, r.KeyHistory, 1)
+	assert.Equal(t, prev, r.KeyHistory[0].Key)
+
+	// The salt is kept and further services start at epoch 0
+	r, changed = EnsureSalt(r, "diary-service", bytes.Repeat([]byte{9}, SaltSize))
+	assert.True(t, changed)
+	assert.Equal(t, salt, r.Salt)
+	assert.Equal(t, []string{"diary-service", "user-service"}, r.Services())
+	_, changed = EnsureSalt(r, "diary-service", nil)
+	assert.False(t, changed)
+}
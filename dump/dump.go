@@ -0,0 +1,288 @@
+// Package dump implements a versioned, streamable format to export all records of a koda.Store and to import them
+// into another one.
+//
+// A dump is a sequence of newline delimited JSON objects. The first line holds a Header, followed by one line per
+// record and a Trailer as the last line. The Trailer holds the number of records and a checksum over all preceding
+// lines, so truncated or modified dumps are detected. A dump can be encrypted with a key of KeySize bytes. Every
+// record is then sealed with AES-GCM and the checksum is a HMAC, so an encrypted dump can neither be read nor
+// modified without the key.
+package dump
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/mindtastic/koda"
+)
+
+const (
+	// Format identifies koda dumps in the Header.
+	Format = "koda-dump"
+	// Version is the version of the dump format written by Writer.
+	Version = 1
+	// KeySize is the size of keys to encrypt dumps with.
+	KeySize = 32
+
+	checksumSHA256     = "sha256"
+	checksumHMACSHA256 = "hmac-sha256"
+
+	// maxLineSize limits the size of a single line, to bound memory when reading untrusted dumps.
+	maxLineSize = 16 << 20
+)
+
+var (
+	ErrUnsupported = errors.New("unsupported dump")
+	ErrNoKey       = errors.New("dump is encrypted, but no key is given")
+	ErrChecksum    = errors.New("dump checksum mismatch")
+	ErrTruncated   = errors.New("dump is truncated")
+)
+
+// Header is the first line of a dump.
+type Header struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	Encrypted bool      `json:"encrypted"`
+}
+
+// Trailer is the last line of a dump.
+type Trailer struct {
+	Records  int    `json:"records"`
+	Checksum string `json:"checksum"` // <algorithm>:<hex digest>
+}
+
+// line is a single line of a dump. Exactly one of its fields is set.
+type line struct {
+	Header  *Header      `json:"header,omitempty"`
+	Record  *koda.Record `json:"record,omitempty"`
+	Sealed  []byte       `json:"sealed,omitempty"`
+	Trailer *Trailer     `json:"trailer,omitempty"`
+}
+
+// keys derives separate keys for encryption and authentication from the key a dump is encrypted with.
+func keys(key []byte) (cipher.AEAD, []byte, error) {
+	if len(key) != KeySize {
+		return nil, nil, fmt.Errorf("dump key must be %d bytes, got %d", KeySize, len(key))
+	}
+	derive := func(purpose string) []byte {
+		m := hmac.New(sha256.New, key)
+		m.Write([]byte(purpose))
+		return m.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("koda-dump-encryption"))
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, derive("koda-dump-authentication"), nil
+}
+
+// Writer writes a dump. Close must be called to write the Trailer, without it the dump is incomplete.
+type Writer struct {
+	w       *bufio.Writer
+	aead    cipher.AEAD // Only set if the dump is encrypted
+	sum     hash.Hash
+	algo    string
+	records int
+}
+
+// NewWriter writes the Header of a new dump to w. If key is not nil, the dump is encrypted with key.
+func NewWriter(w io.Writer, key []byte) (*Writer, error) {
+	dw := &Writer{w: bufio.NewWriter(w), sum: sha256.New(), algo: checksumSHA256}
+	if key != nil {
+		aead, mac, err := keys(key)
+		if err != nil {
+			return nil, err
+		}
+		dw.aead, dw.sum, dw.algo = aead, hmac.New(sha256.New, mac), checksumHMACSHA256
+	}
+	h := Header{Format: Format, Version: Version, CreatedAt: time.Now().UTC(), Encrypted: key != nil}
+	if err := dw.writeLine(line{Header: &h}, true); err != nil {
+		return nil, err
+	}
+	return dw, nil
+}
+
+// Write appends a record to the dump.
+func (w *Writer) Write(r koda.Record) error {
+	if w.aead == nil {
+		if err := w.writeLine(line{Record: &r}, true); err != nil {
+			return err
+		}
+		w.records++
+		return nil
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("error encoding record %s: %v", r.AccountKey, err)
+	}
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %v", err)
+	}
+	if err := w.writeLine(line{Sealed: w.aead.Seal(nonce, nonce, data, nil)}, true); err != nil {
+		return err
+	}
+	w.records++
+	return nil
+}
+
+// Close writes the Trailer and flushes the dump to the underlying writer. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	t := Trailer{Records: w.records, Checksum: w.algo + ":" + hex.EncodeToString(w.sum.Sum(nil))}
+	if err := w.writeLine(line{Trailer: &t}, false); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return fmt.Errorf("error writing dump: %v", err)
+	}
+	return nil
+}
+
+func (w *Writer) writeLine(l line, checksum bool) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("error encoding dump: %v", err)
+	}
+	b = append(b, '\n')
+	if checksum {
+		w.sum.Write(b)
+	}
+	if _, err := w.w.Write(b); err != nil {
+		return fmt.Errorf("error writing dump: %v", err)
+	}
+	return nil
+}
+
+// Reader reads a dump.
+type Reader struct {
+	s       *bufio.Scanner
+	header  Header
+	aead    cipher.AEAD // Only set if the dump is encrypted
+	sum     hash.Hash
+	algo    string
+	records int
+	done    bool
+}
+
+// NewReader reads the Header of a dump from r. An encrypted dump can only be read with the key it was written with,
+// otherwise NewReader returns ErrNoKey. A key given for an unencrypted dump is ignored.
+func NewReader(r io.Reader, key []byte) (*Reader, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxLineSize)
+	dr := &Reader{s: s, sum: sha256.New(), algo: checksumSHA256}
+	l, raw, err := dr.readLine()
+	if err == io.EOF {
+		return nil, ErrTruncated
+	}
+	if err != nil {
+		return nil, err
+	}
+	if l.Header == nil || l.Header.Format != Format {
+		return nil, fmt.Errorf("%w: missing header", ErrUnsupported)
+	}
+	if l.Header.Version != Version {
+		return nil, fmt.Errorf("%w: version %d", ErrUnsupported, l.Header.Version)
+	}
+	dr.header = *l.Header
+	if dr.header.Encrypted {
+		if key == nil {
+			return nil, ErrNoKey
+		}
+		aead, mac, err := keys(key)
+		if err != nil {
+			return nil, err
+		}
+		dr.aead, dr.sum, dr.algo = aead, hmac.New(sha256.New, mac), checksumHMACSHA256
+	}
+	dr.sum.Write(raw)
+	return dr, nil
+}
+
+// Header returns the Header of the dump.
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Read returns the next record of the dump. After the last record, Read verifies the Trailer and returns io.EOF.
+// It returns ErrChecksum if the dump has been modified and ErrTruncated if the Trailer is missing.
+// As records are returned before the dump is verified, callers that must not process a modified dump should read it
+// completely first, see Verify.
+func (r *Reader) Read() (koda.Record, error) {
+	if r.done {
+		return koda.Record{}, io.EOF
+	}
+	l, raw, err := r.readLine()
+	if err == io.EOF {
+		return koda.Record{}, ErrTruncated
+	}
+	if err != nil {
+		return koda.Record{}, err
+	}
+
+	switch {
+	case l.Trailer != nil:
+		r.done = true
+		expected := r.algo + ":" + hex.EncodeToString(r.sum.Sum(nil))
+		if !hmac.Equal([]byte(l.Trailer.Checksum), []byte(expected)) || l.Trailer.Records != r.records {
+			return koda.Record{}, ErrChecksum
+		}
+		if r.s.Scan() {
+			return koda.Record{}, fmt.Errorf("%w: data after trailer", ErrChecksum)
+		}
+		return koda.Record{}, io.EOF
+	case l.Record != nil && r.aead == nil:
+		r.sum.Write(raw)
+		r.records++
+		return *l.Record, nil
+	case l.Sealed != nil && r.aead != nil:
+		r.sum.Write(raw)
+		r.records++
+		ns := r.aead.NonceSize()
+		if len(l.Sealed) < ns {
+			return koda.Record{}, ErrChecksum
+		}
+		data, err := r.aead.Open(nil, l.Sealed[:ns], l.Sealed[ns:], nil)
+		if err != nil {
+			return koda.Record{}, ErrChecksum
+		}
+		var rec koda.Record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return koda.Record{}, fmt.Errorf("error decoding record %d: %v", r.records, err)
+		}
+		return rec, nil
+	}
+	return koda.Record{}, fmt.Errorf("%w: unexpected line %d", ErrUnsupported, r.records+2)
+}
+
+// readLine reads and decodes the next line. It returns the raw line including its newline for the checksum.
+func (r *Reader) readLine() (line, []byte, error) {
+	if !r.s.Scan() {
+		if err := r.s.Err(); err != nil {
+			return line{}, nil, fmt.Errorf("error reading dump: %v", err)
+		}
+		return line{}, nil, io.EOF
+	}
+	raw := make([]byte, len(r.s.Bytes())+1)
+	copy(raw, r.s.Bytes())
+	raw[len(raw)-1] = '\n'
+	var l line
+	if err := json.Unmarshal(raw, &l); err != nil {
+		return line{}, nil, fmt.Errorf("%w: malformed line %d: %v", ErrUnsupported, r.records+2, err)
+	}
+	return l, raw, nil
+}
@@ -0,0 +1,146 @@
+package dump
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/store/localfile"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRecords = []koda.Record{
+	{AccountKey: "a", ServiceKeys: map[string]koda.ServiceKey{"user-service": "key-a"}},
+	{AccountKey: "b", Inactive: true, DeactivationReason: "test", ServiceKeys: map[string]koda.ServiceKey{"user-service": "key-b"}},
+	{AccountKey: "c", Salt: bytes.Repeat([]byte{1}, koda.SaltSize), Epochs: map[string]uint32{"diary-service": 2}},
+}
+
+func writeDump(t *testing.T, key []byte) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, key)
+	assert.NoError(t, err)
+	for _, r := range testRecords {
+		assert.NoError(t, w.Write(r))
+	}
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func readDump(data []byte, key []byte) ([]koda.Record, error) {
+	r, err := NewReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	var records []koda.Record
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, KeySize)
+
+	testCases := []struct {
+		name string
+		key  []byte
+	}{
+		{name: "plain"},
+		{name: "encrypted", key: key},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := writeDump(t, tc.key)
+			assert.Equal(t, 1+len(testRecords)+1, bytes.Count(data, []byte("\n")))
+			assert.Equal(t, tc.key == nil, bytes.Contains(data, []byte("key-a")))
+
+			records, err := readDump(data, tc.key)
+			assert.NoError(t, err)
+			assert.Equal(t, testRecords, records)
+		})
+	}
+}
+
+func TestReader_Errors(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, KeySize)
+	plain := writeDump(t, nil)
+	encrypted := writeDump(t, key)
+	lines := strings.SplitAfter(string(plain), "\n")
+
+	testCases := []struct {
+		name string
+		data string
+		key  []byte
+		err  error
+	}{
+		{name: "empty", data: "", err: ErrTruncated},
+		{name: "no header", data: lines[1], err: ErrUnsupported},
+		{name: "future version", data: strings.Replace(string(plain), `"version":1`, `"version":2`, 1), err: ErrUnsupported},
+		{name: "truncated", data: strings.Join(lines[:3], ""), err: ErrTruncated},
+		{name: "dropped record", data: lines[0] + lines[1] + lines[3] + lines[4], err: ErrChecksum},
+		{name: "modified record", data: strings.Replace(string(plain), "key-b", "key-x", 1), err: ErrChecksum},
+		{name: "trailing data", data: string(plain) + lines[1], err: ErrChecksum},
+		{name: "no key", data: string(encrypted), err: ErrNoKey},
+		{name: "wrong key", data: string(encrypted), key: bytes.Repeat([]byte{8}, KeySize), err: ErrChecksum},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := readDump([]byte(tc.data), tc.key)
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src := localfile.New()
+	for _, r := range testRecords {
+		assert.NoError(t, src.Set(context.Background(), r.AccountKey, r))
+	}
+	var buf bytes.Buffer
+	n, err := Export(context.Background(), src, &buf, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, len(testRecords), n)
+
+	n, err = Verify(bytes.NewReader(buf.Bytes()), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, len(testRecords), n)
+
+	dst := localfile.New()
+	existing := koda.Record{AccountKey: "a", ServiceKeys: map[string]koda.ServiceKey{"user-service": "existing"}}
+	assert.NoError(t, dst.Set(context.Background(), "a", existing))
+	stats, err := Import(context.Background(), dst, bytes.NewReader(buf.Bytes()), nil, false)
+	assert.NoError(t, err)
+	assert.Equal(t, ImportStats{Imported: 2, Skipped: 1}, stats)
+	r, err := dst.Get(context.Background(), "a")
+	assert.NoError(t, err)
+	assert.Equal(t, existing, r)
+
+	stats, err = Import(context.Background(), dst, bytes.NewReader(buf.Bytes()), nil, true)
+	assert.NoError(t, err)
+	assert.Equal(t, ImportStats{Imported: 3}, stats)
+	for _, expected := range testRecords {
+		r, err := dst.Get(context.Background(), expected.AccountKey)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, r)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	r, err := NewReader(bytes.NewReader(writeDump(t, nil)), nil)
+	assert.NoError(t, err)
+	h := r.Header()
+	assert.Equal(t, Format, h.Format)
+	assert.Equal(t, Version, h.Version)
+	assert.False(t, h.Encrypted)
+	assert.WithinDuration(t, time.Now(), h.CreatedAt, time.Minute)
+}
@@ -0,0 +1,92 @@
+package dump
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mindtastic/koda"
+)
+
+// Export writes all records of s to w as a dump, encrypted with key if it is not nil. It returns the number of
+// exported records. Records written to s during the export might or might not be part of the dump.
+func Export(ctx context.Context, s koda.Store, w io.Writer, key []byte) (int, error) {
+	dw, err := NewWriter(w, key)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = koda.Walk(ctx, s, koda.DefaultPageSize, func(r koda.Record) error {
+		if err := dw.Write(r); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, fmt.Errorf("error exporting records: %w", err)
+	}
+	return n, dw.Close()
+}
+
+// Verify reads a dump from r completely and checks its integrity. It returns the number of records in the dump.
+func Verify(r io.Reader, key []byte) (int, error) {
+	dr, err := NewReader(r, key)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for {
+		if _, err := dr.Read(); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		n++
+	}
+}
+
+// ImportStats counts the records processed by Import.
+type ImportStats struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// Import writes all records of the dump read from r to s. Records that already exist in s are skipped, unless
+// overwrite is set. Records are written while the dump is read, so records preceding a modification of the dump are
+// imported before the modification is detected. Use Verify first to rule that out.
+func Import(ctx context.Context, s koda.Store, r io.Reader, key []byte, overwrite bool) (ImportStats, error) {
+	var stats ImportStats
+	dr, err := NewReader(r, key)
+	if err != nil {
+		return stats, err
+	}
+	for {
+		rec, err := dr.Read()
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+		if rec.AccountKey == "" {
+			return stats, fmt.Errorf("%w: record %d has no AccountKey", ErrUnsupported, stats.Imported+stats.Skipped+1)
+		}
+		if !overwrite {
+			_, err := s.Get(ctx, rec.AccountKey)
+			if err == nil {
+				stats.Skipped++
+				continue
+			}
+			if !errors.Is(err, koda.ErrNotFound) {
+				return stats, err
+			}
+		}
+		if err := s.Set(ctx, rec.AccountKey, rec); err != nil {
+			return stats, err
+		}
+		stats.Imported++
+	}
+}
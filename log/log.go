@@ -325,6 +325,11 @@ func logLevelGlyph(level Level) string {
 	}
 }
 
+// ParseLevel parses the name of a log level as accepted by New.
+func ParseLevel(level string) (Level, error) {
+	return levelFromString(level)
+}
+
 func levelFromString(level string) (Level, error) {
 	switch strings.ToLower(level) {
 	case "debug":
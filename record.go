@@ -1,6 +1,12 @@
 package koda
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
 
 // AccountKey is the primary identifier for a User. It is Service agnostic.
 type AccountKey string
@@ -8,19 +14,230 @@ type AccountKey string
 // ServiceKey is a service dependent primary key for a User.
 type ServiceKey string
 
+// DefaultKeyHistory is the default number of previous ServiceKeys retained per service after rotations.
+const DefaultKeyHistory = 5
+
 type Record struct {
 	AccountKey AccountKey `json:"accountKey"`
 	Inactive   bool       `json:"inactive"`
 
+	// DeactivatedAt and DeactivationReason describe the last deactivation of an inactive record.
+	DeactivatedAt      *time.Time `json:"deactivatedAt,omitempty"`
+	DeactivationReason string     `json:"deactivationReason,omitempty"`
+
 	// ServiceKeys maps the name of a service to a ServiceKey for the specific user.
 	ServiceKeys map[string]ServiceKey `json:"serviceKeys"`
+
+	// KeyHistory holds previous ServiceKeys that have been replaced by a rotation, oldest first.
+	// Downstream services can use it to migrate data stored under a previous key.
+	KeyHistory []RotatedKey `json:"keyHistory,omitempty"`
+
+	// Salt and Epochs are used to derive ServiceKeys instead of storing them, see DeriveServiceKey.
+	// Epochs holds the current epoch of every service a ServiceKey has been derived for.
+	Salt   []byte            `json:"salt,omitempty"`
+	Epochs map[string]uint32 `json:"epochs,omitempty"`
+}
+
+// RotatedKey is a ServiceKey that has been replaced by a rotation.
+type RotatedKey struct {
+	Service   string     `json:"service"`
+	Key       ServiceKey `json:"key"`
+	RotatedAt time.Time  `json:"rotatedAt"`
+	Reason    string     `json:"reason"`
+}
+
+// RotateServiceKey replaces the ServiceKey of service with key and appends the previous key to KeyHistory.
+// At most keep previous keys are retained per service, older ones are dropped. A keep value < 1 retains no history.
+// It returns ErrNotFound if the record has no ServiceKey for service.
+func (r *Record) RotateServiceKey(service string, key ServiceKey, reason string, at time.Time, keep int) error {
+	prev, ok := r.ServiceKeys[service]
+	if !ok {
+		return fmt.Errorf("no key for service %q: %w", service, ErrNotFound)
+	}
+	r.ServiceKeys[service] = key
+	r.appendHistory(service, prev, reason, at, keep)
+	return nil
+}
+
+// RotateDerivedServiceKey increments the epoch of service, which changes its derived ServiceKey, and appends the
+// previous key to KeyHistory. History is retained as for RotateServiceKey.
+// It returns ErrNotFound if no ServiceKey has been derived for service.
+func (r *Record) RotateDerivedServiceKey(secret []byte, service string, reason string, at time.Time, keep int) error {
+	if _, ok := r.Epochs[service]; !ok {
+		return fmt.Errorf("no key for service %q: %w", service, ErrNotFound)
+	}
+	prev, err := DeriveServiceKey(secret, *r, service)
+	if err != nil {
+		return err
+	}
+	r.Epochs[service]++
+	r.appendHistory(service, prev, reason, at, keep)
+	return nil
+}
+
+// Services returns the sorted names of all services the record holds a stored or derived ServiceKey for.
+func (r Record) Services() []string {
+	services := make([]string, 0, len(r.ServiceKeys)+len(r.Epochs))
+	for s := range r.ServiceKeys {
+		services = append(services, s)
+	}
+	for s := range r.Epochs {
+		if _, ok := r.ServiceKeys[s]; !ok {
+			services = append(services, s)
+		}
+	}
+	sort.Strings(services)
+	return services
+}
+
+// appendHistory appends a rotated key to KeyHistory and drops the oldest entries of service exceeding keep.
+func (r *Record) appendHistory(service string, key ServiceKey, reason string, at time.Time, keep int) {
+	r.KeyHistory = append(r.KeyHistory, RotatedKey{
+		Service:   service,
+		Key:       key,
+		RotatedAt: at,
+		Reason:    reason,
+	})
+
+	var n int
+	for _, h := range r.KeyHistory {
+		if h.Service == service {
+			n++
+		}
+	}
+	history := r.KeyHistory[:0]
+	for _, h := range r.KeyHistory {
+		if h.Service == service && n > keep {
+			n--
+			continue
+		}
+		history = append(history, h)
+	}
+	r.KeyHistory = history
+}
+
+// EnsureServiceKey returns r with newKey as the ServiceKey of service, unless r already has a ServiceKey for service
+// or is inactive. It reports whether a ServiceKey has been added. The ServiceKeys of r are copied before they are
+// modified. Stores use it to implement GetOrCreateServiceKey.
+func EnsureServiceKey(r Record, service string, newKey ServiceKey) (Record, bool) {
+	if _, ok := r.ServiceKeys[service]; ok || r.Inactive {
+		return r, false
+	}
+	serviceKeys := make(map[string]ServiceKey, len(r.ServiceKeys)+1)
+	for s, k := range r.ServiceKeys {
+		serviceKeys[s] = k
+	}
+	serviceKeys[service] = newKey
+	r.ServiceKeys = serviceKeys
+	return r, true
+}
+
+// EnsureSalt returns r with salt as its Salt and an epoch for service, unless r already has both or is inactive.
+// It reports whether r has been changed. The Epochs of r are copied before they are modified. Stores use it to
+// implement GetOrCreateSalt.
+func EnsureSalt(r Record, service string, salt []byte) (Record, bool) {
+	_, ok := r.Epochs[service]
+	if (ok && len(r.Salt) > 0) || r.Inactive {
+		return r, false
+	}
+	if len(r.Salt) == 0 {
+		r.Salt = salt
+	}
+	epochs := make(map[string]uint32, len(r.Epochs)+1)
+	for s, e := range r.Epochs {
+		epochs[s] = e
+	}
+	if !ok {
+		epochs[service] = 0
+	}
+	r.Epochs = epochs
+	return r, true
+}
+
+// Deactivate marks the record as inactive. ServiceKeys of an inactive record must not be handed out.
+func (r *Record) Deactivate(reason string, at time.Time) {
+	r.Inactive = true
+	r.DeactivatedAt = &at
+	r.DeactivationReason = reason
+}
+
+// Reactivate marks the record as active again and clears the deactivation details.
+func (r *Record) Reactivate() {
+	r.Inactive = false
+	r.DeactivatedAt = nil
+	r.DeactivationReason = ""
+}
+
+// Clone returns a deep copy of r, so modifying the maps and slices of one does not affect the other. Nil maps and
+// slices stay nil.
+func (r Record) Clone() Record {
+	if r.DeactivatedAt != nil {
+		at := *r.DeactivatedAt
+		r.DeactivatedAt = &at
+	}
+	if r.ServiceKeys != nil {
+		serviceKeys := make(map[string]ServiceKey, len(r.ServiceKeys))
+		for s, k := range r.ServiceKeys {
+			serviceKeys[s] = k
+		}
+		r.ServiceKeys = serviceKeys
+	}
+	if r.Epochs != nil {
+		epochs := make(map[string]uint32, len(r.Epochs))
+		for s, e := range r.Epochs {
+			epochs[s] = e
+		}
+		r.Epochs = epochs
+	}
+	if r.KeyHistory != nil {
+		r.KeyHistory = append([]RotatedKey(nil), r.KeyHistory...)
+	}
+	if r.Salt != nil {
+		r.Salt = append([]byte(nil), r.Salt...)
+	}
+	return r
 }
 
 var ErrNotFound = errors.New("not found")
 
 // A Store must be able to store and retrieve records based on a given AccountKey only.
 // ServiceKeys must not be used for indexing.
+// Every operation takes a context. A Store should stop waiting and return an error wrapping ctx.Err() once ctx is done.
 type Store interface {
-	Set(AccountKey, Record) error
-	Get(key AccountKey) (Record, error)
+	Set(ctx context.Context, key AccountKey, record Record) error
+	Get(ctx context.Context, key AccountKey) (Record, error)
+
+	// Update atomically replaces the record of key with the result of fn, which is passed the current record, and
+	// returns the stored record. No other write to key may happen between reading the record passed to fn and writing
+	// its result. fn may be called more than once if the record changes concurrently, so it must not have side
+	// effects besides modifying the record passed to it. If fn returns an error, the record is left unchanged and
+	// Update returns an error wrapping it. Update returns ErrNotFound without calling fn if the record does not exist.
+	Update(ctx context.Context, key AccountKey, fn func(Record) (Record, error)) (Record, error)
+
+	// Delete removes a record from the Store. It returns ErrNotFound if the record does not exist.
+	// Copies of the record might remain on disk until they are overwritten, the documentation of every Store states
+	// which.
+	Delete(ctx context.Context, key AccountKey) error
+
+	// List returns up to limit AccountKeys greater than after in ascending byte order. An empty after lists from the
+	// first AccountKey. Fewer than limit AccountKeys are returned only once the end has been reached.
+	List(ctx context.Context, after AccountKey, limit int) ([]AccountKey, error)
+
+	// Scan returns up to limit records with an AccountKey greater than after, in the same order as List. The
+	// AccountKey of each record is set to the key it is stored under, so it can be passed as after to get the next
+	// page. A Store must not block other operations for longer than it takes to collect a single page.
+	// Walk iterates over all records with Scan.
+	Scan(ctx context.Context, after AccountKey, limit int) ([]Record, error)
+
+	// GetOrCreateServiceKey returns the record of key with a ServiceKey for service. If the record does not exist, it
+	// is created. If the record has no ServiceKey for service, newKey is stored. Inactive records are returned
+	// unchanged. The operation must be atomic: concurrent calls for the same key and service must return the same
+	// ServiceKey, which must never be replaced by another call.
+	GetOrCreateServiceKey(ctx context.Context, key AccountKey, service string, newKey ServiceKey) (Record, error)
+
+	// GetOrCreateSalt returns the record of key with a Salt and an epoch for service, to derive its ServiceKey with
+	// DeriveServiceKey. If the record does not exist, it is created. If the record has no Salt, salt is stored. If
+	// the record has no epoch for service, it is initialized to zero. Inactive records are returned unchanged.
+	// The operation must be atomic like GetOrCreateServiceKey.
+	GetOrCreateSalt(ctx context.Context, key AccountKey, service string, salt []byte) (Record, error)
 }
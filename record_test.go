@@ -0,0 +1,110 @@
+package koda
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecord_RotateServiceKey(t *testing.T) {
+	at := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name            string
+		service         string
+		rotations       int
+		keep            int
+		expectedHistory []ServiceKey
+		err             error
+	}{
+		{name: "single rotation", service: "user-service", rotations: 1, keep: 5, expectedHistory: []ServiceKey{"initial"}},
+		{name: "bounded history", service: "user-service", rotations: 3, keep: 2, expectedHistory: []ServiceKey{"key-0", "key-1"}},
+		{name: "no history", service: "user-service", rotations: 2, keep: 0, expectedHistory: nil},
+		{name: "unknown service", service: "diary-service", rotations: 1, keep: 5, err: ErrNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := Record{
+				AccountKey: "account",
+				ServiceKeys: map[string]ServiceKey{
+					"user-service": "initial",
+					"other":        "other-key",
+				},
+				KeyHistory: []RotatedKey{{Service: "other", Key: "old-other-key", RotatedAt: at, Reason: "test"}},
+			}
+
+			var last ServiceKey
+			for i := 0; i < tc.rotations; i++ {
+				last = ServiceKey("key-" + string(rune('0'+i)))
+				err := r.RotateServiceKey(tc.service, last, "test", at, tc.keep)
+				if tc.err != nil {
+					assert.True(t, errors.Is(err, tc.err))
+					return
+				}
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, last, r.ServiceKeys[tc.service])
+			assert.Equal(t, ServiceKey("other-key"), r.ServiceKeys["other"])
+
+			var history []ServiceKey
+			for _, h := range r.KeyHistory {
+				if h.Service == tc.service {
+					assert.Equal(t, "test", h.Reason)
+					assert.Equal(t, at, h.RotatedAt)
+					history = append(history, h.Key)
+				}
+			}
+			if tc.expectedHistory == nil {
+				assert.Empty(t, history)
+			} else {
+				assert.Equal(t, tc.expectedHistory, history)
+			}
+			// History of other services must be untouched
+			assert.Equal(t, RotatedKey{Service: "other", Key: "old-other-key", RotatedAt: at, Reason: "test"}, r.KeyHistory[0])
+		})
+	}
+}
+
+func TestRecord_Deactivate(t *testing.T) {
+	at := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	r := Record{AccountKey: "account"}
+
+	r.Deactivate("fraud", at)
+	assert.True(t, r.Inactive)
+	assert.Equal(t, &at, r.DeactivatedAt)
+	assert.Equal(t, "fraud", r.DeactivationReason)
+
+	r.Reactivate()
+	assert.Equal(t, Record{AccountKey: "account"}, r)
+}
+
+func TestRecord_Clone(t *testing.T) {
+	at := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	r := Record{
+		AccountKey:    "account",
+		DeactivatedAt: &at,
+		ServiceKeys:   map[string]ServiceKey{"user-service": "key"},
+		KeyHistory:    []RotatedKey{{Service: "user-service", Key: "old"}},
+		Salt:          []byte("salt"),
+		Epochs:        map[string]uint32{"diary-service": 1},
+	}
+	c := r.Clone()
+	assert.Equal(t, r, c)
+
+	c.ServiceKeys["user-service"] = "other"
+	c.Epochs["diary-service"]++
+	c.KeyHistory[0].Key = "other"
+	c.Salt[0] = 'x'
+	*c.DeactivatedAt = at.Add(time.Hour)
+	assert.Equal(t, ServiceKey("key"), r.ServiceKeys["user-service"])
+	assert.Equal(t, uint32(1), r.Epochs["diary-service"])
+	assert.Equal(t, ServiceKey("old"), r.KeyHistory[0].Key)
+	assert.Equal(t, []byte("salt"), r.Salt)
+	assert.Equal(t, at, *r.DeactivatedAt)
+
+	assert.Equal(t, Record{AccountKey: "account"}, Record{AccountKey: "account"}.Clone())
+}
@@ -0,0 +1,58 @@
+package koda
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// OpenFunc opens a Store configured by the URI u.
+type OpenFunc func(ctx context.Context, u *url.URL) (Store, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]OpenFunc)
+)
+
+// Register makes a Store backend available to Open under the URI scheme. Backends register themselves in an init
+// function, so importing a backend package is enough to use it. Register panics if scheme is registered twice.
+func Register(scheme string, open OpenFunc) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if open == nil {
+		panic("koda: Register of nil OpenFunc for scheme " + scheme)
+	}
+	if _, ok := registry[scheme]; ok {
+		panic("koda: Register called twice for scheme " + scheme)
+	}
+	registry[scheme] = open
+}
+
+// Schemes returns the sorted URI schemes of all registered Store backends.
+func Schemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	schemes := make([]string, 0, len(registry))
+	for s := range registry {
+		schemes = append(schemes, s)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open opens the Store at uri with the backend registered for its scheme.
+func Open(ctx context.Context, uri string) (Store, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store URI: %v", err)
+	}
+	registryMu.RLock()
+	open, ok := registry[u.Scheme]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown store URI scheme %q, registered are %v", u.Scheme, Schemes())
+	}
+	return open(ctx, u)
+}
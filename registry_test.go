@@ -0,0 +1,35 @@
+package koda
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	errOpened := errors.New("opened")
+	var opened *url.URL
+	Register("test-registry", func(_ context.Context, u *url.URL) (Store, error) {
+		opened = u
+		return nil, errOpened
+	})
+	t.Cleanup(func() {
+		registryMu.Lock()
+		delete(registry, "test-registry")
+		registryMu.Unlock()
+	})
+
+	assert.Contains(t, Schemes(), "test-registry")
+	assert.Panics(t, func() { Register("test-registry", func(context.Context, *url.URL) (Store, error) { return nil, nil }) })
+
+	_, err := Open(context.Background(), "test-registry:///some/path?option=1")
+	assert.ErrorIs(t, err, errOpened)
+	assert.Equal(t, "/some/path", opened.Path)
+	assert.Equal(t, "1", opened.Query().Get("option"))
+
+	_, err = Open(context.Background(), "unknown:///path")
+	assert.EqualError(t, err, `unknown store URI scheme "unknown", registered are [test-registry]`)
+}
@@ -0,0 +1,299 @@
+// Package reverse implements an optional index resolving ServiceKeys back to the AccountKey they belong to.
+//
+// koda deliberately does not index ServiceKeys, as this allows to link the data of all services of an account.
+// The index is meant for tightly controlled admin tooling only, e.g. to handle data-subject requests. ServiceKeys are
+// only stored as keyed hashes and the AccountKeys are encrypted, so the index file alone does not reveal any mapping.
+package reverse
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mindtastic/koda"
+)
+
+// KeySize is the size of the index key in bytes.
+const KeySize = 32
+
+const (
+	opAdd    = "add"
+	opRemove = "remove" // Only found in index files written by earlier versions, which appended removals
+)
+
+// Entry is the result of a reverse lookup.
+type Entry struct {
+	AccountKey koda.AccountKey `json:"accountKey"`
+	Service    string          `json:"service"`
+}
+
+// logEntry is a single change in the index file.
+type logEntry struct {
+	Op    string `json:"op"`
+	ID    string `json:"id"`
+	Entry string `json:"entry,omitempty"` // Sealed Entry
+}
+
+// Index maps ServiceKeys to the AccountKey and service they belong to. It is safe for concurrent access.
+// Additions are appended to the index file and synced before they are applied. Removals rewrite the index file, so
+// removed entries do not stay behind on disk.
+type Index struct {
+	mu      sync.RWMutex
+	path    string
+	mac     []byte
+	aead    cipher.AEAD
+	entries map[string][]byte // Keyed hash of the ServiceKey to sealed Entry
+	f       *os.File
+}
+
+// Open opens or creates the index file at path. key is used to hash ServiceKeys and encrypt entries, it must be
+// KeySize bytes long. The index file is compacted while opening.
+func Open(path string, key []byte) (*Index, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("index key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(deriveKey(key, "koda reverse index encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	idx := &Index{
+		path:    path,
+		mac:     deriveKey(key, "koda reverse index mac"),
+		aead:    aead,
+		entries: make(map[string][]byte),
+	}
+	if err := idx.load(path); err != nil {
+		return nil, err
+	}
+	if err := idx.compact(nil); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func deriveKey(key []byte, label string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(label))
+	return m.Sum(nil)
+}
+
+func (idx *Index) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening index file: %v", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for s.Scan() {
+		var e logEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			// A torn last line is left behind by a crash during append
+			break
+		}
+		switch e.Op {
+		case opAdd:
+			sealed, err := base64.StdEncoding.DecodeString(e.Entry)
+			if err != nil {
+				return fmt.Errorf("error decoding index entry: %v", err)
+			}
+			idx.entries[e.ID] = sealed
+		case opRemove:
+			delete(idx.entries, e.ID)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("error reading index file %s: %v", path, err)
+	}
+	return nil
+}
+
+// compact rewrites the index file with the current entries only, except for the entries in skip, and opens it for
+// appending. The rewritten file is synced before it replaces the index file.
+func (idx *Index) compact(skip map[string]bool) error {
+	tmp := idx.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("error compacting index file: %v", err)
+	}
+	w := bufio.NewWriter(f)
+	e := json.NewEncoder(w)
+	for id, sealed := range idx.entries {
+		if skip[id] {
+			continue
+		}
+		if err := e.Encode(logEntry{Op: opAdd, ID: id, Entry: base64.StdEncoding.EncodeToString(sealed)}); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return fmt.Errorf("error compacting index file: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("error compacting index file: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("error compacting index file: %v", err)
+	}
+	f.Close()
+	if err := os.Rename(tmp, idx.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error compacting index file: %v", err)
+	}
+	if err := syncDir(filepath.Dir(idx.path)); err != nil {
+		return fmt.Errorf("error syncing index directory: %v", err)
+	}
+
+	if idx.f != nil {
+		idx.f.Close()
+	}
+	idx.f, err = os.OpenFile(idx.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening index file: %v", err)
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Close closes the index file.
+func (idx *Index) Close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.f.Close()
+}
+
+// Hash returns the keyed hash identifying sk in the index. It does not reveal sk without the key of the index, so it
+// can be recorded in place of sk, e.g. in an audit log.
+func (idx *Index) Hash(sk koda.ServiceKey) string {
+	return idx.id(sk)
+}
+
+// id returns the keyed hash identifying sk in the index.
+func (idx *Index) id(sk koda.ServiceKey) string {
+	m := hmac.New(sha256.New, idx.mac)
+	m.Write([]byte(sk))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// Add indexes sk as the ServiceKey of service for ak. ServiceKeys are unique, so adding a ServiceKey that is already
+// indexed is a no-op.
+func (idx *Index) Add(sk koda.ServiceKey, ak koda.AccountKey, service string) error {
+	id := idx.id(sk)
+	idx.mu.RLock()
+	_, ok := idx.entries[id]
+	idx.mu.RUnlock()
+	if ok {
+		return nil
+	}
+
+	plaintext, err := json.Marshal(Entry{AccountKey: ak, Service: service})
+	if err != nil {
+		return fmt.Errorf("error encoding index entry: %v", err)
+	}
+	nonce := make([]byte, idx.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %v", err)
+	}
+	// The id is authenticated, so that entries cannot be swapped in the index file.
+	sealed := idx.aead.Seal(nonce, nonce, plaintext, []byte(id))
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if err := idx.append(logEntry{Op: opAdd, ID: id, Entry: base64.StdEncoding.EncodeToString(sealed)}); err != nil {
+		return err
+	}
+	idx.entries[id] = sealed
+	return nil
+}
+
+// Remove removes ServiceKeys from the index. The index file is compacted before Remove returns, so the removed
+// entries are gone from disk as well. Removing ServiceKeys that are not indexed is a no-op.
+func (idx *Index) Remove(sks ...koda.ServiceKey) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	removed := make(map[string]bool)
+	for _, sk := range sks {
+		if id := idx.id(sk); idx.entries[id] != nil {
+			removed[id] = true
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	if err := idx.compact(removed); err != nil {
+		return err
+	}
+	for id := range removed {
+		delete(idx.entries, id)
+	}
+	return nil
+}
+
+func (idx *Index) append(e logEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error encoding index entry: %v", err)
+	}
+	if _, err := idx.f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("error writing index file: %v", err)
+	}
+	if err := idx.f.Sync(); err != nil {
+		return fmt.Errorf("error syncing index file: %v", err)
+	}
+	return nil
+}
+
+// Lookup returns the Entry sk belongs to. It returns koda.ErrNotFound if sk is not indexed.
+func (idx *Index) Lookup(sk koda.ServiceKey) (Entry, error) {
+	id := idx.id(sk)
+	idx.mu.RLock()
+	sealed, ok := idx.entries[id]
+	idx.mu.RUnlock()
+	if !ok {
+		return Entry{}, fmt.Errorf("could not look up service key: %w", koda.ErrNotFound)
+	}
+
+	ns := idx.aead.NonceSize()
+	if len(sealed) < ns {
+		return Entry{}, errors.New("index entry is truncated")
+	}
+	plaintext, err := idx.aead.Open(nil, sealed[:ns], sealed[ns:], []byte(id))
+	if err != nil {
+		return Entry{}, fmt.Errorf("error decrypting index entry: %v", err)
+	}
+	var e Entry
+	if err := json.Unmarshal(plaintext, &e); err != nil {
+		return Entry{}, fmt.Errorf("error decoding index entry: %v", err)
+	}
+	return e, nil
+}
@@ -0,0 +1,107 @@
+package reverse
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/store/localfile"
+	"github.com/stretchr/testify/assert"
+)
+
+var testKey = bytes.Repeat([]byte{42}, KeySize)
+
+func TestIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reverse.idx")
+	idx, err := Open(path, testKey)
+	assert.NoError(t, err)
+
+	assert.NoError(t, idx.Add("service-key", "account-key", "user-service"))
+	assert.NoError(t, idx.Add("removed-key", "account-key", "diary-service"))
+	assert.NoError(t, idx.Remove("removed-key"))
+	assert.NoError(t, idx.Remove("unknown-key"))
+	removedID := idx.id("removed-key")
+
+	e, err := idx.Lookup("service-key")
+	assert.NoError(t, err)
+	assert.Equal(t, Entry{AccountKey: "account-key", Service: "user-service"}, e)
+	_, err = idx.Lookup("removed-key")
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+	assert.NoError(t, idx.Close())
+
+	// Neither ServiceKeys nor AccountKeys are stored in plaintext, removed entries are gone from the index file
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	for _, s := range []string{"service-key", "account-key", "user-service", removedID} {
+		assert.NotContains(t, string(data), s)
+	}
+	assert.Equal(t, 1, bytes.Count(data, []byte("\n")))
+
+	// Reopening replays the index file
+	idx, err = Open(path, testKey)
+	assert.NoError(t, err)
+	defer idx.Close()
+	e, err = idx.Lookup("service-key")
+	assert.NoError(t, err)
+	assert.Equal(t, koda.AccountKey("account-key"), e.AccountKey)
+	_, err = idx.Lookup("removed-key")
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+
+	// A different key cannot resolve any ServiceKey
+	other, err := Open(filepath.Join(t.TempDir(), "other.idx"), bytes.Repeat([]byte{1}, KeySize))
+	assert.NoError(t, err)
+	defer other.Close()
+	_, err = other.Lookup("service-key")
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+
+	_, err = Open(path, []byte("short"))
+	assert.EqualError(t, err, "index key must be 32 bytes, got 5")
+}
+
+func TestIndexedStore(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "index")
+	assert.NoError(t, os.Mkdir(dir, 0700))
+	path := filepath.Join(dir, "reverse.idx")
+	idx, err := Open(path, testKey)
+	assert.NoError(t, err)
+	defer idx.Close()
+	s := NewIndexedStore(localfile.New(), idx)
+
+	r, err := s.GetOrCreateServiceKey(ctx, "account", "user-service", "user-key")
+	assert.NoError(t, err)
+	e, err := idx.Lookup("user-key")
+	assert.NoError(t, err)
+	assert.Equal(t, Entry{AccountKey: "account", Service: "user-service"}, e)
+
+	// Rotated keys stay resolvable while they are part of the KeyHistory
+	assert.NoError(t, r.RotateServiceKey("user-service", "rotated-key", "test", time.Now(), 1))
+	assert.NoError(t, s.Set(ctx, "account", r))
+	for _, sk := range []koda.ServiceKey{"user-key", "rotated-key"} {
+		_, err = idx.Lookup(sk)
+		assert.NoError(t, err)
+	}
+	r.KeyHistory = nil
+	assert.NoError(t, s.Set(ctx, "account", r))
+	_, err = idx.Lookup("user-key")
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+
+	assert.NoError(t, s.Delete(ctx, "account"))
+	_, err = idx.Lookup("rotated-key")
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+
+	// Records are not deleted while their ServiceKeys cannot be removed from the index file
+	_, err = s.GetOrCreateServiceKey(ctx, "other", "user-service", "other-key")
+	assert.NoError(t, err)
+	assert.NoError(t, os.RemoveAll(dir))
+	assert.Error(t, s.Delete(ctx, "other"))
+	_, err = s.Get(ctx, "other")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,122 @@
+package reverse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/log"
+)
+
+// Ensure that IndexedStore implements the koda.Store interface
+var _ koda.Store = (*IndexedStore)(nil)
+
+// IndexedStore is a koda.Store that keeps an Index up to date with all ServiceKeys written to the underlying Store,
+// including previous keys in the KeyHistory of a record.
+// Failing to update the Index is logged, but does not fail the operation on the underlying Store. Deletions are the
+// exception, they fail if the ServiceKeys of the record cannot be removed from the Index.
+// Records written before the IndexedStore has been set up are not indexed.
+type IndexedStore struct {
+	koda.Store
+	idx *Index
+}
+
+// NewIndexedStore wraps store to keep idx up to date.
+func NewIndexedStore(store koda.Store, idx *Index) *IndexedStore {
+	return &IndexedStore{Store: store, idx: idx}
+}
+
+// Set stores record in the underlying Store and indexes all its ServiceKeys. ServiceKeys of the previous record that
+// are not part of record anymore are removed from the Index.
+func (s *IndexedStore) Set(ctx context.Context, key koda.AccountKey, record koda.Record) error {
+	prev, err := s.Store.Get(ctx, key)
+	if err != nil && !errors.Is(err, koda.ErrNotFound) {
+		return err
+	}
+	if err := s.Store.Set(ctx, key, record); err != nil {
+		return err
+	}
+	s.reindex(key, prev, record)
+	return nil
+}
+
+// Update updates the record in the underlying Store and updates the Index like Set.
+func (s *IndexedStore) Update(ctx context.Context, key koda.AccountKey, fn func(koda.Record) (koda.Record, error)) (koda.Record, error) {
+	var prev koda.Record
+	record, err := s.Store.Update(ctx, key, func(r koda.Record) (koda.Record, error) {
+		prev = r.Clone()
+		return fn(r)
+	})
+	if err != nil {
+		return record, err
+	}
+	s.reindex(key, prev, record)
+	return record, nil
+}
+
+// reindex indexes all ServiceKeys of record and removes the ServiceKeys of prev that are not part of record anymore.
+func (s *IndexedStore) reindex(key koda.AccountKey, prev, record koda.Record) {
+	current := serviceKeys(record)
+	var removed []koda.ServiceKey
+	for sk := range serviceKeys(prev) {
+		if _, ok := current[sk]; !ok {
+			removed = append(removed, sk)
+		}
+	}
+	if len(removed) > 0 {
+		if err := s.idx.Remove(removed...); err != nil {
+			log.Errorf("error removing service keys of AccountKey %q from reverse index: %v", key, err)
+		}
+	}
+	for sk, service := range current {
+		s.add(sk, key, service)
+	}
+}
+
+// Delete removes all ServiceKeys of the record from the Index and then deletes the record from the underlying Store.
+// The record is not deleted if its ServiceKeys cannot be removed, so a deleted account can never be resolved.
+func (s *IndexedStore) Delete(ctx context.Context, key koda.AccountKey) error {
+	record, err := s.Store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	var sks []koda.ServiceKey
+	for sk := range serviceKeys(record) {
+		sks = append(sks, sk)
+	}
+	if err := s.idx.Remove(sks...); err != nil {
+		return fmt.Errorf("could not remove service keys of key %s from reverse index: %w", key, err)
+	}
+	return s.Store.Delete(ctx, key)
+}
+
+// GetOrCreateServiceKey calls GetOrCreateServiceKey on the underlying Store and indexes the ServiceKey of service.
+func (s *IndexedStore) GetOrCreateServiceKey(ctx context.Context, key koda.AccountKey, service string, newKey koda.ServiceKey) (koda.Record, error) {
+	record, err := s.Store.GetOrCreateServiceKey(ctx, key, service, newKey)
+	if err != nil {
+		return record, err
+	}
+	if sk, ok := record.ServiceKeys[service]; ok && sk == newKey {
+		s.add(sk, key, service)
+	}
+	return record, nil
+}
+
+func (s *IndexedStore) add(sk koda.ServiceKey, key koda.AccountKey, service string) {
+	if err := s.idx.Add(sk, key, service); err != nil {
+		log.Errorf("error adding service key of AccountKey %q to reverse index: %v", key, err)
+	}
+}
+
+// serviceKeys returns all current and previous ServiceKeys of r with the service they belong to.
+func serviceKeys(r koda.Record) map[koda.ServiceKey]string {
+	keys := make(map[koda.ServiceKey]string, len(r.ServiceKeys)+len(r.KeyHistory))
+	for _, h := range r.KeyHistory {
+		keys[h.Key] = h.Service
+	}
+	for service, sk := range r.ServiceKeys {
+		keys[sk] = service
+	}
+	return keys
+}
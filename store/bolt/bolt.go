@@ -0,0 +1,280 @@
+// Package bolt implements a koda.Store in a single bbolt database file.
+//
+// Deleted records are not erased from disk immediately. bbolt frees the pages holding them, but their bytes stay in the
+// database file until the pages are reused by later writes.
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mindtastic/koda"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// Ensure that BoltStore implements the koda.Store interface
+var _ koda.Store = (*BoltStore)(nil)
+
+var recordsBucket = []byte("records")
+
+var ErrStoreClosed = errors.New("store is closed")
+
+// BoltStore is a koda.Store that keeps records in an embedded B+tree file using bbolt.
+// Every write is a transaction that is synced to disk before it returns. Only modified pages are written, and records
+// are read from a memory mapped file, so neither writes nor the heap grow with the number of records.
+// bbolt transactions cannot be cancelled, the context of an operation is only checked before it starts.
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+func init() {
+	koda.Register("bolt", func(_ context.Context, u *url.URL) (koda.Store, error) {
+		if u.Host != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("bolt store URI takes an absolute path and no options, like bolt:///data/db/koda.db")
+		}
+		return Open(u.Path)
+	})
+}
+
+// Open opens or creates the database file at path. Only a single process can open the file at a time.
+func Open(path string) (*BoltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("error creating path %s: %v", filepath.Dir(path), err)
+	}
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening database file %s: %v", path, err)
+	}
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(recordsBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing database file %s: %v", path, err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Close closes the database file. After Close is called, all operations return ErrStoreClosed.
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+// Set stores a record, replacing any existing record for key.
+func (b *BoltStore) Set(ctx context.Context, key koda.AccountKey, record koda.Record) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("could not set key %s: %w", key, err)
+	}
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		return putRecord(tx, key, record)
+	})
+	if err != nil {
+		return fmt.Errorf("could not set key %s: %w", key, translateError(err))
+	}
+	return nil
+}
+
+// Get retrieves an existing record. It returns koda.ErrNotFound if the record does not exist.
+func (b *BoltStore) Get(ctx context.Context, key koda.AccountKey) (koda.Record, error) {
+	if err := ctx.Err(); err != nil {
+		return koda.Record{}, fmt.Errorf("could not get key %s: %w", key, err)
+	}
+	var r koda.Record
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		r, err = getRecord(tx, key)
+		return err
+	})
+	if err != nil {
+		return koda.Record{}, fmt.Errorf("could not get key %s: %w", key, translateError(err))
+	}
+	return r, nil
+}
+
+// Update replaces the record of key with the result of fn. It returns koda.ErrNotFound if the record does not exist.
+// Reading and writing the record happens in a single write transaction, so fn is called exactly once.
+func (b *BoltStore) Update(ctx context.Context, key koda.AccountKey, fn func(koda.Record) (koda.Record, error)) (koda.Record, error) {
+	if err := ctx.Err(); err != nil {
+		return koda.Record{}, fmt.Errorf("could not update key %s: %w", key, err)
+	}
+	var r koda.Record
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		current, err := getRecord(tx, key)
+		if err != nil {
+			return err
+		}
+		if r, err = fn(current); err != nil {
+			return err
+		}
+		return putRecord(tx, key, r)
+	})
+	if err != nil {
+		return koda.Record{}, fmt.Errorf("could not update key %s: %w", key, translateError(err))
+	}
+	return r, nil
+}
+
+// Delete removes a record. It returns koda.ErrNotFound if the record does not exist.
+// bbolt reuses the pages of deleted records, but does not overwrite them immediately. The record might remain in
+// the database file until its pages are reused.
+func (b *BoltStore) Delete(ctx context.Context, key koda.AccountKey) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("could not delete key %s: %w", key, err)
+	}
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(recordsBucket)
+		if bucket.Get([]byte(key)) == nil {
+			return koda.ErrNotFound
+		}
+		return bucket.Delete([]byte(key))
+	})
+	if err != nil {
+		return fmt.Errorf("could not delete key %s: %w", key, translateError(err))
+	}
+	return nil
+}
+
+// List returns up to limit AccountKeys greater than after in ascending order.
+func (b *BoltStore) List(ctx context.Context, after koda.AccountKey, limit int) ([]koda.AccountKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("could not list keys: %w", err)
+	}
+	var keys []koda.AccountKey
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return scan(tx, after, limit, func(k, _ []byte) error {
+			keys = append(keys, koda.AccountKey(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list keys: %w", translateError(err))
+	}
+	return keys, nil
+}
+
+// Scan returns up to limit records with an AccountKey greater than after in ascending order.
+// Each page is read in its own read transaction, which does not block writes.
+func (b *BoltStore) Scan(ctx context.Context, after koda.AccountKey, limit int) ([]koda.Record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("could not scan records: %w", err)
+	}
+	var records []koda.Record
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return scan(tx, after, limit, func(k, v []byte) error {
+			var r koda.Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("error decoding record %s: %v", k, err)
+			}
+			r.AccountKey = koda.AccountKey(k)
+			records = append(records, r)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not scan records: %w", translateError(err))
+	}
+	return records, nil
+}
+
+// scan calls fn for up to limit records with a key greater than after in ascending order.
+func scan(tx *bbolt.Tx, after koda.AccountKey, limit int, fn func(k, v []byte) error) error {
+	c := tx.Bucket(recordsBucket).Cursor()
+	k, v := c.Seek([]byte(after))
+	if k != nil && string(k) == string(after) {
+		k, v = c.Next()
+	}
+	for n := 0; k != nil && n < limit; k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+		n++
+	}
+	return nil
+}
+
+// GetOrCreateServiceKey returns the record of key with a ServiceKey for service. If the record does not exist, it is
+// created. If the record has no ServiceKey for service, newKey is stored. Inactive records are returned unchanged.
+// bbolt allows only a single write transaction at a time, so concurrent calls never issue different ServiceKeys.
+func (b *BoltStore) GetOrCreateServiceKey(ctx context.Context, key koda.AccountKey, service string, newKey koda.ServiceKey) (koda.Record, error) {
+	r, err := b.getOrCreate(ctx, key, func(r koda.Record) (koda.Record, bool) {
+		return koda.EnsureServiceKey(r, service, newKey)
+	})
+	if err != nil {
+		return koda.Record{}, fmt.Errorf("could not create service key for %s: %w", key, err)
+	}
+	return r, nil
+}
+
+// GetOrCreateSalt returns the record of key with a Salt and an epoch for service. If the record does not exist, it is
+// created. Missing Salt and epoch are set as described by koda.EnsureSalt.
+func (b *BoltStore) GetOrCreateSalt(ctx context.Context, key koda.AccountKey, service string, salt []byte) (koda.Record, error) {
+	r, err := b.getOrCreate(ctx, key, func(r koda.Record) (koda.Record, bool) {
+		return koda.EnsureSalt(r, service, salt)
+	})
+	if err != nil {
+		return koda.Record{}, fmt.Errorf("could not create salt for %s: %w", key, err)
+	}
+	return r, nil
+}
+
+// getOrCreate applies ensure to the record of key, or a new record if it does not exist, and stores the result if
+// ensure reports a change. Both happens in a single write transaction.
+func (b *BoltStore) getOrCreate(ctx context.Context, key koda.AccountKey, ensure func(koda.Record) (koda.Record, bool)) (koda.Record, error) {
+	if err := ctx.Err(); err != nil {
+		return koda.Record{}, err
+	}
+	var r koda.Record
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		r, err = getRecord(tx, key)
+		if errors.Is(err, koda.ErrNotFound) {
+			r = koda.Record{AccountKey: key}
+		} else if err != nil {
+			return err
+		}
+		var changed bool
+		if r, changed = ensure(r); !changed {
+			return nil
+		}
+		return putRecord(tx, key, r)
+	})
+	if err != nil {
+		return koda.Record{}, translateError(err)
+	}
+	return r, nil
+}
+
+func getRecord(tx *bbolt.Tx, key koda.AccountKey) (koda.Record, error) {
+	var r koda.Record
+	v := tx.Bucket(recordsBucket).Get([]byte(key))
+	if v == nil {
+		return r, koda.ErrNotFound
+	}
+	// v is only valid during the transaction, json.Unmarshal copies all data.
+	if err := json.Unmarshal(v, &r); err != nil {
+		return r, fmt.Errorf("error decoding record: %v", err)
+	}
+	return r, nil
+}
+
+func putRecord(tx *bbolt.Tx, key koda.AccountKey, record koda.Record) error {
+	v, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error encoding record: %v", err)
+	}
+	return tx.Bucket(recordsBucket).Put([]byte(key), v)
+}
+
+// translateError maps bbolt errors to errors of this package.
+func translateError(err error) error {
+	if errors.Is(err, bbolt.ErrDatabaseNotOpen) {
+		return ErrStoreClosed
+	}
+	return err
+}
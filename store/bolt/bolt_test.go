@@ -0,0 +1,152 @@
+package bolt
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/store/storetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStore(t *testing.T) (*BoltStore, string) {
+	path := filepath.Join(t.TempDir(), "db", "koda.db")
+	b, err := Open(path)
+	if err != nil {
+		t.Fatalf("error opening store: %v", err)
+	}
+	return b, path
+}
+
+func TestBoltStore(t *testing.T) {
+	b, path := newTestStore(t)
+	record := koda.Record{
+		AccountKey:  "testing",
+		ServiceKeys: map[string]koda.ServiceKey{"user-service": "key"},
+	}
+
+	_, err := b.Get(context.Background(), record.AccountKey)
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+
+	assert.NoError(t, b.Set(context.Background(), record.AccountKey, record))
+	assert.NoError(t, b.Set(context.Background(), "other", koda.Record{AccountKey: "other"}))
+	r, err := b.Get(context.Background(), record.AccountKey)
+	assert.NoError(t, err)
+	assert.Equal(t, record, r)
+
+	assert.NoError(t, b.Delete(context.Background(), "other"))
+	assert.ErrorIs(t, b.Delete(context.Background(), "other"), koda.ErrNotFound)
+
+	// Data is persisted without an explicit flush
+	assert.NoError(t, b.Close())
+	_, err = b.Get(context.Background(), record.AccountKey)
+	assert.ErrorIs(t, err, ErrStoreClosed)
+	assert.ErrorIs(t, b.Set(context.Background(), record.AccountKey, record), ErrStoreClosed)
+
+	reopened, err := Open(path)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	r, err = reopened.Get(context.Background(), record.AccountKey)
+	assert.NoError(t, err)
+	assert.Equal(t, record, r)
+	_, err = reopened.Get(context.Background(), "other")
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+}
+
+func TestBoltStore_GetOrCreateServiceKey(t *testing.T) {
+	b, _ := newTestStore(t)
+	defer b.Close()
+	const workers = 16
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		keys = make(map[koda.ServiceKey]bool)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := uuid.GenerateUUID()
+			assert.NoError(t, err)
+			r, err := b.GetOrCreateServiceKey(context.Background(), "testing", "user-service", koda.ServiceKey(id))
+			assert.NoError(t, err)
+			mu.Lock()
+			keys[r.ServiceKeys["user-service"]] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, keys, 1)
+
+	r, err := b.Get(context.Background(), "testing")
+	assert.NoError(t, err)
+	assert.Equal(t, koda.AccountKey("testing"), r.AccountKey)
+
+	r.Inactive = true
+	assert.NoError(t, b.Set(context.Background(), "testing", r))
+	r, err = b.GetOrCreateServiceKey(context.Background(), "testing", "diary-service", "new")
+	assert.NoError(t, err)
+	assert.NotContains(t, r.ServiceKeys, "diary-service")
+}
+
+func TestBoltStore_List(t *testing.T) {
+	b, _ := newTestStore(t)
+	defer b.Close()
+	for _, k := range []koda.AccountKey{"c", "a", "b", "d"} {
+		assert.NoError(t, b.Set(context.Background(), k, koda.Record{AccountKey: k}))
+	}
+
+	testCases := []struct {
+		after    koda.AccountKey
+		limit    int
+		expected []koda.AccountKey
+	}{
+		{after: "", limit: 2, expected: []koda.AccountKey{"a", "b"}},
+		{after: "b", limit: 2, expected: []koda.AccountKey{"c", "d"}},
+		{after: "bb", limit: 10, expected: []koda.AccountKey{"c", "d"}},
+		{after: "d", limit: 2, expected: nil},
+	}
+	for _, tc := range testCases {
+		keys, err := b.List(context.Background(), tc.after, tc.limit)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, keys, "after %q", tc.after)
+	}
+}
+
+func TestBoltStore_Scan(t *testing.T) {
+	b, _ := newTestStore(t)
+	defer b.Close()
+	for _, k := range []koda.AccountKey{"c", "a", "b"} {
+		assert.NoError(t, b.Set(context.Background(), k, koda.Record{ServiceKeys: map[string]koda.ServiceKey{"user-service": koda.ServiceKey(k)}}))
+	}
+
+	records, err := b.Scan(context.Background(), "a", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.Record{{AccountKey: "b", ServiceKeys: map[string]koda.ServiceKey{"user-service": "b"}}}, records)
+
+	var visited []koda.AccountKey
+	assert.NoError(t, koda.Walk(context.Background(), b, 2, func(r koda.Record) error {
+		visited = append(visited, r.AccountKey)
+		return nil
+	}))
+	assert.Equal(t, []koda.AccountKey{"a", "b", "c"}, visited)
+}
+
+func TestConformance(t *testing.T) {
+	dir := t.TempDir()
+	storetest.RunConformance(t, storetest.Factory{
+		Open: func(t *testing.T, name string) koda.Store {
+			b, err := Open(filepath.Join(dir, name, "koda.db"))
+			if err != nil {
+				t.Fatalf("error opening store: %v", err)
+			}
+			t.Cleanup(func() { b.Close() })
+			return b
+		},
+		Persistent: true,
+	})
+}
@@ -0,0 +1,289 @@
+// Package cache implements a koda.Store that caches the records of another Store in memory.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mindtastic/koda"
+	"golang.org/x/sync/singleflight"
+)
+
+// Ensure that Store implements the koda.Store interface
+var _ koda.Store = (*Store)(nil)
+
+const (
+	DefaultSize        = 10000
+	DefaultTTL         = time.Minute
+	DefaultNegativeTTL = 5 * time.Second
+	DefaultLoadTimeout = 10 * time.Second
+)
+
+// Store is a read-through cache in front of a backend koda.Store. Records read with Get are kept in a LRU cache of a
+// bounded size for a TTL. Missing records are cached for a shorter negative TTL, so repeated lookups of unknown
+// AccountKeys do not reach the backend either. Concurrent misses of the same AccountKey are served by a single read
+// from the backend.
+// Every write through Store invalidates the cached record, so rotations, deactivations and deletions are visible
+// immediately. Writes to the backend that bypass Store are only visible after the TTL, unless the record is
+// invalidated with Invalidate. List and Scan are not cached.
+// Returned records are copies, so callers may modify them. It is safe for concurrent use.
+type Store struct {
+	backend     koda.Store
+	size        int
+	ttl         time.Duration // Entries do not expire if not positive
+	negativeTTL time.Duration // Missing records are not cached if not positive
+	loadTimeout time.Duration
+	now         func() time.Time
+	loads       singleflight.Group
+
+	mu      sync.Mutex
+	entries map[koda.AccountKey]*list.Element
+	lru     *list.List // Of *entry, most recently used first
+	writes  uint64     // Incremented by every invalidation, loads that overlap with one are not cached
+	stats   Stats
+}
+
+// entry is a cached record, or a cached ErrNotFound if notFound is set.
+type entry struct {
+	key      koda.AccountKey
+	record   koda.Record
+	notFound bool
+	expires  time.Time // Zero if the entry does not expire
+}
+
+// Stats counts the lookups of a Store.
+type Stats struct {
+	Hits          int64 `json:"hits"`
+	NegativeHits  int64 `json:"negativeHits"` // Lookups answered with a cached ErrNotFound
+	Misses        int64 `json:"misses"`
+	Loads         int64 `json:"loads"` // Reads from the backend, fewer than Misses if concurrent misses are shared
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+	Entries       int   `json:"entries"`
+}
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithSize sets the maximum number of cached entries, including missing records. Sizes < 1 are ignored.
+func WithSize(n int) Option {
+	return func(s *Store) {
+		if n > 0 {
+			s.size = n
+		}
+	}
+}
+
+// WithTTL sets the time records are cached for. Records do not expire if d is not positive, they are only evicted or
+// invalidated.
+func WithTTL(d time.Duration) Option {
+	return func(s *Store) {
+		s.ttl = d
+	}
+}
+
+// WithNegativeTTL sets the time missing records are cached for. Missing records are not cached if d is not positive.
+func WithNegativeTTL(d time.Duration) Option {
+	return func(s *Store) {
+		s.negativeTTL = d
+	}
+}
+
+// WithLoadTimeout sets the time a read from the backend may take. Durations < 1 are ignored.
+func WithLoadTimeout(d time.Duration) Option {
+	return func(s *Store) {
+		if d > 0 {
+			s.loadTimeout = d
+		}
+	}
+}
+
+// New creates a Store caching the records of backend, configured by opts.
+func New(backend koda.Store, opts ...Option) *Store {
+	s := &Store{
+		backend:     backend,
+		size:        DefaultSize,
+		ttl:         DefaultTTL,
+		negativeTTL: DefaultNegativeTTL,
+		loadTimeout: DefaultLoadTimeout,
+		now:         time.Now,
+		entries:     make(map[koda.AccountKey]*list.Element),
+		lru:         list.New(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Stats returns the statistics of the Store since it has been created.
+func (s *Store) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Entries = s.lru.Len()
+	return stats
+}
+
+// Invalidate removes the record of key from the cache. Reads of key from the backend that are in progress are not
+// cached.
+func (s *Store) Invalidate(key koda.AccountKey) {
+	s.mu.Lock()
+	s.writes++
+	if el, ok := s.entries[key]; ok {
+		s.remove(el)
+		s.stats.Invalidations++
+	}
+	s.mu.Unlock()
+	s.loads.Forget(string(key))
+}
+
+// Purge removes all records from the cache.
+func (s *Store) Purge() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes++
+	s.stats.Invalidations += int64(s.lru.Len())
+	s.entries = make(map[koda.AccountKey]*list.Element)
+	s.lru.Init()
+}
+
+// lookup returns the cached record of key. It reports false if key is not cached or its entry expired.
+func (s *Store) lookup(key koda.AccountKey) (koda.Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if ok {
+		if e := el.Value.(*entry); !e.expires.IsZero() && !s.now().Before(e.expires) {
+			s.remove(el)
+			ok = false
+		}
+	}
+	if !ok {
+		s.stats.Misses++
+		return koda.Record{}, false, nil
+	}
+	s.lru.MoveToFront(el)
+	e := el.Value.(*entry)
+	if e.notFound {
+		s.stats.NegativeHits++
+		return koda.Record{}, true, fmt.Errorf("could not get key %s: %w", key, koda.ErrNotFound)
+	}
+	s.stats.Hits++
+	return e.record.Clone(), true, nil
+}
+
+// load reads the record of key from the backend and caches the result, unless the record has been invalidated
+// during the read.
+func (s *Store) load(ctx context.Context, key koda.AccountKey) (koda.Record, error) {
+	s.mu.Lock()
+	writes := s.writes
+	s.mu.Unlock()
+
+	r, err := s.backend.Get(ctx, key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Loads++
+	if s.writes != writes {
+		return r, err
+	}
+	switch {
+	case err == nil:
+		s.add(&entry{key: key, record: r.Clone()}, s.ttl)
+	case errors.Is(err, koda.ErrNotFound) && s.negativeTTL > 0:
+		s.add(&entry{key: key, notFound: true}, s.negativeTTL)
+	}
+	return r, err
+}
+
+// add caches e for ttl and evicts the least recently used entry if the cache is full. s.mu must be held.
+func (s *Store) add(e *entry, ttl time.Duration) {
+	if ttl > 0 {
+		e.expires = s.now().Add(ttl)
+	}
+	if el, ok := s.entries[e.key]; ok {
+		el.Value = e
+		s.lru.MoveToFront(el)
+		return
+	}
+	s.entries[e.key] = s.lru.PushFront(e)
+	if s.lru.Len() > s.size {
+		s.remove(s.lru.Back())
+		s.stats.Evictions++
+	}
+}
+
+// remove removes el from the cache. s.mu must be held.
+func (s *Store) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.entries, el.Value.(*entry).key)
+}
+
+// Get returns the cached record of key, or reads it from the backend on a miss. A read from the backend is shared by
+// all concurrent callers, so it is not bound to the context of any of them but to the load timeout of s. Callers
+// waiting for it return early if their context is done.
+func (s *Store) Get(ctx context.Context, key koda.AccountKey) (koda.Record, error) {
+	if r, ok, err := s.lookup(key); ok {
+		return r, err
+	}
+	ch := s.loads.DoChan(string(key), func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), s.loadTimeout)
+		defer cancel()
+		return s.load(ctx, key)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return koda.Record{}, res.Err
+		}
+		return res.Val.(koda.Record).Clone(), nil
+	case <-ctx.Done():
+		return koda.Record{}, fmt.Errorf("could not get key %s: %w", key, ctx.Err())
+	}
+}
+
+// Set writes record to the backend and invalidates its cached copy.
+func (s *Store) Set(ctx context.Context, key koda.AccountKey, record koda.Record) error {
+	defer s.Invalidate(key)
+	return s.backend.Set(ctx, key, record)
+}
+
+// Update updates the record in the backend and invalidates its cached copy. fn is passed the record of the backend,
+// never a cached one.
+func (s *Store) Update(ctx context.Context, key koda.AccountKey, fn func(koda.Record) (koda.Record, error)) (koda.Record, error) {
+	defer s.Invalidate(key)
+	return s.backend.Update(ctx, key, fn)
+}
+
+// Delete deletes the record of key from the backend and invalidates its cached copy.
+func (s *Store) Delete(ctx context.Context, key koda.AccountKey) error {
+	defer s.Invalidate(key)
+	return s.backend.Delete(ctx, key)
+}
+
+// List returns AccountKeys from the backend.
+func (s *Store) List(ctx context.Context, after koda.AccountKey, limit int) ([]koda.AccountKey, error) {
+	return s.backend.List(ctx, after, limit)
+}
+
+// Scan returns records from the backend.
+func (s *Store) Scan(ctx context.Context, after koda.AccountKey, limit int) ([]koda.Record, error) {
+	return s.backend.Scan(ctx, after, limit)
+}
+
+// GetOrCreateServiceKey calls the backend, as it might write, and invalidates the cached copy of the record.
+func (s *Store) GetOrCreateServiceKey(ctx context.Context, key koda.AccountKey, service string, newKey koda.ServiceKey) (koda.Record, error) {
+	defer s.Invalidate(key)
+	return s.backend.GetOrCreateServiceKey(ctx, key, service, newKey)
+}
+
+// GetOrCreateSalt calls the backend, as it might write, and invalidates the cached copy of the record.
+func (s *Store) GetOrCreateSalt(ctx context.Context, key koda.AccountKey, service string, salt []byte) (koda.Record, error) {
+	defer s.Invalidate(key)
+	return s.backend.GetOrCreateSalt(ctx, key, service, salt)
+}
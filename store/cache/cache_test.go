@@ -0,0 +1,246 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/store/localfile"
+	"github.com/mindtastic/koda/store/storetest"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingStore counts the Gets of a koda.Store. If block is set, Gets wait until it is closed or their context is
+// done.
+type countingStore struct {
+	koda.Store
+	gets  int64
+	block chan struct{}
+}
+
+func (s *countingStore) Get(ctx context.Context, key koda.AccountKey) (koda.Record, error) {
+	atomic.AddInt64(&s.gets, 1)
+	if s.block != nil {
+		select {
+		case <-s.block:
+		case <-ctx.Done():
+			return koda.Record{}, ctx.Err()
+		}
+	}
+	return s.Store.Get(ctx, key)
+}
+
+func newTestStore(opts ...Option) (*Store, *countingStore) {
+	backend := &countingStore{Store: localfile.New()}
+	return New(backend, opts...), backend
+}
+
+func TestStore(t *testing.T) {
+	s, backend := newTestStore()
+	record := koda.Record{AccountKey: "testing", ServiceKeys: map[string]koda.ServiceKey{"user-service": "key"}}
+	assert.NoError(t, s.Set(context.Background(), record.AccountKey, record))
+
+	for i := 0; i < 3; i++ {
+		r, err := s.Get(context.Background(), record.AccountKey)
+		assert.NoError(t, err)
+		assert.Equal(t, record, r)
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&backend.gets))
+
+	// Returned records do not share maps with the cache
+	r, err := s.Get(context.Background(), record.AccountKey)
+	assert.NoError(t, err)
+	r.ServiceKeys["user-service"] = "modified"
+	r, err = s.Get(context.Background(), record.AccountKey)
+	assert.NoError(t, err)
+	assert.Equal(t, koda.ServiceKey("key"), r.ServiceKeys["user-service"])
+
+	// Writes invalidate the cached record
+	r.Deactivate("fraud", time.Now().UTC())
+	assert.NoError(t, s.Set(context.Background(), record.AccountKey, r))
+	cached, err := s.Get(context.Background(), record.AccountKey)
+	assert.NoError(t, err)
+	assert.True(t, cached.Inactive)
+
+	_, err = s.GetOrCreateServiceKey(context.Background(), record.AccountKey, "diary-service", "other")
+	assert.NoError(t, err)
+	assert.NoError(t, s.Delete(context.Background(), record.AccountKey))
+	_, err = s.Get(context.Background(), record.AccountKey)
+	assert.True(t, errors.Is(err, koda.ErrNotFound))
+
+	assert.Equal(t, Stats{Hits: 4, Misses: 3, Loads: 3, Invalidations: 2, Entries: 1}, s.Stats())
+}
+
+func TestNegativeCaching(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	s, backend := newTestStore(WithNegativeTTL(time.Second))
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		_, err := s.Get(context.Background(), "unknown")
+		assert.True(t, errors.Is(err, koda.ErrNotFound))
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&backend.gets))
+	assert.Equal(t, int64(1), s.Stats().NegativeHits)
+
+	// Creating the record replaces the cached ErrNotFound
+	_, err := s.GetOrCreateSalt(context.Background(), "unknown", "user-service", []byte("salt"))
+	assert.NoError(t, err)
+	r, err := s.Get(context.Background(), "unknown")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("salt"), r.Salt)
+
+	_, err = s.Get(context.Background(), "other")
+	assert.True(t, errors.Is(err, koda.ErrNotFound))
+	now = now.Add(time.Second)
+	_, err = s.Get(context.Background(), "other")
+	assert.True(t, errors.Is(err, koda.ErrNotFound))
+	assert.Equal(t, int64(4), atomic.LoadInt64(&backend.gets))
+
+	s, backend = newTestStore(WithNegativeTTL(0))
+	for i := 0; i < 2; i++ {
+		_, err := s.Get(context.Background(), "unknown")
+		assert.True(t, errors.Is(err, koda.ErrNotFound))
+	}
+	assert.Equal(t, int64(2), atomic.LoadInt64(&backend.gets))
+}
+
+func TestExpiryAndEviction(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	s, backend := newTestStore(WithSize(2), WithTTL(time.Minute))
+	s.now = func() time.Time { return now }
+	for _, k := range []koda.AccountKey{"a", "b", "c"} {
+		assert.NoError(t, backend.Set(context.Background(), k, koda.Record{AccountKey: k}))
+	}
+
+	get := func(k koda.AccountKey) {
+		_, err := s.Get(context.Background(), k)
+		assert.NoError(t, err)
+	}
+	get("a")
+	get("b")
+	get("a") // b is now the least recently used
+	get("c")
+	assert.Equal(t, Stats{Hits: 1, Misses: 3, Loads: 3, Evictions: 1, Entries: 2}, s.Stats())
+	get("a")
+	get("b")
+	assert.Equal(t, int64(4), atomic.LoadInt64(&backend.gets))
+
+	now = now.Add(time.Minute)
+	get("b")
+	assert.Equal(t, int64(5), atomic.LoadInt64(&backend.gets))
+
+	s.Purge()
+	assert.Equal(t, 0, s.Stats().Entries)
+}
+
+func TestSingleflight(t *testing.T) {
+	s, backend := newTestStore()
+	assert.NoError(t, backend.Set(context.Background(), "testing", koda.Record{AccountKey: "testing"}))
+	backend.block = make(chan struct{})
+
+	const workers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := s.Get(context.Background(), "testing")
+			assert.NoError(t, err)
+			assert.Equal(t, koda.AccountKey("testing"), r.AccountKey)
+		}()
+	}
+	for s.Stats().Misses < workers {
+		time.Sleep(time.Millisecond)
+	}
+	close(backend.block)
+	wg.Wait()
+	assert.Equal(t, int64(1), atomic.LoadInt64(&backend.gets))
+	assert.Equal(t, int64(1), s.Stats().Loads)
+
+	// Waiting callers return when their context is done
+	backend.block = make(chan struct{})
+	defer close(backend.block)
+	s.Invalidate("testing")
+	go s.Get(context.Background(), "testing")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := s.Get(ctx, "testing")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestLoadContext(t *testing.T) {
+	s, backend := newTestStore()
+	assert.NoError(t, backend.Set(context.Background(), "testing", koda.Record{AccountKey: "testing"}))
+	backend.block = make(chan struct{})
+
+	// The caller that started the load is cancelled, the load continues for the other caller
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := s.Get(ctx, "testing")
+		first <- err
+	}()
+	for atomic.LoadInt64(&backend.gets) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan koda.Record, 1)
+	go func() {
+		r, err := s.Get(context.Background(), "testing")
+		assert.NoError(t, err)
+		second <- r
+	}()
+	for s.Stats().Misses < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	assert.ErrorIs(t, <-first, context.Canceled)
+	close(backend.block)
+	assert.Equal(t, koda.AccountKey("testing"), (<-second).AccountKey)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&backend.gets))
+
+	// Loads are bounded by the load timeout
+	s, backend = newTestStore(WithLoadTimeout(10 * time.Millisecond))
+	backend.block = make(chan struct{})
+	defer close(backend.block)
+	_, err := s.Get(context.Background(), "testing")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestInvalidateDuringLoad(t *testing.T) {
+	s, backend := newTestStore()
+	assert.NoError(t, backend.Set(context.Background(), "testing", koda.Record{AccountKey: "testing"}))
+	backend.block = make(chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := s.Get(context.Background(), "testing")
+		assert.NoError(t, err)
+	}()
+	for atomic.LoadInt64(&backend.gets) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The record is written while it is read, the possibly outdated read must not be cached
+	assert.NoError(t, s.Set(context.Background(), "testing", koda.Record{AccountKey: "testing", Inactive: true}))
+	close(backend.block)
+	<-done
+
+	r, err := s.Get(context.Background(), "testing")
+	assert.NoError(t, err)
+	assert.True(t, r.Inactive)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&backend.gets))
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, storetest.Factory{
+		Open: func(t *testing.T, name string) koda.Store {
+			s, _ := newTestStore()
+			return s
+		},
+	})
+}
@@ -0,0 +1,388 @@
+// Package dual implements a koda.Store that migrates records from one Store to another while both stay in use.
+package dual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/log"
+)
+
+// Ensure that Store implements the koda.Store interface
+var _ koda.Store = (*Store)(nil)
+
+// copyPageSize is the number of records Copy reads from the old Store at a time.
+const copyPageSize = 500
+
+// ErrUnmirrored is returned by FlipReads while the new Store misses writes that failed to be mirrored to it.
+var ErrUnmirrored = errors.New("writes have not been mirrored to the new store")
+
+// Store is a koda.Store that writes to an old and a new Store, while Copy transfers all existing records from the
+// old to the new Store. The old Store stays the source of truth: every write is applied to it first and then mirrored
+// to the new Store. Failing to mirror a write is logged and counted, but does not fail the operation. The record is
+// unmirrored until it is copied again by Copy or RetryMirrors, or a later write of it is mirrored. Deletions are the
+// exception, they fail unless the record is gone from both Stores.
+// Reads are served by the old Store and fall back to the new Store if the old Store fails. After FlipReads, reads are
+// served by the new Store and fall back to the old one. Unmirrored records are always read from the old Store.
+type Store struct {
+	old, new koda.Store
+	flipped  int32          // Accessed atomically, 1 if reads are flipped
+	locks    [64]sync.Mutex // Serializes writes and copies of the same key
+
+	mu         sync.Mutex
+	unmirrored map[koda.AccountKey]bool // Records the new Store holds an outdated copy of
+
+	// Progress of the migration, accessed atomically
+	copied       int64
+	total        int64
+	mirrorErrors int64
+}
+
+// New creates a Store migrating from old to new.
+func New(old, new koda.Store) *Store {
+	return &Store{old: old, new: new, unmirrored: make(map[koda.AccountKey]bool)}
+}
+
+// Progress describes the state of a migration.
+type Progress struct {
+	Copied       int64 `json:"copied"`
+	Total        int64 `json:"total"` // Number of records in the old Store when Copy started
+	MirrorErrors int64 `json:"mirrorErrors"`
+	Unmirrored   int   `json:"unmirrored"` // Number of records with a failed mirror that has not been retried yet
+	ReadsFlipped bool  `json:"readsFlipped"`
+}
+
+// Progress returns the current progress of the migration. It is safe to call while Copy is running.
+func (s *Store) Progress() Progress {
+	s.mu.Lock()
+	unmirrored := len(s.unmirrored)
+	s.mu.Unlock()
+	return Progress{
+		Copied:       atomic.LoadInt64(&s.copied),
+		Total:        atomic.LoadInt64(&s.total),
+		MirrorErrors: atomic.LoadInt64(&s.mirrorErrors),
+		Unmirrored:   unmirrored,
+		ReadsFlipped: atomic.LoadInt32(&s.flipped) == 1,
+	}
+}
+
+// FlipReads makes the new Store serve reads, falling back to the old Store. It returns ErrUnmirrored and leaves reads
+// unchanged if any record is unmirrored, see RetryMirrors.
+func (s *Store) FlipReads() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.unmirrored); n > 0 {
+		return fmt.Errorf("%w: %d records are outdated in the new store", ErrUnmirrored, n)
+	}
+	atomic.StoreInt32(&s.flipped, 1)
+	return nil
+}
+
+// RetryMirrors copies all unmirrored records from the old Store to the new Store again. Records deleted from the old
+// Store are deleted from the new Store as well.
+func (s *Store) RetryMirrors(ctx context.Context) error {
+	s.mu.Lock()
+	keys := make([]koda.AccountKey, 0, len(s.unmirrored))
+	for key := range s.unmirrored {
+		keys = append(keys, key)
+	}
+	s.mu.Unlock()
+	for _, key := range keys {
+		if err := s.remirror(ctx, key); err != nil {
+			return fmt.Errorf("error mirroring record %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) remirror(ctx context.Context, key koda.AccountKey) error {
+	defer s.lock(key)()
+	r, err := s.old.Get(ctx, key)
+	switch {
+	case errors.Is(err, koda.ErrNotFound):
+		if err = s.new.Delete(ctx, key); errors.Is(err, koda.ErrNotFound) {
+			err = nil
+		}
+	case err == nil:
+		err = s.new.Set(ctx, key, r)
+	}
+	if err != nil {
+		return err
+	}
+	s.setUnmirrored(key, false)
+	return nil
+}
+
+// setUnmirrored marks the record of key as unmirrored, or as mirrored if unmirrored is false.
+func (s *Store) setUnmirrored(key koda.AccountKey, unmirrored bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if unmirrored {
+		s.unmirrored[key] = true
+	} else {
+		delete(s.unmirrored, key)
+	}
+}
+
+// readers returns the Store serving reads and its fallback.
+func (s *Store) readers() (koda.Store, koda.Store) {
+	if atomic.LoadInt32(&s.flipped) == 1 {
+		return s.new, s.old
+	}
+	return s.old, s.new
+}
+
+func (s *Store) lock(key koda.AccountKey) func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	m := &s.locks[h.Sum32()%uint32(len(s.locks))]
+	m.Lock()
+	return m.Unlock
+}
+
+// mirror records the result err of mirroring a write of key to the new Store. Every write mirrors the whole record, so
+// a successful mirror also replaces the copy left behind by a previous failed one.
+func (s *Store) mirror(key koda.AccountKey, err error) {
+	s.setUnmirrored(key, err != nil)
+	if err != nil {
+		atomic.AddInt64(&s.mirrorErrors, 1)
+		log.Errorf("error mirroring write of AccountKey %q to new store: %v", key, err)
+	}
+}
+
+// Set stores record in the old and the new Store.
+func (s *Store) Set(ctx context.Context, key koda.AccountKey, record koda.Record) error {
+	defer s.lock(key)()
+	if err := s.old.Set(ctx, key, record); err != nil {
+		return err
+	}
+	s.mirror(key, s.new.Set(ctx, key, record))
+	return nil
+}
+
+// Get retrieves a record from the Store serving reads. If it fails, the record is retrieved from the fallback.
+// As the old Store is the source of truth, a record it does not hold is not retrieved from the new Store, which might
+// still hold a record deleted during the migration. Unmirrored records are retrieved from the old Store only.
+func (s *Store) Get(ctx context.Context, key koda.AccountKey) (koda.Record, error) {
+	s.mu.Lock()
+	unmirrored := s.unmirrored[key]
+	s.mu.Unlock()
+	if unmirrored {
+		return s.old.Get(ctx, key)
+	}
+	primary, fallback := s.readers()
+	r, err := primary.Get(ctx, key)
+	if err == nil {
+		return r, nil
+	}
+	if primary == s.old && errors.Is(err, koda.ErrNotFound) {
+		return koda.Record{}, err
+	}
+	if fr, ferr := fallback.Get(ctx, key); ferr == nil {
+		return fr, nil
+	}
+	return koda.Record{}, err
+}
+
+// Update updates the record in the old Store and mirrors the result to the new Store.
+func (s *Store) Update(ctx context.Context, key koda.AccountKey, fn func(koda.Record) (koda.Record, error)) (koda.Record, error) {
+	defer s.lock(key)()
+	r, err := s.old.Update(ctx, key, fn)
+	if err != nil {
+		return r, err
+	}
+	s.mirror(key, s.new.Set(ctx, key, r))
+	return r, nil
+}
+
+// Delete deletes the record from the new and then from the old Store. It returns koda.ErrNotFound if the old Store
+// does not hold the record. If either deletion fails, the record is still served by the old Store, so the deletion can
+// be retried.
+func (s *Store) Delete(ctx context.Context, key koda.AccountKey) error {
+	defer s.lock(key)()
+	if err := s.new.Delete(ctx, key); err != nil && !errors.Is(err, koda.ErrNotFound) {
+		return fmt.Errorf("could not delete key %s from new store: %w", key, err)
+	}
+	if err := s.old.Delete(ctx, key); err != nil {
+		return err
+	}
+	s.setUnmirrored(key, false)
+	return nil
+}
+
+// List lists AccountKeys of the Store serving reads.
+func (s *Store) List(ctx context.Context, after koda.AccountKey, limit int) ([]koda.AccountKey, error) {
+	primary, _ := s.readers()
+	return primary.List(ctx, after, limit)
+}
+
+// Scan scans records of the Store serving reads.
+func (s *Store) Scan(ctx context.Context, after koda.AccountKey, limit int) ([]koda.Record, error) {
+	primary, _ := s.readers()
+	return primary.Scan(ctx, after, limit)
+}
+
+// GetOrCreateServiceKey calls GetOrCreateServiceKey on the old Store and mirrors the resulting record to the new
+// Store, so both issue the same ServiceKey.
+func (s *Store) GetOrCreateServiceKey(ctx context.Context, key koda.AccountKey, service string, newKey koda.ServiceKey) (koda.Record, error) {
+	defer s.lock(key)()
+	r, err := s.old.GetOrCreateServiceKey(ctx, key, service, newKey)
+	if err != nil {
+		return r, err
+	}
+	s.mirror(key, s.new.Set(ctx, key, r))
+	return r, nil
+}
+
+// GetOrCreateSalt calls GetOrCreateSalt on the old Store and mirrors the resulting record to the new Store.
+func (s *Store) GetOrCreateSalt(ctx context.Context, key koda.AccountKey, service string, salt []byte) (koda.Record, error) {
+	defer s.lock(key)()
+	r, err := s.old.GetOrCreateSalt(ctx, key, service, salt)
+	if err != nil {
+		return r, err
+	}
+	s.mirror(key, s.new.Set(ctx, key, r))
+	return r, nil
+}
+
+// Copy copies all records of the old Store to the new Store, replacing records the new Store already holds.
+// Each record is read again from the old Store while concurrent writes to it are held back, so Copy never overwrites
+// a newer record with a stale one. Records deleted during the copy are skipped.
+func (s *Store) Copy(ctx context.Context) error {
+	atomic.StoreInt64(&s.copied, 0)
+	var total int64
+	var after koda.AccountKey
+	for {
+		keys, err := s.old.List(ctx, after, copyPageSize)
+		if err != nil {
+			return fmt.Errorf("error counting records: %w", err)
+		}
+		total += int64(len(keys))
+		if len(keys) < copyPageSize {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+	atomic.StoreInt64(&s.total, total)
+
+	after = ""
+	for {
+		keys, err := s.old.List(ctx, after, copyPageSize)
+		if err != nil {
+			return fmt.Errorf("error listing records: %w", err)
+		}
+		for _, key := range keys {
+			if err := s.copy(ctx, key); err != nil {
+				return fmt.Errorf("error copying record %s: %w", key, err)
+			}
+			atomic.AddInt64(&s.copied, 1)
+		}
+		if len(keys) < copyPageSize {
+			return nil
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+func (s *Store) copy(ctx context.Context, key koda.AccountKey) error {
+	defer s.lock(key)()
+	r, err := s.old.Get(ctx, key)
+	if errors.Is(err, koda.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.new.Set(ctx, key, r); err != nil {
+		return err
+	}
+	s.setUnmirrored(key, false)
+	return nil
+}
+
+// Report is the result of Verify.
+type Report struct {
+	Checked    int               `json:"checked"`
+	Missing    []koda.AccountKey `json:"missing,omitempty"`    // Records of the old Store missing in the new Store
+	Mismatched []koda.AccountKey `json:"mismatched,omitempty"` // Records that differ between both Stores
+	Extra      []koda.AccountKey `json:"extra,omitempty"`      // Records of the new Store missing in the old Store
+}
+
+// OK reports whether both Stores hold the same records.
+func (r Report) OK() bool {
+	return len(r.Missing) == 0 && len(r.Mismatched) == 0 && len(r.Extra) == 0
+}
+
+// Verify compares all records of the old and the new Store. Records written during the verification might be
+// reported as differing.
+func (s *Store) Verify(ctx context.Context) (Report, error) {
+	var report Report
+	err := koda.Walk(ctx, s.old, copyPageSize, func(r koda.Record) error {
+		report.Checked++
+		nr, err := s.new.Get(ctx, r.AccountKey)
+		if errors.Is(err, koda.ErrNotFound) {
+			report.Missing = append(report.Missing, r.AccountKey)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		nr.AccountKey = r.AccountKey
+		if !equal(r, nr) {
+			report.Mismatched = append(report.Mismatched, r.AccountKey)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("error verifying old store: %w", err)
+	}
+	err = koda.Walk(ctx, s.new, copyPageSize, func(r koda.Record) error {
+		if _, err := s.old.Get(ctx, r.AccountKey); errors.Is(err, koda.ErrNotFound) {
+			report.Extra = append(report.Extra, r.AccountKey)
+		} else if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("error verifying new store: %w", err)
+	}
+	return report, nil
+}
+
+// equal compares two records, ignoring the difference between nil and empty collections and time zones, which do not
+// survive every Store.
+func equal(a, b koda.Record) bool {
+	normalize := func(r *koda.Record) {
+		if len(r.ServiceKeys) == 0 {
+			r.ServiceKeys = nil
+		}
+		if len(r.Epochs) == 0 {
+			r.Epochs = nil
+		}
+		if len(r.KeyHistory) == 0 {
+			r.KeyHistory = nil
+		}
+		if len(r.Salt) == 0 {
+			r.Salt = nil
+		}
+		for i := range r.KeyHistory {
+			r.KeyHistory[i].RotatedAt = r.KeyHistory[i].RotatedAt.UTC()
+		}
+		if r.DeactivatedAt != nil {
+			t := r.DeactivatedAt.UTC()
+			r.DeactivatedAt = &t
+		}
+	}
+	a.KeyHistory = append([]koda.RotatedKey(nil), a.KeyHistory...)
+	b.KeyHistory = append([]koda.RotatedKey(nil), b.KeyHistory...)
+	normalize(&a)
+	normalize(&b)
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,201 @@
+package dual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/store/localfile"
+	"github.com/mindtastic/koda/store/storetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	old, new := localfile.New(), localfile.New()
+	ctx := context.Background()
+	assert.NoError(t, old.Set(ctx, "existing", koda.Record{AccountKey: "existing"}))
+	assert.NoError(t, new.Set(ctx, "new-only", koda.Record{AccountKey: "new-only"}))
+	s := New(old, new)
+
+	// Records missing in the old store are not read from the new store
+	_, err := s.Get(ctx, "new-only")
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+	_, err = s.Get(ctx, "unknown")
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+
+	// Writes go to both stores
+	r, err := s.GetOrCreateServiceKey(ctx, "created", "user-service", "key")
+	assert.NoError(t, err)
+	nr, err := new.Get(ctx, "created")
+	assert.NoError(t, err)
+	assert.Equal(t, r, nr)
+
+	assert.NoError(t, s.Delete(ctx, "created"))
+	_, err = new.Get(ctx, "created")
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+
+	report, err := s.Verify(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.AccountKey{"existing"}, report.Missing)
+	assert.Equal(t, []koda.AccountKey{"new-only"}, report.Extra)
+	assert.ErrorIs(t, s.Delete(ctx, "new-only"), koda.ErrNotFound, "the old store is the source of truth")
+	_, err = new.Get(ctx, "new-only")
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+
+	assert.NoError(t, s.Copy(ctx))
+	assert.Equal(t, Progress{Copied: 1, Total: 1}, s.Progress())
+	report, err = s.Verify(ctx)
+	assert.NoError(t, err)
+	assert.True(t, report.OK(), "%+v", report)
+
+	// After flipping, reads are served by the new store
+	assert.NoError(t, new.Set(ctx, "existing", koda.Record{AccountKey: "existing", DeactivationReason: "new"}))
+	r, err = s.Get(ctx, "existing")
+	assert.NoError(t, err)
+	assert.Empty(t, r.DeactivationReason)
+	assert.NoError(t, s.FlipReads())
+	r, err = s.Get(ctx, "existing")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", r.DeactivationReason)
+	assert.True(t, s.Progress().ReadsFlipped)
+}
+
+// failingDeleteStore is a koda.Store whose deletions fail while fail is set.
+type failingDeleteStore struct {
+	koda.Store
+	fail bool
+}
+
+func (s *failingDeleteStore) Delete(ctx context.Context, key koda.AccountKey) error {
+	if s.fail {
+		return errors.New("unavailable")
+	}
+	return s.Store.Delete(ctx, key)
+}
+
+func TestDelete_NewStoreFails(t *testing.T) {
+	old, new := localfile.New(), &failingDeleteStore{Store: localfile.New(), fail: true}
+	ctx := context.Background()
+	s := New(old, new)
+	assert.NoError(t, s.Set(ctx, "testing", koda.Record{AccountKey: "testing"}))
+
+	// A failed deletion leaves the record in place, so it can be retried
+	assert.Error(t, s.Delete(ctx, "testing"))
+	_, err := s.Get(ctx, "testing")
+	assert.NoError(t, err)
+	assert.NoError(t, s.FlipReads())
+	_, err = s.Get(ctx, "testing")
+	assert.NoError(t, err)
+
+	new.fail = false
+	assert.NoError(t, s.Delete(ctx, "testing"))
+	for _, st := range []koda.Store{s, old, new} {
+		_, err = st.Get(ctx, "testing")
+		assert.ErrorIs(t, err, koda.ErrNotFound)
+	}
+}
+
+// failingSetStore is a koda.Store whose Sets fail while fail is set.
+type failingSetStore struct {
+	koda.Store
+	fail bool
+}
+
+func (s *failingSetStore) Set(ctx context.Context, key koda.AccountKey, record koda.Record) error {
+	if s.fail {
+		return errors.New("unavailable")
+	}
+	return s.Store.Set(ctx, key, record)
+}
+
+func TestFlipReads_Unmirrored(t *testing.T) {
+	old, new := localfile.New(), &failingSetStore{Store: localfile.New()}
+	ctx := context.Background()
+	s := New(old, new)
+	assert.NoError(t, s.Set(ctx, "testing", koda.Record{AccountKey: "testing"}))
+
+	// The deactivation is not mirrored, the new store holds the active record
+	new.fail = true
+	deactivate := func(r koda.Record) (koda.Record, error) {
+		r.Deactivate("fraud", time.Now())
+		return r, nil
+	}
+	_, err := s.Update(ctx, "testing", deactivate)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, s.Progress().Unmirrored)
+	assert.ErrorIs(t, s.FlipReads(), ErrUnmirrored)
+	assert.False(t, s.Progress().ReadsFlipped)
+	assert.Error(t, s.RetryMirrors(ctx))
+
+	new.fail = false
+	assert.NoError(t, s.RetryMirrors(ctx))
+	assert.Zero(t, s.Progress().Unmirrored)
+	assert.NoError(t, s.FlipReads())
+	r, err := new.Get(ctx, "testing")
+	assert.NoError(t, err)
+	assert.True(t, r.Inactive)
+
+	// Records that fail to be mirrored after the flip are read from the old store
+	new.fail = true
+	_, err = s.Update(ctx, "testing", func(r koda.Record) (koda.Record, error) {
+		r.DeactivationReason = "chargeback"
+		return r, nil
+	})
+	assert.NoError(t, err)
+	r, err = s.Get(ctx, "testing")
+	assert.NoError(t, err)
+	assert.Equal(t, "chargeback", r.DeactivationReason)
+}
+
+func TestCopy_ConcurrentWrites(t *testing.T) {
+	old, new := localfile.New(), localfile.New()
+	ctx := context.Background()
+	for i := 0; i < 3*copyPageSize; i++ {
+		k := koda.AccountKey(fmt.Sprintf("key-%04d", i))
+		assert.NoError(t, old.Set(ctx, k, koda.Record{AccountKey: k}))
+	}
+	s := New(old, new)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			k := koda.AccountKey(fmt.Sprintf("key-%04d", i%(3*copyPageSize)))
+			switch i % 3 {
+			case 0:
+				s.Delete(ctx, k)
+			default:
+				r := koda.Record{AccountKey: k}
+				r.Deactivate(fmt.Sprint(i), time.Now())
+				assert.NoError(t, s.Set(ctx, k, r))
+			}
+		}
+	}()
+	assert.NoError(t, s.Copy(ctx))
+	close(done)
+	wg.Wait()
+
+	report, err := s.Verify(ctx)
+	assert.NoError(t, err)
+	assert.True(t, report.OK(), "%+v", report)
+	assert.Zero(t, s.Progress().MirrorErrors)
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, storetest.Factory{
+		Open: func(t *testing.T, name string) koda.Store {
+			return New(localfile.New(), localfile.New())
+		},
+	})
+}
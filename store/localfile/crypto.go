@@ -0,0 +1,169 @@
+package localfile
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// KeySize is the size of a master key in bytes. Data is encrypted with AES-256-GCM.
+const KeySize = 32
+
+// encryptedMagic prefixes encrypted data files. It is followed by a format version byte, the big endian uint32
+// version of the master key, the nonce and the sealed data. The header is authenticated as additional data.
+var encryptedMagic = []byte("KODAENC")
+
+const encryptedFormatVersion = 1
+
+var ErrNoKeyring = errors.New("data is encrypted but no keyring is configured")
+
+// Keyring holds versioned master keys. Data is always encrypted with the key of the highest version, while every key
+// in the Keyring can be used to decrypt data. To re-encrypt data under a new master key, add it with a higher version
+// while keeping the previous keys until all data has been written again.
+type Keyring struct {
+	keys    map[uint32]cipher.AEAD
+	primary uint32
+}
+
+// NewKeyring creates an empty Keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[uint32]cipher.AEAD)}
+}
+
+// Add adds a master key with the given version. Keys must be KeySize bytes long and versions must be unique.
+func (k *Keyring) Add(version uint32, key []byte) error {
+	if len(key) != KeySize {
+		return fmt.Errorf("key version %d: key must be %d bytes, got %d", version, KeySize, len(key))
+	}
+	if _, ok := k.keys[version]; ok {
+		return fmt.Errorf("key version %d: duplicate version", version)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("key version %d: %v", version, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("key version %d: %v", version, err)
+	}
+	if len(k.keys) == 0 || version > k.primary {
+		k.primary = version
+	}
+	k.keys[version] = aead
+	return nil
+}
+
+// ParseKeyring parses master keys from s. Keys are given as <version>:<base64 key> and separated by newlines or commas.
+// Empty lines and lines starting with # are ignored.
+func ParseKeyring(s string) (*Keyring, error) {
+	k := NewKeyring()
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			v, key, ok := strings.Cut(entry, ":")
+			if !ok {
+				return nil, errors.New("key entry must be of the form <version>:<base64 key>")
+			}
+			version, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key version %q: %v", v, err)
+			}
+			raw, err := base64.StdEncoding.DecodeString(key)
+			if err != nil {
+				return nil, fmt.Errorf("key version %d: invalid base64: %v", version, err)
+			}
+			if err := k.Add(uint32(version), raw); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(k.keys) == 0 {
+		return nil, errors.New("no keys found")
+	}
+	return k, nil
+}
+
+// LoadKeyring reads a Keyring from the file at path. See ParseKeyring for the format.
+func LoadKeyring(path string) (*Keyring, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %v", err)
+	}
+	k, err := ParseKeyring(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing key file %s: %v", path, err)
+	}
+	return k, nil
+}
+
+// PrimaryVersion returns the version of the key new data is encrypted with.
+func (k *Keyring) PrimaryVersion() uint32 {
+	return k.primary
+}
+
+func encryptedHeaderSize() int {
+	return len(encryptedMagic) + 1 + 4
+}
+
+// IsEncrypted reports whether data starts with the header of data encrypted by a Keyring.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic)
+}
+
+// Seal encrypts and authenticates plaintext with the primary key.
+func (k *Keyring) Seal(plaintext []byte) ([]byte, error) {
+	aead := k.keys[k.primary]
+	header := make([]byte, encryptedHeaderSize(), encryptedHeaderSize()+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	copy(header, encryptedMagic)
+	header[len(encryptedMagic)] = encryptedFormatVersion
+	binary.BigEndian.PutUint32(header[len(encryptedMagic)+1:], k.primary)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %v", err)
+	}
+	out := append(header, nonce...)
+	return aead.Seal(out, nonce, plaintext, header), nil
+}
+
+// Open decrypts data sealed with any key in k. It fails if data has been modified.
+func (k *Keyring) Open(data []byte) ([]byte, error) {
+	if len(data) < encryptedHeaderSize() || !IsEncrypted(data) {
+		return nil, errors.New("data is not encrypted")
+	}
+	header := data[:encryptedHeaderSize()]
+	if v := header[len(encryptedMagic)]; v != encryptedFormatVersion {
+		return nil, fmt.Errorf("unsupported encryption format version %d", v)
+	}
+	version := binary.BigEndian.Uint32(header[len(encryptedMagic)+1:])
+	aead, ok := k.keys[version]
+	if !ok {
+		return nil, fmt.Errorf("no key with version %d in keyring", version)
+	}
+
+	data = data[encryptedHeaderSize():]
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data with key version %d: %v", version, err)
+	}
+	return plaintext, nil
+}
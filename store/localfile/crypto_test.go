@@ -0,0 +1,131 @@
+package localfile
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mindtastic/koda"
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, KeySize))
+}
+
+func TestParseKeyring(t *testing.T) {
+	testCases := []struct {
+		name    string
+		input   string
+		primary uint32
+		err     string
+	}{
+		{name: "single key", input: "1:" + testKey(1), primary: 1},
+		{name: "comma separated", input: "1:" + testKey(1) + ",3:" + testKey(3) + ",2:" + testKey(2), primary: 3},
+		{name: "key file", input: "# koda master keys\n1:" + testKey(1) + "\n\n2:" + testKey(2) + "\n", primary: 2},
+		{name: "empty", input: "# nothing here\n", err: "no keys found"},
+		{name: "missing version", input: testKey(1), err: "key entry must be of the form <version>:<base64 key>"},
+		{name: "invalid version", input: "one:" + testKey(1), err: `invalid key version "one": strconv.ParseUint: parsing "one": invalid syntax`},
+		{name: "short key", input: "1:" + base64.StdEncoding.EncodeToString([]byte("short")), err: "key version 1: key must be 32 bytes, got 5"},
+		{name: "duplicate version", input: "1:" + testKey(1) + ",1:" + testKey(2), err: "key version 1: duplicate version"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			k, err := ParseKeyring(tc.input)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.primary, k.PrimaryVersion())
+		})
+	}
+}
+
+func TestKeyring_SealOpen(t *testing.T) {
+	old, err := ParseKeyring("1:" + testKey(1))
+	assert.NoError(t, err)
+	rotated, err := ParseKeyring("1:" + testKey(1) + ",2:" + testKey(2))
+	assert.NoError(t, err)
+	other, err := ParseKeyring("1:" + testKey(9))
+	assert.NoError(t, err)
+
+	plaintext := []byte(`{"some":"data"}`)
+	sealed, err := old.Seal(plaintext)
+	assert.NoError(t, err)
+	assert.True(t, IsEncrypted(sealed))
+	assert.False(t, bytes.Contains(sealed, plaintext))
+
+	// Data sealed with an old key can be opened after rotation
+	opened, err := rotated.Open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, opened)
+
+	// Data sealed after rotation cannot be opened without the new key
+	resealed, err := rotated.Seal(plaintext)
+	assert.NoError(t, err)
+	_, err = old.Open(resealed)
+	assert.EqualError(t, err, "no key with version 2 in keyring")
+
+	_, err = other.Open(sealed)
+	assert.EqualError(t, err, "error decrypting data with key version 1: cipher: message authentication failed")
+
+	// The key version in the header is authenticated
+	tampered := append([]byte(nil), resealed...)
+	tampered[len(encryptedMagic)+4] = 1
+	_, err = rotated.Open(tampered)
+	assert.EqualError(t, err, "error decrypting data with key version 1: cipher: message authentication failed")
+}
+
+func TestEncryptedPersistence(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "koda.db")
+	record := koda.Record{AccountKey: "testing", ServiceKeys: map[string]koda.ServiceKey{"user-service": "secret-service-key"}}
+
+	// Start with an unencrypted data file
+	lfs := New()
+	assert.NoError(t, lfs.InitializePersistence(dbPath))
+	assert.NoError(t, lfs.Set(context.Background(), record.AccountKey, record))
+	assert.NoError(t, lfs.flush())
+	lfs.crash()
+
+	// Migrate to encryption
+	k1, err := ParseKeyring("1:" + testKey(1))
+	assert.NoError(t, err)
+	lfs = New()
+	assert.NoError(t, lfs.SetKeyring(k1))
+	assert.NoError(t, lfs.InitializePersistence(dbPath))
+	assert.NoError(t, lfs.flush())
+	assertEncrypted(t, dbPath, 1)
+
+	// Loading without a keyring fails
+	lfs.crash()
+	assert.ErrorIs(t, New().InitializePersistence(dbPath), ErrNoKeyring)
+
+	// Rotate the master key on a running store
+	k2, err := ParseKeyring("1:" + testKey(1) + ",2:" + testKey(2))
+	assert.NoError(t, err)
+	assert.NoError(t, lfs.SetKeyring(k2))
+	assertEncrypted(t, dbPath, 2)
+
+	reloaded := New()
+	assert.NoError(t, reloaded.SetKeyring(k2))
+	assert.NoError(t, reloaded.InitializePersistence(dbPath))
+	r, err := reloaded.Get(context.Background(), record.AccountKey)
+	assert.NoError(t, err)
+	assert.Equal(t, record, r)
+}
+
+func assertEncrypted(t *testing.T, dbPath string, version uint32) {
+	data, err := os.ReadFile(dbPath)
+	assert.NoError(t, err)
+	data, err = decodeSnapshot(data)
+	assert.NoError(t, err)
+	assert.True(t, IsEncrypted(data), "data file is not encrypted")
+	assert.False(t, bytes.Contains(data, []byte("secret-service-key")), "data file contains plaintext")
+	assert.Equal(t, fmt.Sprint(version), fmt.Sprint(data[len(encryptedMagic)+4]))
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+
+package localfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockSuffix is appended to the path of the data file to get the path of its lock file.
+const lockSuffix = ".lock"
+
+// ErrLocked is returned when the data file is in use by another process.
+var ErrLocked = errors.New("data file is in use by another process")
+
+// lockDataFile locks the data file at dbpath against other processes and returns the lock file, which releases the
+// lock when closed. A separate lock file is locked, as flushes replace the data file. A shared lock is taken if
+// exclusive is false, so the data file can be read by several processes but not while another one writes to it.
+// lockDataFile does not wait for the lock, it returns ErrLocked if it is held by another process.
+func lockDataFile(dbpath string, exclusive bool) (*os.File, error) {
+	f, err := os.OpenFile(dbpath+lockSuffix, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file: %v", err)
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, dbpath)
+		}
+		return nil, fmt.Errorf("error locking data file %s: %v", dbpath, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,114 @@
+package localfile
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/mindtastic/koda/log"
+)
+
+// Option configures a LocalFileStore created with New.
+type Option func(*LocalFileStore)
+
+// WithFlushInterval sets the interval in which the store is flushed to the data file. Periodic flushes are disabled
+// if d is not positive, the store is then only flushed by WithFlushAfterWrites, on Delete and on Shutdown.
+func WithFlushInterval(d time.Duration) Option {
+	return func(l *LocalFileStore) {
+		l.flushInterval = d
+	}
+}
+
+// WithFlushAfterWrites flushes the store as soon as n writes happened since the last flush, in addition to periodic
+// flushes. This bounds the size of the write-ahead log.
+func WithFlushAfterWrites(n int) Option {
+	return func(l *LocalFileStore) {
+		l.flushAfter = n
+	}
+}
+
+// WithReadOnly opens the store read-only. Writes return ErrReadOnly, and neither the data file nor the write-ahead log
+// are ever written, not even by Shutdown. Several read-only stores can use the same data file at once, but not while
+// a writable store uses it.
+func WithReadOnly() Option {
+	return func(l *LocalFileStore) {
+		l.readOnly = true
+	}
+}
+
+// WithFlushOnlyWhenDirty skips periodic flushes if nothing has been written since the last flush.
+func WithFlushOnlyWhenDirty() Option {
+	return func(l *LocalFileStore) {
+		l.onlyDirty = true
+	}
+}
+
+// FlushStats describes the flushes of a LocalFileStore to its data file.
+type FlushStats struct {
+	Flushes      int64         // Number of successful flushes
+	Errors       int64         // Number of failed flushes
+	Dirty        int64         // Number of writes since the last successful flush
+	LastFlush    time.Time     // Start of the last flush
+	LastDuration time.Duration // Duration of the last flush
+	LastBytes    int           // Size of the data file written by the last successful flush
+	LastError    error         // Error of the last flush, nil if it succeeded
+}
+
+// FlushStats returns statistics about the flushes of the store. It is safe to call while the store is in use.
+func (l *LocalFileStore) FlushStats() FlushStats {
+	l.statsMu.Lock()
+	defer l.statsMu.Unlock()
+	s := l.stats
+	s.Dirty = atomic.LoadInt64(&l.dirty)
+	return s
+}
+
+// recordFlush records a flush that started at start and wrote size bytes in the FlushStats.
+func (l *LocalFileStore) recordFlush(start time.Time, size int, err error) {
+	l.statsMu.Lock()
+	defer l.statsMu.Unlock()
+	l.stats.LastFlush = start
+	l.stats.LastDuration = time.Since(start)
+	l.stats.LastError = err
+	if err != nil {
+		l.stats.Errors++
+		return
+	}
+	l.stats.Flushes++
+	l.stats.LastBytes = size
+}
+
+// markDirty counts a write and signals the flusher if the write triggers a flush. The lock on the store must be held.
+func (l *LocalFileStore) markDirty() {
+	if n := atomic.AddInt64(&l.dirty, 1); l.flushAfter > 0 && n >= int64(l.flushAfter) {
+		select {
+		case l.flushNow <- struct{}{}:
+		default: // A flush is already pending
+		}
+	}
+}
+
+// runFlusher flushes the store at the configured interval and after the configured number of writes until Shutdown
+// is called.
+func (l *LocalFileStore) runFlusher() {
+	defer close(l.flusherDone)
+	var tick <-chan time.Time
+	if l.flushInterval > 0 {
+		t := time.NewTicker(l.flushInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-tick:
+			if l.onlyDirty && atomic.LoadInt64(&l.dirty) == 0 {
+				continue
+			}
+		case <-l.flushNow:
+		}
+		if err := l.flush(); err != nil {
+			log.Errorf("error flushing store to disk: %v", err)
+		}
+	}
+}
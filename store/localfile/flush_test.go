@@ -0,0 +1,83 @@
+package localfile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mindtastic/koda"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushAfterWrites(t *testing.T) {
+	lfs := New(WithFlushInterval(0), WithFlushAfterWrites(3))
+	assert.NoError(t, lfs.InitializePersistence(filepath.Join(t.TempDir(), "koda.db")))
+	defer lfs.Shutdown()
+
+	for i := 0; i < 2; i++ {
+		key := koda.AccountKey(fmt.Sprintf("key-%d", i))
+		assert.NoError(t, lfs.Set(context.Background(), key, koda.Record{AccountKey: key}))
+	}
+	assert.Equal(t, FlushStats{Dirty: 2}, lfs.FlushStats())
+
+	_, err := lfs.GetOrCreateServiceKey(context.Background(), "key-2", "user-service", "service-key")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return lfs.FlushStats().Flushes == 1 }, time.Second, time.Millisecond)
+
+	stats := lfs.FlushStats()
+	assert.Zero(t, stats.Dirty)
+	assert.Zero(t, stats.Errors)
+	assert.NoError(t, stats.LastError)
+	assert.False(t, stats.LastFlush.IsZero())
+	assert.Positive(t, stats.LastBytes)
+}
+
+func TestFlushOnlyWhenDirty(t *testing.T) {
+	lfs := New(WithFlushInterval(time.Millisecond), WithFlushOnlyWhenDirty())
+	assert.NoError(t, lfs.InitializePersistence(filepath.Join(t.TempDir(), "koda.db")))
+	defer lfs.Shutdown()
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Zero(t, lfs.FlushStats().Flushes)
+
+	assert.NoError(t, lfs.Set(context.Background(), "testing", koda.Record{AccountKey: "testing"}))
+	assert.Eventually(t, func() bool { return lfs.FlushStats().Flushes == 1 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int64(1), lfs.FlushStats().Flushes)
+}
+
+func TestFlushStats_Error(t *testing.T) {
+	dir := t.TempDir()
+	lfs := New(WithFlushInterval(0))
+	assert.NoError(t, lfs.InitializePersistence(filepath.Join(dir, "koda.db")))
+	assert.NoError(t, lfs.Set(context.Background(), "testing", koda.Record{AccountKey: "testing"}))
+
+	assert.NoError(t, os.RemoveAll(dir))
+	assert.Error(t, lfs.flush())
+	stats := lfs.FlushStats()
+	assert.Equal(t, int64(1), stats.Errors)
+	assert.Zero(t, stats.Flushes)
+	assert.Error(t, stats.LastError)
+	assert.Equal(t, int64(1), stats.Dirty)
+}
+
+func TestShutdown_StopsFlusher(t *testing.T) {
+	lfs := New(WithFlushInterval(time.Millisecond))
+	assert.NoError(t, lfs.InitializePersistence(filepath.Join(t.TempDir(), "koda.db")))
+	assert.Eventually(t, func() bool { return lfs.FlushStats().Flushes > 0 }, time.Second, time.Millisecond)
+
+	assert.NoError(t, lfs.Shutdown())
+	select {
+	case <-lfs.flusherDone:
+	default:
+		t.Fatal("flusher still running after Shutdown")
+	}
+	flushes := lfs.FlushStats().Flushes
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, flushes, lfs.FlushStats().Flushes)
+
+	assert.NoError(t, New().Shutdown())
+}
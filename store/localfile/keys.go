@@ -0,0 +1,63 @@
+package localfile
+
+import (
+	"sort"
+
+	"github.com/mindtastic/koda"
+)
+
+// sortedKeys is the sorted set of AccountKeys in the store. It allows to page through the store in a stable order
+// while holding the lock on the store only for a single page.
+type sortedKeys []koda.AccountKey
+
+func newSortedKeys(store map[koda.AccountKey]koda.Record) sortedKeys {
+	keys := make(sortedKeys, 0, len(store))
+	for k := range store {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// search returns the index of the first key not less than key.
+func (s sortedKeys) search(key koda.AccountKey) int {
+	return sort.Search(len(s), func(i int) bool { return s[i] >= key })
+}
+
+// insert adds key to the set, if it is not already part of it.
+func (s *sortedKeys) insert(key koda.AccountKey) {
+	i := s.search(key)
+	if i < len(*s) && (*s)[i] == key {
+		return
+	}
+	*s = append(*s, "")
+	copy((*s)[i+1:], (*s)[i:])
+	(*s)[i] = key
+}
+
+// remove removes key from the set, if it is part of it.
+func (s *sortedKeys) remove(key koda.AccountKey) {
+	i := s.search(key)
+	if i == len(*s) || (*s)[i] != key {
+		return
+	}
+	*s = append((*s)[:i], (*s)[i+1:]...)
+}
+
+// after returns up to limit keys greater than key.
+func (s sortedKeys) after(key koda.AccountKey, limit int) []koda.AccountKey {
+	i := s.search(key)
+	if i < len(s) && s[i] == key {
+		i++
+	}
+	if limit <= 0 || i == len(s) {
+		return nil
+	}
+	end := i + limit
+	if end > len(s) {
+		end = len(s)
+	}
+	keys := make([]koda.AccountKey, end-i)
+	copy(keys, s[i:end])
+	return keys
+}
@@ -0,0 +1,35 @@
+package localfile
+
+import (
+	"testing"
+
+	"github.com/mindtastic/koda"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortedKeys(t *testing.T) {
+	keys := newSortedKeys(map[koda.AccountKey]koda.Record{"c": {}, "a": {}})
+	keys.insert("b")
+	keys.insert("a")
+	keys.insert("d")
+	assert.Equal(t, sortedKeys{"a", "b", "c", "d"}, keys)
+
+	keys.remove("c")
+	keys.remove("x")
+	assert.Equal(t, sortedKeys{"a", "b", "d"}, keys)
+
+	testCases := []struct {
+		after    koda.AccountKey
+		limit    int
+		expected []koda.AccountKey
+	}{
+		{after: "", limit: 2, expected: []koda.AccountKey{"a", "b"}},
+		{after: "a", limit: 5, expected: []koda.AccountKey{"b", "d"}},
+		{after: "c", limit: 5, expected: []koda.AccountKey{"d"}},
+		{after: "d", limit: 5, expected: nil},
+		{after: "", limit: 0, expected: nil},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, keys.after(tc.after, tc.limit), "after %q limit %d", tc.after, tc.limit)
+	}
+}
@@ -1,6 +1,7 @@
 package localfile
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,24 +21,51 @@ const defaultFlushInterval = 10 * time.Second
 
 var ErrStoreClosed = errors.New("store is closed")
 
-// LocalFileStore is an in memory koda.Store that persists records on disk at regular intervals.
-// It is safe for concurrent access, however it should not be used for production workloads as data is not stored encrypted.
+var ErrReadOnly = errors.New("store is read-only")
+
+// LocalFileStore is an in memory koda.Store that persists records on disk.
+// Every write is appended to a write-ahead log before it is acknowledged. At regular intervals, and after a number of
+// writes if configured with WithFlushAfterWrites, the whole store is written to a snapshot file and the write-ahead
+// log is compacted.
+// It is safe for concurrent access. Data is stored unencrypted on disk unless a Keyring is configured with SetKeyring.
 type LocalFileStore struct {
-	mu            sync.RWMutex
+	dirty         int64 // Accessed atomically, number of writes since the last flush. First to be 64-bit aligned
+	mu            *ctxRWMutex
+	flushMu       sync.Mutex // Serializes flushes, as they compact the write-ahead log
 	store         map[koda.AccountKey]koda.Record
-	flushInterval time.Duration
+	index         sortedKeys    // Sorted keys of store
+	flushInterval time.Duration // Periodic flushes are disabled if not positive
+	flushAfter    int           // Number of writes that trigger a flush, disabled if 0
+	onlyDirty     bool          // Skip periodic flushes if nothing has been written
+	flushNow      chan struct{} // Signals the flusher that flushAfter writes happened
+	stop          chan struct{} // Closed by Shutdown to stop the flusher
+	flusherDone   chan struct{} // Closed when the flusher stopped, only set if persistence is enabled
+	statsMu       sync.Mutex
+	stats         FlushStats
 	stopped       bool
+	readOnly      bool // Writes are refused and nothing is written to disk, see WithReadOnly
 	shutdown      sync.Once
-	dbPath        string // Only set if persistence is enabled
+	generations   int
+	dbPath        string   // Only set if persistence is enabled
+	wal           *wal     // Only set if persistence is enabled
+	keys          *Keyring // Only set if encryption is enabled
+	lock          *os.File // Lock file of the data file, only set if persistence is enabled
 }
 
-// New creates a new LocalFileStore.
+// New creates a new LocalFileStore configured by opts.
 // After creating a new LocalFileStore lfs, InitializePersistence should be called to load any existing data or create a new
 // store on disk. Not doing so will cause lfs to keep data only in memory and not persist it to disk.
-func New() *LocalFileStore {
+func New(opts ...Option) *LocalFileStore {
 	lfs := LocalFileStore{
+		mu:            newCtxRWMutex(),
 		store:         make(map[koda.AccountKey]koda.Record),
 		flushInterval: defaultFlushInterval,
+		flushNow:      make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		generations:   defaultSnapshotGenerations,
+	}
+	for _, opt := range opts {
+		opt(&lfs)
 	}
 	return &lfs
 }
@@ -45,93 +74,238 @@ func New() *LocalFileStore {
 // dbpath denotes the path to a data file which will be loaded.
 // If it does not exist, it will be created.
 // If dbpath is empty, LocalFileStore will not be initialized with persistence and all data is stored in memory only.
-func (l *LocalFileStore) InitializePersistence(dbpath string) error {
+// If the data file is corrupt, the newest valid previous generation of it is loaded instead. Writes between that
+// generation and the corrupt data file are lost.
+// Any writes in the write-ahead log next to the data file are replayed on top of the loaded data. A torn final entry
+// left behind by a crash is dropped, any other invalid entry fails InitializePersistence.
+// The data file is locked against other processes until Shutdown, see ErrLocked. A read-only store takes a shared lock
+// and requires the data file to exist.
+// An encrypted data file can only be loaded if a Keyring has been configured with SetKeyring before. An unencrypted
+// data file is encrypted on the next flush if a Keyring is configured.
+func (l *LocalFileStore) InitializePersistence(dbpath string) (err error) {
 	if dbpath == "" {
 		return nil
 	}
 	dbFile, err := os.Open(dbpath)
 	if err != nil {
-		if !os.IsNotExist(err) {
+		if !os.IsNotExist(err) || l.readOnly {
 			return fmt.Errorf("error opening file: %v", err)
 		}
 		// Ensure path
 		p := path.Dir(dbpath)
-		if err := os.MkdirAll(p, 0666); err != nil {
+		if err := os.MkdirAll(p, 0700); err != nil {
 			return fmt.Errorf("error creating path %s: %v", p, err)
 		}
-		f, err := os.Create(dbpath)
+		f, err := os.OpenFile(dbpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 		if err != nil {
 			return fmt.Errorf("error creating file %s: %v", dbpath, err)
 		}
 		dbFile = f
 	}
 	defer dbFile.Close()
-	d := json.NewDecoder(dbFile)
-	l.mu.Lock()
+	lock, err := lockDataFile(dbpath, !l.readOnly)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil && lock != nil {
+			lock.Close()
+		}
+	}()
+	data, err := io.ReadAll(dbFile)
+	if err != nil {
+		return fmt.Errorf("error reading database file %s: %v", dbpath, err)
+	}
+	l.mu.Lock(context.Background())
 	defer l.mu.Unlock()
-	l.dbPath = dbpath
-	if err := d.Decode(&l.store); err != nil && err != io.EOF {
-		return fmt.Errorf("error decoding existing database file %s: %v", dbpath, err)
+	store, err := l.decode(data)
+	if errors.Is(err, errCorruptSnapshot) {
+		for n := 1; n <= l.generations; n++ {
+			gen, gerr := os.ReadFile(generationPath(dbpath, n))
+			if gerr != nil {
+				continue
+			}
+			if s, gerr := l.decode(gen); gerr == nil {
+				store, err = s, nil
+				break
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error loading database file %s: %w", dbpath, err)
+	}
+	l.store = store
+	if l.readOnly {
+		if _, err := replayWAL(dbpath+walSuffix, l.store, l.keys); err != nil {
+			return fmt.Errorf("error replaying write-ahead log of %s: %w", dbpath, err)
+		}
+		l.index = newSortedKeys(l.store)
+		l.dbPath = dbpath
+		l.lock = lock
+		return nil
+	}
+	w, err := openWAL(dbpath + walSuffix)
+	if err != nil {
+		return err
 	}
-	go l.flushAtInterval(l.flushInterval)
+	if _, err := w.replay(l.store, l.keys); err != nil {
+		w.Close()
+		return fmt.Errorf("error replaying write-ahead log of %s: %w", dbpath, err)
+	}
+	l.index = newSortedKeys(l.store)
+	l.dbPath = dbpath
+	l.wal = w
+	l.lock = lock
+	l.flusherDone = make(chan struct{})
+	go l.runFlusher()
 	return nil
 }
 
-func (l *LocalFileStore) flushAtInterval(i time.Duration) {
-	for {
-		<-time.Tick(i)
-		l.flush()
+// KeepGenerations sets the number of previous data files that are kept as a fallback for a corrupt data file.
+// It must be called before InitializePersistence.
+func (l *LocalFileStore) KeepGenerations(n int) {
+	l.mu.Lock(context.Background())
+	defer l.mu.Unlock()
+	l.generations = n
+}
+
+// encode encodes store into a checksummed snapshot, encrypted if a Keyring is configured.
+func (l *LocalFileStore) encode(store map[koda.AccountKey]koda.Record) ([]byte, error) {
+	dd, err := json.Marshal(store)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding data in store: %v", err)
+	}
+	if l.keys != nil {
+		if dd, err = l.keys.Seal(dd); err != nil {
+			return nil, fmt.Errorf("error encrypting data in store: %v", err)
+		}
+	}
+	return encodeSnapshot(dd), nil
+}
+
+// decode decodes a snapshot. It returns an error wrapping errCorruptSnapshot if data fails verification.
+func (l *LocalFileStore) decode(data []byte) (map[koda.AccountKey]koda.Record, error) {
+	data, err := decodeSnapshot(data)
+	if err != nil {
+		return nil, err
+	}
+	if IsEncrypted(data) {
+		if l.keys == nil {
+			return nil, ErrNoKeyring
+		}
+		if data, err = l.keys.Open(data); err != nil {
+			return nil, fmt.Errorf("%w: %v", errCorruptSnapshot, err)
+		}
+	}
+	store := make(map[koda.AccountKey]koda.Record)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &store); err != nil {
+			return nil, fmt.Errorf("%w: %v", errCorruptSnapshot, err)
+		}
 	}
+	return store, nil
+}
+
+// SetKeyring enables encryption of the data file with the primary key of keys. It should be called before
+// InitializePersistence to be able to load an encrypted data file. Calling it on a running store replaces the
+// Keyring and immediately re-encrypts the data file with the new primary key.
+func (l *LocalFileStore) SetKeyring(keys *Keyring) error {
+	l.mu.Lock(context.Background())
+	l.keys = keys
+	l.mu.Unlock()
+	return l.flush()
 }
 
-// flush flushes the current state to disk. This is currently done in a syncronous way, meaning the store is blocking any
-// writes during the flushing period.
-func (l *LocalFileStore) flush() error {
-	l.mu.RLock()
+// flush atomically writes the current state to disk and compacts the write-ahead log. This is currently done in a
+// syncronous way, meaning the store is blocking any writes during the flushing period.
+// Every flush is recorded in the FlushStats.
+func (l *LocalFileStore) flush() (err error) {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+	l.mu.RLock(context.Background())
 	defer l.mu.RUnlock()
-	if l.dbPath == "" { // Persistence not enabled.
+	if l.dbPath == "" || l.readOnly { // Persistence not enabled.
 		return nil
 	}
-	dd, err := json.Marshal(l.store)
+	start, size := time.Now(), 0
+	defer func() { l.recordFlush(start, size, err) }()
+	dd, err := l.encode(l.store)
 	if err != nil {
-		return fmt.Errorf("error encoding data in store: %v", err)
+		return err
 	}
-	if err := os.WriteFile(l.dbPath, dd, 0666); err != nil {
+	if err := writeSnapshot(l.dbPath, dd, l.generations); err != nil {
 		return fmt.Errorf("error writing data file %s: %v", l.dbPath, err)
 	}
+	size = len(dd)
+	if err := l.wal.reset(); err != nil {
+		return fmt.Errorf("error compacting data file %s: %v", l.dbPath, err)
+	}
+	atomic.StoreInt64(&l.dirty, 0)
 	return nil
 }
 
-// Shutdown gracefully stops the LocalFileStore, ensuring that data is persisted to disk one last time.
+// Shutdown gracefully stops the LocalFileStore, ensuring that data is persisted to disk one last time, unless the store
+// is read-only. It releases the lock on the data file.
 // Shutdown works similarly to http.Server.Shutdown() in that it stops any new incoming writes, and then waits indefinitely
 // for the data to disk. Shutdown returns any error that occurs during writing data to disk.
 // After Shutdown is called, Set and Get immediately return ErrStoreClosed.
+// Shutdown stops the background flusher and waits for a running flush to finish before flushing the last time.
 // A Closed Store cannot be reused.
 func (l *LocalFileStore) Shutdown() error {
 	var err error
 	l.shutdown.Do(func() {
-		l.mu.Lock()
+		l.mu.Lock(context.Background())
 		l.stopped = true
+		done := l.flusherDone
 		l.mu.Unlock() // Unlocking immediately to unblock any incoming Set and Get calls.
+		close(l.stop)
+		if done != nil {
+			<-done
+		}
 		err = l.flush()
+		if l.wal != nil {
+			if cerr := l.wal.Close(); cerr != nil && err == nil {
+				err = fmt.Errorf("error closing write-ahead log: %v", cerr)
+			}
+		}
+		if l.lock != nil {
+			l.lock.Close()
+		}
 	})
 	return err
 }
 
-// Set stores a new record in memory. It will not automatically be flushed to disk.
-func (l *LocalFileStore) Set(key koda.AccountKey, record koda.Record) error {
-	l.mu.Lock()
+// Set stores a copy of record. If persistence is enabled, the write is synced to the write-ahead log before Set
+// returns. If ctx is done before Set acquires the lock on the store, it returns ctx.Err().
+func (l *LocalFileStore) Set(ctx context.Context, key koda.AccountKey, record koda.Record) error {
+	if err := l.mu.Lock(ctx); err != nil {
+		return fmt.Errorf("could not set key %s: %w", key, err)
+	}
 	defer l.mu.Unlock()
 	if l.stopped {
 		return ErrStoreClosed
 	}
+	if l.readOnly {
+		return fmt.Errorf("could not set key %s: %w", key, ErrReadOnly)
+	}
+	record = record.Clone()
+	if l.wal != nil {
+		if err := l.wal.append(walEntry{Op: walOpSet, Key: key, Record: &record}, l.keys); err != nil {
+			return fmt.Errorf("could not set key %s: %v", key, err)
+		}
+	}
 	l.store[key] = record
+	l.index.insert(key)
+	l.markDirty()
 	return nil
 }
 
-// Get retrieves an existing record. It returns koda.ErrNotFound if the record does not exist.
-func (l *LocalFileStore) Get(key koda.AccountKey) (koda.Record, error) {
-	l.mu.RLock()
+// Get retrieves a copy of an existing record. It returns koda.ErrNotFound if the record does not exist.
+// If ctx is done before Get acquires the lock on the store, it returns ctx.Err().
+func (l *LocalFileStore) Get(ctx context.Context, key koda.AccountKey) (koda.Record, error) {
+	if err := l.mu.RLock(ctx); err != nil {
+		return koda.Record{}, fmt.Errorf("could not get key %s: %w", key, err)
+	}
 	defer l.mu.RUnlock()
 	if l.stopped {
 		return koda.Record{}, ErrStoreClosed
@@ -140,5 +314,208 @@ func (l *LocalFileStore) Get(key koda.AccountKey) (koda.Record, error) {
 	if !ok {
 		return koda.Record{}, fmt.Errorf("could not get key %s: %w", key, koda.ErrNotFound)
 	}
+	return r.Clone(), nil
+}
+
+// List returns up to limit AccountKeys greater than after in ascending order.
+// The lock on the store is only held while the requested page is collected.
+func (l *LocalFileStore) List(ctx context.Context, after koda.AccountKey, limit int) ([]koda.AccountKey, error) {
+	if err := l.mu.RLock(ctx); err != nil {
+		return nil, fmt.Errorf("could not list keys: %w", err)
+	}
+	defer l.mu.RUnlock()
+	if l.stopped {
+		return nil, ErrStoreClosed
+	}
+	return l.index.after(after, limit), nil
+}
+
+// Scan returns up to limit records with an AccountKey greater than after in ascending order.
+// The lock on the store is only held while the requested page is collected.
+func (l *LocalFileStore) Scan(ctx context.Context, after koda.AccountKey, limit int) ([]koda.Record, error) {
+	if err := l.mu.RLock(ctx); err != nil {
+		return nil, fmt.Errorf("could not scan records: %w", err)
+	}
+	defer l.mu.RUnlock()
+	if l.stopped {
+		return nil, ErrStoreClosed
+	}
+	keys := l.index.after(after, limit)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	records := make([]koda.Record, len(keys))
+	for i, k := range keys {
+		records[i] = l.store[k].Clone()
+		records[i].AccountKey = k
+	}
+	return records, nil
+}
+
+// GetOrCreateServiceKey returns the record of key with a ServiceKey for service. If the record does not exist, it is
+// created. If the record has no ServiceKey for service, newKey is stored. Inactive records are returned unchanged.
+// The lock on the store is held during the whole operation, so concurrent calls never issue different ServiceKeys.
+func (l *LocalFileStore) GetOrCreateServiceKey(ctx context.Context, key koda.AccountKey, service string, newKey koda.ServiceKey) (koda.Record, error) {
+	r, err := l.getOrCreate(ctx, key, func(r koda.Record) (koda.Record, bool) {
+		return koda.EnsureServiceKey(r, service, newKey)
+	})
+	if err != nil {
+		return koda.Record{}, fmt.Errorf("could not create service key for %s: %w", key, err)
+	}
+	return r, nil
+}
+
+// GetOrCreateSalt returns the record of key with a Salt and an epoch for service. If the record does not exist, it is
+// created. Missing Salt and epoch are set as described by koda.EnsureSalt.
+func (l *LocalFileStore) GetOrCreateSalt(ctx context.Context, key koda.AccountKey, service string, salt []byte) (koda.Record, error) {
+	r, err := l.getOrCreate(ctx, key, func(r koda.Record) (koda.Record, bool) {
+		return koda.EnsureSalt(r, service, salt)
+	})
+	if err != nil {
+		return koda.Record{}, fmt.Errorf("could not create salt for %s: %w", key, err)
+	}
 	return r, nil
 }
+
+// getOrCreate applies ensure to the record of key, or a new record if it does not exist, and stores the result if
+// ensure reports a change. The lock on the store is held during the whole operation.
+func (l *LocalFileStore) getOrCreate(ctx context.Context, key koda.AccountKey, ensure func(koda.Record) (koda.Record, bool)) (koda.Record, error) {
+	if err := l.mu.Lock(ctx); err != nil {
+		return koda.Record{}, err
+	}
+	defer l.mu.Unlock()
+	if l.stopped {
+		return koda.Record{}, ErrStoreClosed
+	}
+	if l.readOnly {
+		return koda.Record{}, fmt.Errorf("could not create key %s: %w", key, ErrReadOnly)
+	}
+	r, ok := l.store[key]
+	if !ok {
+		r = koda.Record{AccountKey: key}
+	}
+	r, changed := ensure(r.Clone())
+	if !changed {
+		return r, nil
+	}
+	if l.wal != nil {
+		if err := l.wal.append(walEntry{Op: walOpSet, Key: key, Record: &r}, l.keys); err != nil {
+			return koda.Record{}, err
+		}
+	}
+	l.store[key] = r
+	l.index.insert(key)
+	l.markDirty()
+	return r.Clone(), nil
+}
+
+// Update replaces the record of key with the result of fn. It returns koda.ErrNotFound if the record does not exist.
+// The lock on the store is held during the whole operation, so fn is called exactly once.
+func (l *LocalFileStore) Update(ctx context.Context, key koda.AccountKey, fn func(koda.Record) (koda.Record, error)) (koda.Record, error) {
+	if err := l.mu.Lock(ctx); err != nil {
+		return koda.Record{}, fmt.Errorf("could not update key %s: %w", key, err)
+	}
+	defer l.mu.Unlock()
+	if l.stopped {
+		return koda.Record{}, ErrStoreClosed
+	}
+	if l.readOnly {
+		return koda.Record{}, fmt.Errorf("could not update key %s: %w", key, ErrReadOnly)
+	}
+	r, ok := l.store[key]
+	if !ok {
+		return koda.Record{}, fmt.Errorf("could not update key %s: %w", key, koda.ErrNotFound)
+	}
+	r, err := fn(r.Clone())
+	if err != nil {
+		return koda.Record{}, fmt.Errorf("could not update key %s: %w", key, err)
+	}
+	r = r.Clone()
+	if l.wal != nil {
+		if err := l.wal.append(walEntry{Op: walOpSet, Key: key, Record: &r}, l.keys); err != nil {
+			return koda.Record{}, fmt.Errorf("could not update key %s: %v", key, err)
+		}
+	}
+	l.store[key] = r
+	l.markDirty()
+	return r.Clone(), nil
+}
+
+// Delete removes a record from memory and immediately flushes the store to disk, so that the record is erased from the
+// data file and the write-ahead log as well. Previous generations of the data file are rewritten without the record.
+// It returns koda.ErrNotFound if the record does not exist.
+func (l *LocalFileStore) Delete(ctx context.Context, key koda.AccountKey) error {
+	if err := l.mu.Lock(ctx); err != nil {
+		return fmt.Errorf("could not delete key %s: %w", key, err)
+	}
+	if l.stopped {
+		l.mu.Unlock()
+		return ErrStoreClosed
+	}
+	if l.readOnly {
+		l.mu.Unlock()
+		return fmt.Errorf("could not delete key %s: %w", key, ErrReadOnly)
+	}
+	if _, ok := l.store[key]; !ok {
+		l.mu.Unlock()
+		return fmt.Errorf("could not delete key %s: %w", key, koda.ErrNotFound)
+	}
+	if l.wal != nil {
+		if err := l.wal.append(walEntry{Op: walOpDelete, Key: key}, l.keys); err != nil {
+			l.mu.Unlock()
+			return fmt.Errorf("could not delete key %s: %v", key, err)
+		}
+	}
+	delete(l.store, key)
+	l.index.remove(key)
+	l.mu.Unlock()
+
+	if err := l.flush(); err != nil {
+		return fmt.Errorf("error erasing key %s from disk: %w", key, err)
+	}
+	if err := l.eraseFromGenerations(key); err != nil {
+		return fmt.Errorf("error erasing key %s from previous data files: %w", key, err)
+	}
+	return nil
+}
+
+// eraseFromGenerations rewrites all previous generations of the data file without key. Generations that cannot be
+// decoded are removed, as they might still contain key.
+func (l *LocalFileStore) eraseFromGenerations(key koda.AccountKey) error {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+	l.mu.RLock(context.Background())
+	defer l.mu.RUnlock()
+	if l.dbPath == "" {
+		return nil
+	}
+	for n := 1; n <= l.generations; n++ {
+		p := generationPath(l.dbPath, n)
+		data, err := os.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		store, err := l.decode(data)
+		if err != nil {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := store[key]; !ok {
+			continue
+		}
+		delete(store, key)
+		dd, err := l.encode(store)
+		if err != nil {
+			return err
+		}
+		if err := writeSnapshot(p, dd, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,11 +1,16 @@
 package localfile
 
 import (
+	"context"
 	"fmt"
 	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/store/storetest"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLocalFileStore_InitializePersistence(t *testing.T) {
@@ -59,16 +64,17 @@ func TestFlush(t *testing.T) {
 		noPermission bool
 		err          string
 	}{
-		{name: "no data", record: koda.Record{AccountKey: ""}, expectedSize: 58, err: ""},
-		{name: "success", record: koda.Record{AccountKey: "testing"}, expectedSize: 72, err: ""},
-		{name: "no persistence", record: koda.Record{AccountKey: "testing"}, expectedSize: 72, err: ""},
-		{name: "no permission", record: koda.Record{AccountKey: "testing"}, noPermission: true, err: "error writing data file %s: open %s: permission denied"},
+		{name: "no data", record: koda.Record{AccountKey: ""}, expectedSize: 58 + snapshotHeaderSize, err: ""},
+		{name: "success", record: koda.Record{AccountKey: "testing"}, expectedSize: 72 + snapshotHeaderSize, err: ""},
+		{name: "no persistence", record: koda.Record{AccountKey: "testing"}, expectedSize: 72 + snapshotHeaderSize, err: ""},
+		{name: "no permission", record: koda.Record{AccountKey: "testing"}, noPermission: true, err: "error writing data file %s: open %s.tmp: permission denied"},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			var dbPath string
-			f, err := os.CreateTemp("", "koda-testing-*")
+			dir := t.TempDir()
+			f, err := os.CreateTemp(dir, "koda-testing-*")
 			if err != nil {
 				t.Fatalf("error creating temporary file: %v", err)
 			}
@@ -78,11 +84,13 @@ func TestFlush(t *testing.T) {
 			lfs := New()
 			err = lfs.InitializePersistence(dbPath)
 			assert.NoError(t, err)
-			err = lfs.Set(tc.record.AccountKey, tc.record)
+			err = lfs.Set(context.Background(), tc.record.AccountKey, tc.record)
 			assert.NoError(t, err)
 
 			if tc.noPermission {
-				os.Chmod(f.Name(), 0)
+				// Snapshots are written to a temporary file in the same directory first
+				os.Chmod(dir, 0500)
+				defer os.Chmod(dir, 0700)
 			}
 
 			err = lfs.flush()
@@ -103,3 +111,307 @@ func TestFlush(t *testing.T) {
 		})
 	}
 }
+
+func TestDelete(t *testing.T) {
+	f, err := os.CreateTemp("", "koda-testing-*")
+	if err != nil {
+		t.Fatalf("error creating temporary file: %v", err)
+	}
+	dbPath := f.Name()
+	f.Close()
+
+	lfs := New()
+	assert.NoError(t, lfs.InitializePersistence(dbPath))
+	assert.NoError(t, lfs.Set(context.Background(), "keep", koda.Record{AccountKey: "keep"}))
+	assert.NoError(t, lfs.Set(context.Background(), "delete", koda.Record{AccountKey: "delete"}))
+	assert.NoError(t, lfs.flush())
+
+	assert.NoError(t, lfs.Delete(context.Background(), "delete"))
+	_, err = lfs.Get(context.Background(), "delete")
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+	assert.ErrorIs(t, lfs.Delete(context.Background(), "delete"), koda.ErrNotFound)
+
+	// The record must be erased from disk without waiting for the next flush
+	lfs.crash()
+	reloaded := New()
+	assert.NoError(t, reloaded.InitializePersistence(dbPath))
+	_, err = reloaded.Get(context.Background(), "delete")
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+	_, err = reloaded.Get(context.Background(), "keep")
+	assert.NoError(t, err)
+}
+
+func TestContextCancellation(t *testing.T) {
+	lfs := New()
+	assert.NoError(t, lfs.Set(context.Background(), "testing", koda.Record{AccountKey: "testing"}))
+
+	// Block the store, e.g. by a long running flush
+	assert.NoError(t, lfs.mu.Lock(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := lfs.Get(ctx, "testing")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorIs(t, lfs.Set(ctx, "testing", koda.Record{}), context.DeadlineExceeded)
+	assert.ErrorIs(t, lfs.Delete(ctx, "testing"), context.DeadlineExceeded)
+
+	lfs.mu.Unlock()
+	r, err := lfs.Get(context.Background(), "testing")
+	assert.NoError(t, err)
+	assert.Equal(t, koda.AccountKey("testing"), r.AccountKey)
+}
+
+func TestGetOrCreateServiceKey(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "koda.db")
+	lfs := New()
+	assert.NoError(t, lfs.InitializePersistence(dbPath))
+	const workers = 64
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		keys = make(map[koda.ServiceKey]bool)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err := lfs.GetOrCreateServiceKey(context.Background(), "testing", "user-service", koda.ServiceKey(fmt.Sprint(i)))
+			assert.NoError(t, err)
+			mu.Lock()
+			keys[r.ServiceKeys["user-service"]] = true
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, keys, 1, "more than one ServiceKey issued: %v", keys)
+
+	// The issued key is persisted in the write-ahead log
+	lfs.crash()
+	reloaded := New()
+	assert.NoError(t, reloaded.InitializePersistence(dbPath))
+	r, err := reloaded.Get(context.Background(), "testing")
+	assert.NoError(t, err)
+	assert.Equal(t, koda.AccountKey("testing"), r.AccountKey)
+	assert.True(t, keys[r.ServiceKeys["user-service"]])
+
+	// Inactive records do not get new ServiceKeys
+	r.Deactivate("test", time.Now())
+	assert.NoError(t, lfs.Set(context.Background(), "testing", r))
+	r, err = lfs.GetOrCreateServiceKey(context.Background(), "testing", "diary-service", "new")
+	assert.NoError(t, err)
+	assert.NotContains(t, r.ServiceKeys, "diary-service")
+}
+
+func TestGetOrCreateSalt(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "koda.db")
+	lfs := New()
+	assert.NoError(t, lfs.InitializePersistence(dbPath))
+	const workers = 64
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		salts = make(map[string]bool)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err := lfs.GetOrCreateSalt(context.Background(), "testing", "user-service", []byte(fmt.Sprint(i)))
+			assert.NoError(t, err)
+			mu.Lock()
+			salts[string(r.Salt)] = true
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, salts, 1, "more than one salt issued: %v", salts)
+
+	// The salt is persisted in the write-ahead log
+	lfs.crash()
+	reloaded := New()
+	assert.NoError(t, reloaded.InitializePersistence(dbPath))
+	r, err := reloaded.Get(context.Background(), "testing")
+	assert.NoError(t, err)
+	assert.True(t, salts[string(r.Salt)])
+	assert.Equal(t, map[string]uint32{"user-service": 0}, r.Epochs)
+
+	// Inactive records are returned unchanged
+	r.Deactivate("test", time.Now())
+	assert.NoError(t, lfs.Set(context.Background(), "testing", r))
+	r, err = lfs.GetOrCreateSalt(context.Background(), "testing", "diary-service", []byte("new"))
+	assert.NoError(t, err)
+	assert.NotContains(t, r.Epochs, "diary-service")
+}
+
+func TestList(t *testing.T) {
+	lfs := New()
+	for _, k := range []koda.AccountKey{"c", "a", "b", "d"} {
+		assert.NoError(t, lfs.Set(context.Background(), k, koda.Record{AccountKey: k}))
+	}
+
+	testCases := []struct {
+		after    koda.AccountKey
+		limit    int
+		expected []koda.AccountKey
+	}{
+		{after: "", limit: 2, expected: []koda.AccountKey{"a", "b"}},
+		{after: "b", limit: 2, expected: []koda.AccountKey{"c", "d"}},
+		{after: "bb", limit: 10, expected: []koda.AccountKey{"c", "d"}},
+		{after: "d", limit: 2, expected: nil},
+	}
+	for _, tc := range testCases {
+		keys, err := lfs.List(context.Background(), tc.after, tc.limit)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, keys, "after %q", tc.after)
+	}
+}
+
+func TestScan(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "koda.db")
+	lfs := New()
+	assert.NoError(t, lfs.InitializePersistence(dbPath))
+	for i := 0; i < 10; i++ {
+		k := koda.AccountKey(fmt.Sprintf("key-%02d", i))
+		assert.NoError(t, lfs.Set(context.Background(), k, koda.Record{AccountKey: k}))
+	}
+	assert.NoError(t, lfs.Delete(context.Background(), "key-03"))
+
+	// The index is rebuilt from the data file and the write-ahead log
+	assert.NoError(t, lfs.Set(context.Background(), "key-10", koda.Record{}))
+	lfs.crash()
+	lfs = New()
+	assert.NoError(t, lfs.InitializePersistence(dbPath))
+
+	records, err := lfs.Scan(context.Background(), "key-08", 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.Record{{AccountKey: "key-09"}, {AccountKey: "key-10"}}, records)
+
+	// Writes during a walk do not block on it
+	var visited []koda.AccountKey
+	err = koda.Walk(context.Background(), lfs, 3, func(r koda.Record) error {
+		visited = append(visited, r.AccountKey)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return lfs.Set(ctx, "key-00", r)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.AccountKey{"key-00", "key-01", "key-02", "key-04", "key-05", "key-06", "key-07", "key-08", "key-09", "key-10"}, visited)
+}
+
+func TestLock(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "koda.db")
+	lfs := New()
+	assert.NoError(t, lfs.InitializePersistence(dbPath))
+
+	// A second process fails fast instead of overwriting the data file
+	assert.ErrorIs(t, New().InitializePersistence(dbPath), ErrLocked)
+	assert.ErrorIs(t, New(WithReadOnly()).InitializePersistence(dbPath), ErrLocked)
+	assert.NoError(t, lfs.Shutdown())
+
+	// Read-only stores share the data file, but exclude writers
+	ro1, ro2 := New(WithReadOnly()), New(WithReadOnly())
+	assert.NoError(t, ro1.InitializePersistence(dbPath))
+	assert.NoError(t, ro2.InitializePersistence(dbPath))
+	assert.ErrorIs(t, New().InitializePersistence(dbPath), ErrLocked)
+	assert.NoError(t, ro1.Shutdown())
+	assert.NoError(t, ro2.Shutdown())
+
+	lfs = New()
+	assert.NoError(t, lfs.InitializePersistence(dbPath))
+	assert.NoError(t, lfs.Shutdown())
+}
+
+func TestReadOnly(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "koda.db")
+	assert.Error(t, New(WithReadOnly()).InitializePersistence(dbPath))
+	_, err := os.Stat(dbPath)
+	assert.True(t, os.IsNotExist(err))
+
+	lfs := New()
+	assert.NoError(t, lfs.InitializePersistence(dbPath))
+	assert.NoError(t, lfs.Set(context.Background(), "flushed", koda.Record{AccountKey: "flushed"}))
+	assert.NoError(t, lfs.flush())
+	assert.NoError(t, lfs.Set(context.Background(), "unflushed", koda.Record{AccountKey: "unflushed"}))
+	lfs.crash()
+
+	files := func() map[string][]byte {
+		entries, err := os.ReadDir(filepath.Dir(dbPath))
+		assert.NoError(t, err)
+		files := make(map[string][]byte)
+		for _, e := range entries {
+			data, err := os.ReadFile(filepath.Join(filepath.Dir(dbPath), e.Name()))
+			assert.NoError(t, err)
+			files[e.Name()] = data
+		}
+		return files
+	}
+	before := files()
+
+	ro := New(WithReadOnly())
+	assert.NoError(t, ro.InitializePersistence(dbPath))
+	records, err := ro.Scan(context.Background(), "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.Record{{AccountKey: "flushed"}, {AccountKey: "unflushed"}}, records)
+
+	assert.ErrorIs(t, ro.Set(context.Background(), "new", koda.Record{}), ErrReadOnly)
+	_, err = ro.GetOrCreateServiceKey(context.Background(), "new", "user-service", "key")
+	assert.ErrorIs(t, err, ErrReadOnly)
+	_, err = ro.Update(context.Background(), "flushed", func(r koda.Record) (koda.Record, error) { return r, nil })
+	assert.ErrorIs(t, err, ErrReadOnly)
+	assert.ErrorIs(t, ro.Delete(context.Background(), "flushed"), ErrReadOnly)
+
+	// Neither the data file, its generations nor the write-ahead log are touched
+	assert.NoError(t, ro.Shutdown())
+	assert.Equal(t, before, files())
+}
+
+// crash releases the lock on the data file of l without shutting it down, as the operating system does for a crashed
+// process, so the data file can be loaded again.
+func (l *LocalFileStore) crash() {
+	l.lock.Close()
+}
+
+func TestCopies(t *testing.T) {
+	lfs := New()
+	record := koda.Record{AccountKey: "a", ServiceKeys: map[string]koda.ServiceKey{"diary": "key"}}
+	assert.NoError(t, lfs.Set(context.Background(), "a", record))
+
+	// Neither the record passed to Set nor the records returned share their maps with the store
+	record.ServiceKeys["diary"] = "changed"
+	got, err := lfs.Get(context.Background(), "a")
+	assert.NoError(t, err)
+	assert.Equal(t, koda.ServiceKey("key"), got.ServiceKeys["diary"])
+	got.ServiceKeys["diary"] = "changed"
+	records, err := lfs.Scan(context.Background(), "", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, koda.ServiceKey("key"), records[0].ServiceKeys["diary"])
+	records[0].ServiceKeys["diary"] = "changed"
+	got, err = lfs.GetOrCreateServiceKey(context.Background(), "a", "diary", "new")
+	assert.NoError(t, err)
+	assert.Equal(t, koda.ServiceKey("key"), got.ServiceKeys["diary"])
+}
+
+func TestConformance(t *testing.T) {
+	dir := t.TempDir()
+	storetest.RunConformance(t, storetest.Factory{
+		Open: func(t *testing.T, name string) koda.Store {
+			lfs := New()
+			if err := lfs.InitializePersistence(filepath.Join(dir, name, "koda.db")); err != nil {
+				t.Fatalf("error initializing persistence: %v", err)
+			}
+			t.Cleanup(func() { lfs.Shutdown() })
+			return lfs
+		},
+		Persistent: true,
+	})
+}
+
+func TestConformance_Memory(t *testing.T) {
+	storetest.RunConformance(t, storetest.Factory{
+		Open: func(t *testing.T, name string) koda.Store {
+			return New()
+		},
+	})
+}
@@ -0,0 +1,38 @@
+package localfile
+
+import (
+	"context"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// maxReaders is the number of concurrent readers of a ctxRWMutex. A writer acquires all of them.
+const maxReaders = 1 << 30
+
+// ctxRWMutex is a reader/writer mutual exclusion lock whose acquisition can be cancelled with a context.
+// Waiters are served in FIFO order, so a waiting writer blocks subsequent readers and cannot be starved.
+type ctxRWMutex struct {
+	sem *semaphore.Weighted
+}
+
+func newCtxRWMutex() *ctxRWMutex {
+	return &ctxRWMutex{sem: semaphore.NewWeighted(maxReaders)}
+}
+
+// Lock locks m for writing. It returns ctx.Err() without locking m if ctx is done before the lock is acquired.
+func (m *ctxRWMutex) Lock(ctx context.Context) error {
+	return m.sem.Acquire(ctx, maxReaders)
+}
+
+func (m *ctxRWMutex) Unlock() {
+	m.sem.Release(maxReaders)
+}
+
+// RLock locks m for reading. It returns ctx.Err() without locking m if ctx is done before the lock is acquired.
+func (m *ctxRWMutex) RLock(ctx context.Context) error {
+	return m.sem.Acquire(ctx, 1)
+}
+
+func (m *ctxRWMutex) RUnlock() {
+	m.sem.Release(1)
+}
@@ -0,0 +1,112 @@
+package localfile
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/log"
+)
+
+// KeysEnv is the environment variable master keys are read from if a file:// store URI does not name a key file.
+const KeysEnv = "KODA_DB_KEYS"
+
+func init() {
+	koda.Register("file", openFile)
+	koda.Register("memory", openMemory)
+}
+
+// openFile opens a persistent LocalFileStore at the path of a URI like
+//
+//	file:///data/db/koda.db?generations=3&keyfile=/run/secrets/koda-keys&flushinterval=30s&flushafter=1000
+//
+// generations is passed to KeepGenerations, flushinterval to WithFlushInterval and flushafter to
+// WithFlushAfterWrites. readonly=true opens the store WithReadOnly. The data file is encrypted with the Keyring from
+// keyfile or KeysEnv, if either is set.
+func openFile(_ context.Context, u *url.URL) (koda.Store, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("file store URI must have an absolute path, like file:///data/db/koda.db")
+	}
+	if u.Path == "" {
+		return nil, fmt.Errorf("file store URI must have a path")
+	}
+	q := u.Query()
+	for p := range q {
+		if p != "generations" && p != "keyfile" && p != "flushinterval" && p != "flushafter" && p != "readonly" {
+			return nil, fmt.Errorf("unknown file store option %q", p)
+		}
+	}
+
+	var opts []Option
+	if i := q.Get("flushinterval"); i != "" {
+		d, err := time.ParseDuration(i)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid flushinterval %q", i)
+		}
+		opts = append(opts, WithFlushInterval(d))
+	}
+	if a := q.Get("flushafter"); a != "" {
+		n, err := strconv.Atoi(a)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid flushafter %q", a)
+		}
+		opts = append(opts, WithFlushAfterWrites(n))
+	}
+	if r := q.Get("readonly"); r != "" {
+		ro, err := strconv.ParseBool(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid readonly %q", r)
+		}
+		if ro {
+			opts = append(opts, WithReadOnly())
+		}
+	}
+
+	lfs := New(opts...)
+	if g := q.Get("generations"); g != "" {
+		n, err := strconv.Atoi(g)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid generations %q", g)
+		}
+		lfs.KeepGenerations(n)
+	}
+	keys, err := LoadKeyringForURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("error loading database keys: %v", err)
+	}
+	if keys != nil {
+		if err := lfs.SetKeyring(keys); err != nil {
+			return nil, fmt.Errorf("error configuring database encryption: %v", err)
+		}
+	} else {
+		log.Warnf("no database keys configured, data is stored unencrypted")
+	}
+	if err := lfs.InitializePersistence(u.Path); err != nil {
+		return nil, err
+	}
+	return lfs, nil
+}
+
+// openMemory opens a LocalFileStore without persistence for memory:// URIs.
+func openMemory(_ context.Context, u *url.URL) (koda.Store, error) {
+	if u.Host != "" || u.Path != "" || u.RawQuery != "" {
+		return nil, fmt.Errorf("memory store URI takes no options, use memory://")
+	}
+	return New(), nil
+}
+
+// LoadKeyringForURL loads the Keyring for a file:// store URI from the file in its keyfile option or, if not set,
+// from KeysEnv. It returns a nil Keyring if neither is configured.
+func LoadKeyringForURL(u *url.URL) (*Keyring, error) {
+	if path := u.Query().Get("keyfile"); path != "" {
+		return LoadKeyring(path)
+	}
+	if v := os.Getenv(KeysEnv); v != "" {
+		return ParseKeyring(v)
+	}
+	return nil, nil
+}
@@ -0,0 +1,62 @@
+package localfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mindtastic/koda"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys")
+	assert.NoError(t, os.WriteFile(keyFile, []byte("1:"+testKey(1)), 0600))
+	dbPath := filepath.Join(dir, "koda.db")
+
+	s, err := koda.Open(context.Background(), "file://"+dbPath+"?generations=1&flushinterval=1m&flushafter=100&keyfile="+keyFile)
+	assert.NoError(t, err)
+	lfs := s.(*LocalFileStore)
+	assert.Equal(t, 1, lfs.generations)
+	assert.Equal(t, time.Minute, lfs.flushInterval)
+	assert.Equal(t, 100, lfs.flushAfter)
+	assert.NotNil(t, lfs.keys)
+	assert.NoError(t, lfs.Set(context.Background(), "testing", koda.Record{AccountKey: "testing"}))
+	assert.NoError(t, lfs.Shutdown())
+	data, err := os.ReadFile(dbPath)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "testing")
+
+	s, err = koda.Open(context.Background(), "file://"+dbPath+"?readonly=true&keyfile="+keyFile)
+	assert.NoError(t, err)
+	assert.True(t, s.(*LocalFileStore).readOnly)
+	_, err = s.Get(context.Background(), "testing")
+	assert.NoError(t, err)
+	assert.NoError(t, s.(*LocalFileStore).Shutdown())
+
+	s, err = koda.Open(context.Background(), "memory://")
+	assert.NoError(t, err)
+	assert.Empty(t, s.(*LocalFileStore).dbPath)
+
+	testCases := []struct {
+		uri string
+		err string
+	}{
+		{uri: "file://relative/koda.db", err: "file store URI must have an absolute path, like file:///data/db/koda.db"},
+		{uri: "file://" + dbPath + "?generation=1", err: `unknown file store option "generation"`},
+		{uri: "file://" + dbPath + "?generations=-1", err: `invalid generations "-1"`},
+		{uri: "file://" + dbPath + "?flushinterval=0s", err: `invalid flushinterval "0s"`},
+		{uri: "file://" + dbPath + "?flushafter=0", err: `invalid flushafter "0"`},
+		{uri: "file://" + dbPath + "?readonly=maybe", err: `invalid readonly "maybe"`},
+		{uri: "memory:///path", err: "memory store URI takes no options, use memory://"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.uri, func(t *testing.T) {
+			_, err := koda.Open(context.Background(), tc.uri)
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package localfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// snapshotMagic prefixes snapshot files. It is followed by a format version byte, the SHA-256 checksum of the payload
+// and the payload itself. Files without this header are loaded as legacy snapshots without a checksum.
+var snapshotMagic = []byte("KODASNAP")
+
+const snapshotFormatVersion = 1
+
+const snapshotHeaderSize = 8 + 1 + sha256.Size
+
+// defaultSnapshotGenerations is the default number of previous snapshots kept next to the data file.
+const defaultSnapshotGenerations = 3
+
+// errCorruptSnapshot is returned for snapshots that fail verification or decoding.
+var errCorruptSnapshot = errors.New("snapshot is corrupt")
+
+// encodeSnapshot wraps payload into a checksummed snapshot.
+func encodeSnapshot(payload []byte) []byte {
+	sum := sha256.Sum256(payload)
+	data := make([]byte, 0, snapshotHeaderSize+len(payload))
+	data = append(data, snapshotMagic...)
+	data = append(data, snapshotFormatVersion)
+	data = append(data, sum[:]...)
+	return append(data, payload...)
+}
+
+// decodeSnapshot verifies the checksum of a snapshot and returns its payload. Legacy snapshots are returned as is.
+func decodeSnapshot(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, snapshotMagic) {
+		return data, nil
+	}
+	if len(data) < snapshotHeaderSize {
+		return nil, fmt.Errorf("%w: truncated header", errCorruptSnapshot)
+	}
+	if v := data[len(snapshotMagic)]; v != snapshotFormatVersion {
+		return nil, fmt.Errorf("unsupported snapshot format version %d", v)
+	}
+	payload := data[snapshotHeaderSize:]
+	sum := sha256.Sum256(payload)
+	if !bytes.Equal(sum[:], data[len(snapshotMagic)+1:snapshotHeaderSize]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorruptSnapshot)
+	}
+	return payload, nil
+}
+
+// generationPath returns the path of the n-th previous snapshot of the data file at path.
+func generationPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// writeSnapshot atomically replaces the data file at path with data. The previous data file is kept as the first
+// generation, while existing generations are shifted and the oldest generation beyond keep is dropped.
+// data is written to a temporary file first, which is synced and renamed to path. Finally, the directory is synced
+// to persist the rename.
+func writeSnapshot(path string, data []byte, keep int) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := rotateGenerations(path, keep); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// rotateGenerations shifts all generations of the data file at path by one and links the data file as the first
+// generation. The data file itself stays in place until it is replaced.
+func rotateGenerations(path string, keep int) error {
+	if keep < 1 {
+		return nil
+	}
+	if err := os.Remove(generationPath(path, keep)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := keep - 1; n > 0; n-- {
+		if err := os.Rename(generationPath(path, n), generationPath(path, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Link(path, generationPath(path, 1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,112 @@
+package localfile
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mindtastic/koda"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeSnapshot(t *testing.T) {
+	payload := []byte(`{"testing":{"accountKey":"testing"}}`)
+	encoded := encodeSnapshot(payload)
+
+	corrupt := append([]byte(nil), encoded...)
+	corrupt[len(corrupt)-2] ^= 0xff
+
+	testCases := []struct {
+		name     string
+		data     []byte
+		expected []byte
+		err      string
+	}{
+		{name: "valid", data: encoded, expected: payload},
+		{name: "legacy", data: payload, expected: payload},
+		{name: "empty legacy", data: []byte{}, expected: []byte{}},
+		{name: "corrupt", data: corrupt, err: "snapshot is corrupt: checksum mismatch"},
+		{name: "truncated", data: encoded[:snapshotHeaderSize-1], err: "snapshot is corrupt: truncated header"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			decoded, err := decodeSnapshot(tc.data)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				assert.ErrorIs(t, err, errCorruptSnapshot)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, decoded)
+		})
+	}
+}
+
+func TestSnapshotGenerations(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "koda.db")
+	lfs := New()
+	lfs.KeepGenerations(2)
+	assert.NoError(t, lfs.InitializePersistence(dbPath))
+
+	for _, key := range []koda.AccountKey{"first", "second", "third"} {
+		assert.NoError(t, lfs.Set(context.Background(), key, koda.Record{AccountKey: key}))
+		assert.NoError(t, lfs.flush())
+	}
+
+	assertKeys := func(path string, expected ...koda.AccountKey) {
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		store, err := lfs.decode(data)
+		assert.NoError(t, err)
+		assert.Len(t, store, len(expected))
+		for _, key := range expected {
+			assert.Contains(t, store, key)
+		}
+	}
+	assertKeys(dbPath, "first", "second", "third")
+	assertKeys(generationPath(dbPath, 1), "first", "second")
+	assertKeys(generationPath(dbPath, 2), "first")
+	assert.NoFileExists(t, generationPath(dbPath, 3))
+	assert.NoFileExists(t, dbPath+".tmp")
+
+	// Deleting a record erases it from all generations
+	assert.NoError(t, lfs.Delete(context.Background(), "first"))
+	assertKeys(dbPath, "second", "third")
+	assertKeys(generationPath(dbPath, 1), "second", "third")
+	assertKeys(generationPath(dbPath, 2), "second")
+}
+
+func TestSnapshotFallback(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "koda.db")
+	lfs := New()
+	assert.NoError(t, lfs.InitializePersistence(dbPath))
+	assert.NoError(t, lfs.Set(context.Background(), "first", koda.Record{AccountKey: "first"}))
+	assert.NoError(t, lfs.flush())
+	assert.NoError(t, lfs.Set(context.Background(), "second", koda.Record{AccountKey: "second"}))
+	assert.NoError(t, lfs.flush())
+
+	// Corrupt the primary data file
+	data, err := os.ReadFile(dbPath)
+	assert.NoError(t, err)
+	data = bytes.Replace(data, []byte("second"), []byte("secxnd"), 1)
+	assert.NoError(t, os.WriteFile(dbPath, data, 0600))
+
+	lfs.crash()
+	reloaded := New()
+	assert.NoError(t, reloaded.InitializePersistence(dbPath))
+	_, err = reloaded.Get(context.Background(), "first")
+	assert.NoError(t, err)
+	_, err = reloaded.Get(context.Background(), "second")
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+
+	// Without any valid generation, loading fails
+	for n := 1; n <= defaultSnapshotGenerations; n++ {
+		os.Remove(generationPath(dbPath, n))
+	}
+	reloaded.crash()
+	err = New().InitializePersistence(dbPath)
+	assert.ErrorIs(t, err, errCorruptSnapshot)
+}
@@ -0,0 +1,220 @@
+package localfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/log"
+)
+
+// walSuffix is appended to the path of the data file to get the path of the write-ahead log.
+const walSuffix = ".wal"
+
+// walFrameHeaderSize is the size of the header preceding every entry in the write-ahead log. It consists of the big
+// endian uint32 length and the CRC-32 checksum of the payload.
+const walFrameHeaderSize = 8
+
+// maxWALEntrySize bounds the payload size of a single entry to detect corrupt length headers.
+const maxWALEntrySize = 16 << 20
+
+const (
+	walOpSet    = "set"
+	walOpDelete = "delete"
+)
+
+// walEntry is a single change to the store.
+type walEntry struct {
+	Op     string          `json:"op"`
+	Key    koda.AccountKey `json:"key"`
+	Record *koda.Record    `json:"record,omitempty"`
+}
+
+// wal is an append-only log of all changes since the last snapshot. Every entry is synced to disk before append
+// returns, so acknowledged writes survive a crash. The log is replayed on top of the snapshot when loading the store
+// and truncated after each successful snapshot.
+type wal struct {
+	f    *os.File
+	size int64 // Size of all valid entries
+}
+
+// openWAL opens or creates the write-ahead log at path.
+func openWAL(path string) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening write-ahead log: %v", err)
+	}
+	return &wal{f: f}, nil
+}
+
+// replay applies all complete entries of the log to store. A torn final entry, as left behind by a crash during
+// append, ends the log. It is truncated from the file, so that new entries are appended after the last valid one.
+// Any other invalid entry fails replay and leaves the file unchanged, as the entries after it are acknowledged writes.
+// replay returns the number of applied entries.
+func (w *wal) replay(store map[koda.AccountKey]koda.Record, keys *Keyring) (int, error) {
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("error seeking write-ahead log: %v", err)
+	}
+	n, offset, err := applyWAL(w.f, store, keys)
+	if err != nil {
+		return n, err
+	}
+
+	info, err := w.f.Stat()
+	if err != nil {
+		return n, fmt.Errorf("error reading write-ahead log: %v", err)
+	}
+	if torn := info.Size() - offset; torn > 0 {
+		log.Warnf("truncating %d bytes of a torn entry at the end of the write-ahead log %s", torn, w.f.Name())
+	}
+	if err := w.f.Truncate(offset); err != nil {
+		return n, fmt.Errorf("error truncating write-ahead log: %v", err)
+	}
+	if _, err := w.f.Seek(offset, io.SeekStart); err != nil {
+		return n, fmt.Errorf("error seeking write-ahead log: %v", err)
+	}
+	w.size = offset
+	return n, nil
+}
+
+// replayWAL applies all complete entries of the write-ahead log at path to store like wal.replay, but leaves the file
+// unchanged. A missing log has no entries.
+func replayWAL(path string, store map[koda.AccountKey]koda.Record, keys *Keyring) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error opening write-ahead log: %v", err)
+	}
+	defer f.Close()
+	n, _, err := applyWAL(f, store, keys)
+	return n, err
+}
+
+// applyWAL applies the complete entries read from r to store, up to the end of r or a torn final entry. It returns the
+// number of applied entries and the number of bytes they occupy.
+func applyWAL(r io.Reader, store map[koda.AccountKey]koda.Record, keys *Keyring) (int, int64, error) {
+	br := bufio.NewReader(r)
+	var (
+		offset int64
+		n      int
+	)
+	for {
+		e, size, err := readWALEntry(br, keys)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return n, offset, fmt.Errorf("write-ahead log entry %d at offset %d: %w", n, offset, err)
+		}
+		switch e.Op {
+		case walOpSet:
+			if e.Record == nil {
+				return n, offset, fmt.Errorf("write-ahead log entry %d: missing record", n)
+			}
+			store[e.Key] = *e.Record
+		case walOpDelete:
+			delete(store, e.Key)
+		default:
+			return n, offset, fmt.Errorf("write-ahead log entry %d: unknown operation %q", n, e.Op)
+		}
+		offset += size
+		n++
+	}
+	return n, offset, nil
+}
+
+// readWALEntry reads a single entry and returns it with the number of bytes it occupies in the log. It returns io.EOF
+// at the end of r and io.ErrUnexpectedEOF if r ends within the entry.
+func readWALEntry(r io.Reader, keys *Keyring) (walEntry, int64, error) {
+	var e walEntry
+	header := make([]byte, walFrameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return e, 0, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxWALEntrySize {
+		return e, 0, fmt.Errorf("entry size %d exceeds limit", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return e, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return e, 0, errors.New("checksum mismatch")
+	}
+
+	if IsEncrypted(payload) {
+		if keys == nil {
+			return e, 0, ErrNoKeyring
+		}
+		var err error
+		if payload, err = keys.Open(payload); err != nil {
+			return e, 0, fmt.Errorf("error decrypting entry: %w", err)
+		}
+	}
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return e, 0, fmt.Errorf("error decoding entry: %v", err)
+	}
+	return e, int64(walFrameHeaderSize) + int64(size), nil
+}
+
+// append writes e to the log, sealed with the primary key of keys if not nil, and syncs it to disk.
+func (w *wal) append(e walEntry, keys *Keyring) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error encoding write-ahead log entry: %v", err)
+	}
+	if keys != nil {
+		if payload, err = keys.Seal(payload); err != nil {
+			return fmt.Errorf("error encrypting write-ahead log entry: %v", err)
+		}
+	}
+
+	frame := make([]byte, walFrameHeaderSize, walFrameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload))
+	frame = append(frame, payload...)
+	if _, err := w.f.Write(frame); err != nil {
+		w.rollback()
+		return fmt.Errorf("error writing write-ahead log: %v", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		w.rollback()
+		return fmt.Errorf("error syncing write-ahead log: %v", err)
+	}
+	w.size += int64(len(frame))
+	return nil
+}
+
+// rollback removes a partially written entry, so that it does not hide subsequent entries during replay.
+func (w *wal) rollback() {
+	_ = w.f.Truncate(w.size)
+	_, _ = w.f.Seek(w.size, io.SeekStart)
+}
+
+// reset discards all entries. It must only be called once the entries are contained in a snapshot on disk.
+func (w *wal) reset() error {
+	if err := w.f.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating write-ahead log: %v", err)
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking write-ahead log: %v", err)
+	}
+	w.size = 0
+	return w.f.Sync()
+}
+
+func (w *wal) Close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,186 @@
+package localfile
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mindtastic/koda"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_CrashRecovery(t *testing.T) {
+	testCases := []struct {
+		name    string
+		keyring string
+		garbage []byte
+	}{
+		{name: "plain", keyring: ""},
+		{name: "encrypted", keyring: "1:" + testKey(1)},
+		{name: "torn header", keyring: "", garbage: []byte{0, 0, 1}},
+		{name: "torn entry", keyring: "", garbage: []byte{0, 0, 1, 0, 42, 42}},
+		{name: "torn payload", keyring: "", garbage: walFrame([]byte(`{"op":"set","key":"torn"}`))[:12]},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "koda.db")
+			open := func() *LocalFileStore {
+				lfs := New()
+				if tc.keyring != "" {
+					k, err := ParseKeyring(tc.keyring)
+					assert.NoError(t, err)
+					assert.NoError(t, lfs.SetKeyring(k))
+				}
+				assert.NoError(t, lfs.InitializePersistence(dbPath))
+				return lfs
+			}
+
+			lfs := open()
+			assert.NoError(t, lfs.Set(context.Background(), "flushed", koda.Record{AccountKey: "flushed"}))
+			assert.NoError(t, lfs.flush())
+			assert.NoError(t, lfs.Set(context.Background(), "unflushed", koda.Record{AccountKey: "unflushed"}))
+			assert.NoError(t, lfs.Set(context.Background(), "deleted", koda.Record{AccountKey: "deleted"}))
+			assert.NoError(t, lfs.wal.append(walEntry{Op: walOpDelete, Key: "deleted"}, lfs.keys))
+
+			if tc.garbage != nil {
+				f, err := os.OpenFile(dbPath+walSuffix, os.O_WRONLY|os.O_APPEND, 0)
+				assert.NoError(t, err)
+				_, err = f.Write(tc.garbage)
+				assert.NoError(t, err)
+				f.Close()
+			}
+
+			// Simulate a crash by loading the data again without shutting down lfs
+			lfs.crash()
+			recovered := open()
+			for _, key := range []koda.AccountKey{"flushed", "unflushed"} {
+				r, err := recovered.Get(context.Background(), key)
+				assert.NoError(t, err)
+				assert.Equal(t, key, r.AccountKey)
+			}
+			_, err := recovered.Get(context.Background(), "deleted")
+			assert.ErrorIs(t, err, koda.ErrNotFound)
+
+			// Writes after recovery must not be hidden behind a torn entry
+			assert.NoError(t, recovered.Set(context.Background(), "recovered", koda.Record{AccountKey: "recovered"}))
+			recovered.crash()
+			_, err = open().Get(context.Background(), "recovered")
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// walFrame returns payload framed like an entry of the write-ahead log.
+func walFrame(payload []byte) []byte {
+	frame := make([]byte, walFrameHeaderSize, walFrameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload))
+	return append(frame, payload...)
+}
+
+func TestWAL_Corruption(t *testing.T) {
+	valid := walFrame([]byte(`{"op":"set","key":"later","record":{}}`))
+	testCases := []struct {
+		name    string
+		garbage []byte
+		err     string
+	}{
+		{name: "checksum mismatch", garbage: []byte{0, 0, 0, 2, 0, 0, 0, 0, '{', '}'}, err: "checksum mismatch"},
+		{name: "checksum mismatch within the log", garbage: append([]byte{0, 0, 0, 2, 0, 0, 0, 0, '{', '}'}, valid...), err: "checksum mismatch"},
+		{name: "invalid entry", garbage: append(walFrame([]byte("not json")), valid...), err: "error decoding entry"},
+		{name: "size limit", garbage: []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, err: "exceeds limit"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "koda.db")
+			lfs := New()
+			assert.NoError(t, lfs.InitializePersistence(dbPath))
+			assert.NoError(t, lfs.Set(context.Background(), "testing", koda.Record{AccountKey: "testing"}))
+			f, err := os.OpenFile(dbPath+walSuffix, os.O_WRONLY|os.O_APPEND, 0)
+			assert.NoError(t, err)
+			_, err = f.Write(tc.garbage)
+			assert.NoError(t, err)
+			f.Close()
+			info, err := os.Stat(dbPath + walSuffix)
+			assert.NoError(t, err)
+
+			// Loading fails instead of dropping the entries following the invalid one
+			lfs.crash()
+			err = New().InitializePersistence(dbPath)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.err)
+			}
+			after, err := os.Stat(dbPath + walSuffix)
+			assert.NoError(t, err)
+			assert.Equal(t, info.Size(), after.Size())
+		})
+	}
+}
+
+func TestWAL_UnknownKeyVersion(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "koda.db")
+	k2, err := ParseKeyring("2:" + testKey(2))
+	assert.NoError(t, err)
+	lfs := New()
+	assert.NoError(t, lfs.SetKeyring(k2))
+	assert.NoError(t, lfs.InitializePersistence(dbPath))
+	assert.NoError(t, lfs.flush())
+	assert.NoError(t, lfs.Set(context.Background(), "testing", koda.Record{AccountKey: "testing"}))
+	lfs.crash()
+	assert.NoError(t, os.Remove(dbPath)) // Leave only the write-ahead log to be decrypted
+
+	// The entry cannot be decrypted without version 2, which must not be mistaken for a torn entry
+	k1, err := ParseKeyring("1:" + testKey(1))
+	assert.NoError(t, err)
+	reloaded := New()
+	assert.NoError(t, reloaded.SetKeyring(k1))
+	err = reloaded.InitializePersistence(dbPath)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no key with version 2 in keyring")
+	}
+	info, err := os.Stat(dbPath + walSuffix)
+	assert.NoError(t, err)
+	assert.NotZero(t, info.Size())
+}
+
+func TestWAL_Compaction(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "koda.db")
+	lfs := New()
+	assert.NoError(t, lfs.InitializePersistence(dbPath))
+	assert.NoError(t, lfs.Set(context.Background(), "testing", koda.Record{AccountKey: "testing"}))
+
+	info, err := os.Stat(dbPath + walSuffix)
+	assert.NoError(t, err)
+	assert.NotZero(t, info.Size())
+
+	assert.NoError(t, lfs.Shutdown())
+	info, err = os.Stat(dbPath + walSuffix)
+	assert.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	reloaded := New()
+	assert.NoError(t, reloaded.InitializePersistence(dbPath))
+	_, err = reloaded.Get(context.Background(), "testing")
+	assert.NoError(t, err)
+}
+
+func TestWAL_EncryptedWithoutKeyring(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "koda.db")
+	k, err := ParseKeyring("1:" + testKey(1))
+	assert.NoError(t, err)
+
+	lfs := New()
+	assert.NoError(t, lfs.SetKeyring(k))
+	assert.NoError(t, lfs.InitializePersistence(dbPath))
+	assert.NoError(t, lfs.Set(context.Background(), "testing", koda.Record{AccountKey: "testing"}))
+
+	// The snapshot is still empty and unencrypted, the write-ahead log must not be dropped silently
+	lfs.crash()
+	err = New().InitializePersistence(dbPath)
+	assert.ErrorIs(t, err, ErrNoKeyring)
+}
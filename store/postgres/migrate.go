@@ -0,0 +1,59 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+)
+
+// migrations are applied in order. Each migration is applied exactly once, its version is its index plus one.
+// Applied migrations must never be changed, add a new migration instead.
+var migrations = []string{
+	// 1: Records are stored as JSON documents. ServiceKeys must not be indexed.
+	`CREATE TABLE koda_records (
+		account_key TEXT PRIMARY KEY,
+		record JSONB NOT NULL
+	)`,
+}
+
+// migrationLockID is the key of the advisory lock serializing migrations of concurrently starting koda instances.
+const migrationLockID = 0x6b6f6461 // "koda"
+
+// Migrate brings the database schema up to date. It is safe to be called concurrently by multiple koda instances.
+func (p *PostgresStore) Migrate(ctx context.Context) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+		return fmt.Errorf("error acquiring migration lock: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS koda_schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return fmt.Errorf("error creating migration table: %v", err)
+	}
+
+	var current int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM koda_schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("error reading schema version: %v", err)
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", current, len(migrations))
+	}
+
+	for v := current + 1; v <= len(migrations); v++ {
+		if _, err := tx.ExecContext(ctx, migrations[v-1]); err != nil {
+			return fmt.Errorf("error applying migration %d: %v", v, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO koda_schema_migrations (version) VALUES ($1)`, v); err != nil {
+			return fmt.Errorf("error recording migration %d: %v", v, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing migrations: %v", err)
+	}
+	return nil
+}
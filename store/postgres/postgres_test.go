@@ -0,0 +1,154 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/store/storetest"
+	"github.com/stretchr/testify/assert"
+)
+
+// dsnEnv points the integration tests to a PostgreSQL database, see the package documentation.
+const dsnEnv = "KODA_POSTGRES_DSN"
+
+func newTestStore(t *testing.T) *PostgresStore {
+	dsn := os.Getenv(dsnEnv)
+	if dsn == "" {
+		t.Skipf("%s not set, skipping PostgreSQL integration test", dsnEnv)
+	}
+	p, err := Open(context.Background(), dsn)
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	if _, err := p.db.Exec(`DROP TABLE IF EXISTS koda_records, koda_schema_migrations`); err != nil {
+		t.Fatalf("error resetting database: %v", err)
+	}
+	if err := p.Migrate(context.Background()); err != nil {
+		t.Fatalf("error migrating database: %v", err)
+	}
+	return p
+}
+
+func TestMigrate(t *testing.T) {
+	p := newTestStore(t)
+
+	// Migrations are idempotent
+	assert.NoError(t, p.Migrate(context.Background()))
+
+	var version int
+	assert.NoError(t, p.db.QueryRow(`SELECT MAX(version) FROM koda_schema_migrations`).Scan(&version))
+	assert.Equal(t, len(migrations), version)
+}
+
+func TestPostgresStore(t *testing.T) {
+	p := newTestStore(t)
+	record := koda.Record{
+		AccountKey:  "testing",
+		ServiceKeys: map[string]koda.ServiceKey{"user-service": "key"},
+	}
+
+	_, err := p.Get(context.Background(), record.AccountKey)
+	assert.True(t, errors.Is(err, koda.ErrNotFound))
+
+	assert.NoError(t, p.Set(context.Background(), record.AccountKey, record))
+	r, err := p.Get(context.Background(), record.AccountKey)
+	assert.NoError(t, err)
+	assert.Equal(t, record, r)
+
+	record.ServiceKeys["diary-service"] = "other"
+	assert.NoError(t, p.Set(context.Background(), record.AccountKey, record))
+	r, err = p.Get(context.Background(), record.AccountKey)
+	assert.NoError(t, err)
+	assert.Equal(t, record, r)
+
+	assert.NoError(t, p.Delete(context.Background(), record.AccountKey))
+	_, err = p.Get(context.Background(), record.AccountKey)
+	assert.True(t, errors.Is(err, koda.ErrNotFound))
+	assert.True(t, errors.Is(p.Delete(context.Background(), record.AccountKey), koda.ErrNotFound))
+}
+
+func TestGetOrCreateServiceKey(t *testing.T) {
+	p := newTestStore(t)
+	const workers = 16
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		keys = make(map[koda.ServiceKey]bool)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := uuid.GenerateUUID()
+			assert.NoError(t, err)
+			r, err := p.GetOrCreateServiceKey(context.Background(), "testing", "user-service", koda.ServiceKey(id))
+			assert.NoError(t, err)
+			mu.Lock()
+			keys[r.ServiceKeys["user-service"]] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, keys, 1, fmt.Sprintf("issued keys: %v", keys))
+
+	r, err := p.Get(context.Background(), "testing")
+	assert.NoError(t, err)
+	assert.Equal(t, koda.AccountKey("testing"), r.AccountKey)
+	assert.True(t, keys[r.ServiceKeys["user-service"]])
+
+	// Inactive records do not get new ServiceKeys
+	r.Inactive = true
+	assert.NoError(t, p.Set(context.Background(), "testing", r))
+	r, err = p.GetOrCreateServiceKey(context.Background(), "testing", "diary-service", "new")
+	assert.NoError(t, err)
+	assert.NotContains(t, r.ServiceKeys, "diary-service")
+}
+
+func TestList(t *testing.T) {
+	p := newTestStore(t)
+	// "B" sorts before "a" bytewise, but after it in most collations
+	for _, k := range []koda.AccountKey{"a", "B", "c"} {
+		assert.NoError(t, p.Set(context.Background(), k, koda.Record{AccountKey: k}))
+	}
+
+	keys, err := p.List(context.Background(), "", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.AccountKey{"B", "a"}, keys)
+	keys, err = p.List(context.Background(), "a", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.AccountKey{"c"}, keys)
+
+	records, err := p.Scan(context.Background(), "B", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.Record{{AccountKey: "a"}}, records)
+}
+
+func TestConformance(t *testing.T) {
+	// Every run of the suite starts on a fresh database, reopening a store keeps its records
+	var current string
+	storetest.RunConformance(t, storetest.Factory{
+		Open: func(t *testing.T, name string) koda.Store {
+			if name == current {
+				dsn := os.Getenv(dsnEnv)
+				p, err := Open(context.Background(), dsn)
+				if err != nil {
+					t.Fatalf("error opening database: %v", err)
+				}
+				t.Cleanup(func() { p.Close() })
+				return p
+			}
+			current = name
+			return newTestStore(t)
+		},
+		Persistent: true,
+	})
+}
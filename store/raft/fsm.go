@@ -0,0 +1,269 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	hraft "github.com/hashicorp/raft"
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/dump"
+	"github.com/mindtastic/koda/store/localfile"
+)
+
+// Operations of a command
+const (
+	opSet        = "set"
+	opDelete     = "delete"
+	opServiceKey = "serviceKey"
+	opSalt       = "salt"
+	opUpdate     = "update"
+)
+
+// command is a write replicated through the Raft log. Commands carry everything needed to apply them, like newly
+// generated ServiceKeys and Salts, so every node applies them identically.
+type command struct {
+	Op         string          `json:"op"`
+	Key        koda.AccountKey `json:"key"`
+	Record     *koda.Record    `json:"record,omitempty"`
+	Expected   *koda.Record    `json:"expected,omitempty"` // Record an update was computed from
+	Service    string          `json:"service,omitempty"`
+	ServiceKey koda.ServiceKey `json:"serviceKey,omitempty"`
+	Salt       []byte          `json:"salt,omitempty"`
+}
+
+// result is the outcome of applying a command. It is returned as the response of the Raft log entry.
+type result struct {
+	record koda.Record
+	err    error
+}
+
+// fsm is the replicated state of a node, an in-memory LocalFileStore. Raft persists it with its log and snapshots,
+// which are encrypted with keys.
+type fsm struct {
+	mu      sync.RWMutex
+	state   *localfile.LocalFileStore // Replaced on Restore
+	keys    *localfile.Keyring
+	deleted func() // Called after a record has been deleted, must not block
+
+	appliedMu sync.Mutex
+	index     uint64        // Index of the last applied log entry
+	advanced  chan struct{} // Closed and replaced whenever index changes
+}
+
+// Ensure that fsm implements the hraft.FSM interface
+var _ hraft.FSM = (*fsm)(nil)
+
+func newFSM(keys *localfile.Keyring, deleted func()) *fsm {
+	return &fsm{state: localfile.New(), keys: keys, deleted: deleted, advanced: make(chan struct{})}
+}
+
+// store returns the current state. The returned store must not be written to outside of Apply.
+func (f *fsm) store() *localfile.LocalFileStore {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.state
+}
+
+// applied returns the index of the last log entry applied to the state. Unlike hraft.Raft.AppliedIndex, it does not
+// advance before the entry has been applied.
+func (f *fsm) applied() uint64 {
+	f.appliedMu.Lock()
+	defer f.appliedMu.Unlock()
+	return f.index
+}
+
+// setApplied sets the index of the last applied log entry and wakes up everything waiting for it.
+func (f *fsm) setApplied(index uint64) {
+	f.appliedMu.Lock()
+	defer f.appliedMu.Unlock()
+	f.index = index
+	close(f.advanced)
+	f.advanced = make(chan struct{})
+}
+
+// waitApplied waits until the log entry at index has been applied to the state. It returns ctx.Err() if ctx is done
+// before.
+func (f *fsm) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		f.appliedMu.Lock()
+		applied, advanced := f.index, f.advanced
+		f.appliedMu.Unlock()
+		if applied >= index {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-advanced:
+		}
+	}
+}
+
+// Apply applies a committed command and returns its result. Commands written before the log has been encrypted are
+// applied as well.
+func (f *fsm) Apply(l *hraft.Log) interface{} {
+	defer f.setApplied(l.Index)
+	data := l.Data
+	if localfile.IsEncrypted(data) {
+		var err error
+		if data, err = f.keys.Open(data); err != nil {
+			return result{err: fmt.Errorf("error decrypting command at index %d: %v", l.Index, err)}
+		}
+	}
+	var cmd command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return result{err: fmt.Errorf("error decoding command at index %d: %v", l.Index, err)}
+	}
+	return f.apply(cmd)
+}
+
+func (f *fsm) apply(cmd command) result {
+	ctx, s := context.Background(), f.store()
+	switch cmd.Op {
+	case opSet:
+		if cmd.Record == nil {
+			return result{err: fmt.Errorf("set command for %s has no record", cmd.Key)}
+		}
+		return result{record: *cmd.Record, err: s.Set(ctx, cmd.Key, *cmd.Record)}
+	case opDelete:
+		err := s.Delete(ctx, cmd.Key)
+		if err == nil {
+			f.deleted()
+		}
+		return result{err: err}
+	case opUpdate:
+		if cmd.Record == nil || cmd.Expected == nil {
+			return result{err: fmt.Errorf("update command for %s has no record", cmd.Key)}
+		}
+		r, err := s.Update(ctx, cmd.Key, func(current koda.Record) (koda.Record, error) {
+			if !sameRecord(current, *cmd.Expected) {
+				return current, errConflict
+			}
+			return *cmd.Record, nil
+		})
+		return result{record: r, err: err}
+	case opServiceKey:
+		r, err := s.GetOrCreateServiceKey(ctx, cmd.Key, cmd.Service, cmd.ServiceKey)
+		return result{record: r, err: err}
+	case opSalt:
+		r, err := s.GetOrCreateSalt(ctx, cmd.Key, cmd.Service, cmd.Salt)
+		return result{record: r, err: err}
+	}
+	return result{err: fmt.Errorf("unknown command %q", cmd.Op)}
+}
+
+// sameRecord reports whether a and b are equal once encoded, as records in commands are.
+func sameRecord(a, b koda.Record) bool {
+	ea, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	eb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ea, eb)
+}
+
+// Snapshot captures all records. Apply is not called concurrently, and records are never modified in place, so
+// copying them is enough for a consistent snapshot.
+func (f *fsm) Snapshot() (hraft.FSMSnapshot, error) {
+	var records []koda.Record
+	err := koda.Walk(context.Background(), f.store(), koda.DefaultPageSize, func(r koda.Record) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error capturing snapshot: %v", err)
+	}
+	return &snapshot{index: f.applied(), records: records, keys: f.keys}, nil
+}
+
+// Restore replaces the state with the records of a snapshot written by snapshot.Persist. Snapshots written before
+// they have been encrypted are restored as well.
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("error reading snapshot: %v", err)
+	}
+	var index uint64
+	if localfile.IsEncrypted(data) {
+		if data, err = f.keys.Open(data); err != nil {
+			return fmt.Errorf("error decrypting snapshot: %v", err)
+		}
+		if len(data) < 8 {
+			return fmt.Errorf("error reading snapshot: truncated")
+		}
+		index, data = binary.BigEndian.Uint64(data), data[8:]
+	}
+	dr, err := dump.NewReader(bytes.NewReader(data), nil)
+	if err != nil {
+		return fmt.Errorf("error reading snapshot: %v", err)
+	}
+	state := localfile.New()
+	for {
+		r, err := dr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading snapshot: %v", err)
+		}
+		if err := state.Set(context.Background(), r.AccountKey, r); err != nil {
+			return err
+		}
+	}
+	// The previous state is not shut down, as reads might still be using it. Without persistence, it holds no
+	// resources besides memory.
+	f.mu.Lock()
+	f.state = state
+	f.mu.Unlock()
+	f.setApplied(index)
+	return nil
+}
+
+// snapshot is a point-in-time copy of all records as of the log entry at index. It is persisted as the big endian
+// index followed by a dump, encrypted with keys.
+type snapshot struct {
+	index   uint64
+	records []koda.Record
+	keys    *localfile.Keyring
+}
+
+func (s *snapshot) Persist(sink hraft.SnapshotSink) error {
+	err := func() error {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, s.index)
+		w, err := dump.NewWriter(&buf, nil)
+		if err != nil {
+			return err
+		}
+		for _, r := range s.records {
+			if err := w.Write(r); err != nil {
+				return err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		sealed, err := s.keys.Seal(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		_, err = sink.Write(sealed)
+		return err
+	}()
+	if err != nil {
+		sink.Cancel()
+		return fmt.Errorf("error writing snapshot: %v", err)
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
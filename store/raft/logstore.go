@@ -0,0 +1,172 @@
+package raft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	hraft "github.com/hashicorp/raft"
+	bbolt "go.etcd.io/bbolt"
+)
+
+var (
+	logsBucket   = []byte("logs")
+	stableBucket = []byte("stable")
+)
+
+// errKeyNotFound is returned by logStore.Get for missing keys. Raft compares the error message, so it must not be
+// wrapped or changed.
+var errKeyNotFound = errors.New("not found")
+
+// logStore is a hraft.LogStore and hraft.StableStore in a bbolt file. Log entries are stored as JSON, keyed by their
+// big-endian index so they are sorted. Every write is synced to disk before it returns.
+type logStore struct {
+	db *bbolt.DB
+}
+
+// Ensure that logStore implements the Raft storage interfaces
+var (
+	_ hraft.LogStore    = (*logStore)(nil)
+	_ hraft.StableStore = (*logStore)(nil)
+)
+
+func openLogStore(path string) (*logStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening raft log %s: %v", path, err)
+	}
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(logsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(stableBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing raft log %s: %v", path, err)
+	}
+	return &logStore{db: db}, nil
+}
+
+func (s *logStore) Close() error {
+	return s.db.Close()
+}
+
+func indexKey(i uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, i)
+	return k
+}
+
+// FirstIndex returns the index of the first log entry, or 0 if the log is empty.
+func (s *logStore) FirstIndex() (uint64, error) {
+	var i uint64
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if k, _ := tx.Bucket(logsBucket).Cursor().First(); k != nil {
+			i = binary.BigEndian.Uint64(k)
+		}
+		return nil
+	})
+	return i, err
+}
+
+// LastIndex returns the index of the last log entry, or 0 if the log is empty.
+func (s *logStore) LastIndex() (uint64, error) {
+	var i uint64
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if k, _ := tx.Bucket(logsBucket).Cursor().Last(); k != nil {
+			i = binary.BigEndian.Uint64(k)
+		}
+		return nil
+	})
+	return i, err
+}
+
+// GetLog reads the log entry at index into log. It returns hraft.ErrLogNotFound if there is none.
+func (s *logStore) GetLog(index uint64, log *hraft.Log) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(logsBucket).Get(indexKey(index))
+		if v == nil {
+			return hraft.ErrLogNotFound
+		}
+		return json.Unmarshal(v, log)
+	})
+}
+
+func (s *logStore) StoreLog(log *hraft.Log) error {
+	return s.StoreLogs([]*hraft.Log{log})
+}
+
+// StoreLogs stores all logs in a single transaction.
+func (s *logStore) StoreLogs(logs []*hraft.Log) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(logsBucket)
+		for _, l := range logs {
+			v, err := json.Marshal(l)
+			if err != nil {
+				return fmt.Errorf("error encoding log at index %d: %v", l.Index, err)
+			}
+			if err := b.Put(indexKey(l.Index), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteRange deletes the log entries from min to max, inclusive.
+func (s *logStore) DeleteRange(min, max uint64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		// Keys are collected first, deleting with the cursor while iterating skips entries.
+		b := tx.Bucket(logsBucket)
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.Seek(indexKey(min)); k != nil && binary.BigEndian.Uint64(k) <= max; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *logStore) Set(key []byte, val []byte) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(stableBucket).Put(key, val)
+	})
+}
+
+// Get returns the value of key. It returns errKeyNotFound if key has not been set.
+func (s *logStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(stableBucket).Get(key)
+		if v == nil {
+			return errKeyNotFound
+		}
+		val = append([]byte(nil), v...)
+		return nil
+	})
+	return val, err
+}
+
+func (s *logStore) SetUint64(key []byte, val uint64) error {
+	return s.Set(key, indexKey(val))
+}
+
+// GetUint64 returns the value of key. It returns errKeyNotFound if key has not been set.
+func (s *logStore) GetUint64(key []byte) (uint64, error) {
+	v, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) != 8 {
+		return 0, fmt.Errorf("invalid value of %s", key)
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
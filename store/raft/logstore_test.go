@@ -0,0 +1,56 @@
+package raft
+
+import (
+	"path/filepath"
+	"testing"
+
+	hraft "github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft.db")
+	s, err := openLogStore(path)
+	if err != nil {
+		t.Fatalf("error opening log store: %v", err)
+	}
+
+	first, err := s.FirstIndex()
+	assert.NoError(t, err)
+	assert.Zero(t, first)
+	var l hraft.Log
+	assert.ErrorIs(t, s.GetLog(1, &l), hraft.ErrLogNotFound)
+
+	var logs []*hraft.Log
+	for i := uint64(1); i <= 5; i++ {
+		logs = append(logs, &hraft.Log{Index: i, Term: 1, Type: hraft.LogCommand, Data: []byte{byte(i)}})
+	}
+	assert.NoError(t, s.StoreLogs(logs))
+	assert.NoError(t, s.DeleteRange(1, 3))
+	first, err = s.FirstIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), first)
+	last, err := s.LastIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), last)
+	assert.NoError(t, s.GetLog(5, &l))
+	assert.Equal(t, *logs[4], l)
+
+	// Raft relies on the exact message for missing keys
+	_, err = s.Get([]byte("CurrentTerm"))
+	assert.EqualError(t, err, "not found")
+	assert.NoError(t, s.SetUint64([]byte("CurrentTerm"), 7))
+	assert.NoError(t, s.Close())
+
+	s, err = openLogStore(path)
+	if err != nil {
+		t.Fatalf("error reopening log store: %v", err)
+	}
+	defer s.Close()
+	term, err := s.GetUint64([]byte("CurrentTerm"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), term)
+	last, err = s.LastIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), last)
+}
@@ -0,0 +1,572 @@
+// Package raft implements a koda.Store replicated across a cluster of koda nodes with the Raft consensus algorithm.
+//
+// Every node keeps all records in an in-memory LocalFileStore. Writes are appended to the Raft log, which is stored
+// in a bbolt file, and applied by every node once a majority of nodes has persisted them. Snapshots of all records
+// compact the log. Followers forward writes to the leader, so writes can be sent to any node. Reads are served from
+// the local records of a node, which might lag behind the leader, but a node always reads its own writes.
+//
+// Nodes only talk to each other over mutually authenticated TLS, with certificates signed by the CA of the cluster.
+// Entries of the Raft log and snapshots are encrypted with the same Keyring as the data file of a LocalFileStore, so
+// all nodes need the same keys. Every node takes a snapshot as soon as it deleted a record, which compacts its Raft log
+// and replaces its previous snapshot, so the record is erased from disk. Freed pages of the log file might still hold
+// the encrypted entries until they are reused.
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	hraft "github.com/hashicorp/raft"
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/log"
+	"github.com/mindtastic/koda/store/localfile"
+)
+
+// Ensure that RaftStore implements the koda.Store interface
+var _ koda.Store = (*RaftStore)(nil)
+
+const (
+	// applyTimeout bounds writes whose context has no earlier deadline, including the wait for a leader.
+	applyTimeout = 10 * time.Second
+	// retryInterval is the time between attempts to find the leader during an election.
+	retryInterval = 50 * time.Millisecond
+	// retainSnapshots is the number of snapshots kept on disk. Previous snapshots might hold deleted records.
+	retainSnapshots = 1
+	// logCacheSize is the number of recent log entries kept in memory.
+	logCacheSize = 512
+)
+
+var (
+	ErrStoreClosed = errors.New("store is closed")
+	// ErrNoLeader is returned by writes if no leader has been elected before their deadline, for example because a
+	// majority of the nodes is unreachable.
+	ErrNoLeader  = errors.New("no raft leader")
+	errNotLeader = errors.New("node is not the raft leader")
+	// errUnreachable is returned if the leader cannot be reached. The write has not been sent, so it can be retried.
+	errUnreachable = errors.New("raft leader is unreachable")
+	// errConflict is returned by an update if the record changed since it has been read.
+	errConflict = errors.New("record changed concurrently")
+)
+
+// Peer is a node of the cluster.
+type Peer struct {
+	ID   string
+	Addr string // Address the node is reachable at by the other nodes, like koda-0.koda:7000
+}
+
+// Config configures a node of the cluster.
+type Config struct {
+	ID       string // ID of this node, must be one of Peers
+	Dir      string // Directory of the Raft log and snapshots
+	Peers    []Peer // All nodes of the cluster, including this one
+	BindAddr string // Address to listen on, defaults to the Addr of this node
+
+	// CertFile and KeyFile hold the PEM encoded TLS certificate of this node, which must be valid for the host of its
+	// Addr and for client authentication. CAFile holds the CA that signed the certificates of all nodes.
+	CertFile string
+	KeyFile  string
+	CAFile   string
+
+	// Keys encrypt the Raft log and snapshots.
+	Keys *localfile.Keyring
+}
+
+// RaftStore is a koda.Store replicated with Raft, see the package documentation. It is safe for concurrent use.
+type RaftStore struct {
+	closed     int32 // Accessed atomically
+	raft       *hraft.Raft
+	fsm        *fsm
+	stream     *listener
+	transport  *hraft.NetworkTransport
+	logs       *logStore
+	compactNow chan struct{} // Signals the compactor that a record has been deleted
+	stop       chan struct{} // Closed by Close to stop the compactor
+	shutdown   sync.Once
+}
+
+func init() {
+	koda.Register("raft", openURI)
+}
+
+// openURI opens a node for a URI like
+//
+//	raft:///data/raft?id=koda-0&peers=koda-0@koda-0.koda:7000,koda-1@koda-1.koda:7000,koda-2@koda-2.koda:7000&bind=:7000&cert=/run/secrets/raft.crt&key=/run/secrets/raft.key&ca=/run/secrets/raft-ca.crt&keyfile=/run/secrets/koda-keys
+//
+// The path is the directory of the Raft log and snapshots, peers lists all nodes as id@address and bind is optional.
+// cert, key and ca are the files of the Config. The Raft log is encrypted with the Keyring from keyfile or
+// localfile.KeysEnv, like the data file of a file:// store.
+func openURI(_ context.Context, u *url.URL) (koda.Store, error) {
+	if u.Host != "" || u.Path == "" {
+		return nil, fmt.Errorf("raft store URI must have an absolute path, like raft:///data/raft")
+	}
+	cfg := Config{Dir: u.Path}
+	for k, v := range u.Query() {
+		switch k {
+		case "id":
+			cfg.ID = v[0]
+		case "bind":
+			cfg.BindAddr = v[0]
+		case "cert":
+			cfg.CertFile = v[0]
+		case "key":
+			cfg.KeyFile = v[0]
+		case "ca":
+			cfg.CAFile = v[0]
+		case "keyfile": // Loaded by LoadKeyringForURL
+		case "peers":
+			for _, p := range strings.Split(v[0], ",") {
+				id, addr, ok := strings.Cut(p, "@")
+				if !ok || id == "" || addr == "" {
+					return nil, fmt.Errorf("invalid raft peer %q, must be id@address", p)
+				}
+				cfg.Peers = append(cfg.Peers, Peer{ID: id, Addr: addr})
+			}
+		default:
+			return nil, fmt.Errorf("unknown raft store option %q", k)
+		}
+	}
+	keys, err := localfile.LoadKeyringForURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("error loading database keys: %v", err)
+	}
+	cfg.Keys = keys
+	return Open(cfg)
+}
+
+// Open starts a node of the cluster. On its first start, the node bootstraps the cluster with cfg.Peers, afterwards
+// the membership is read from the Raft log and cfg.Peers is ignored. All nodes must be started with the same Peers.
+// Open returns before a leader has been elected, writes wait for the election.
+func Open(cfg Config) (*RaftStore, error) {
+	self, err := cfg.self()
+	if err != nil {
+		return nil, err
+	}
+	bind := cfg.BindAddr
+	if bind == "" {
+		bind = self.Addr
+	}
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s: %v", bind, err)
+	}
+	s, err := open(cfg, ln, hraft.DefaultConfig())
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// self validates cfg and returns the Peer of this node.
+func (cfg Config) self() (Peer, error) {
+	if cfg.ID == "" {
+		return Peer{}, fmt.Errorf("raft node has no ID")
+	}
+	if cfg.Dir == "" {
+		return Peer{}, fmt.Errorf("raft node has no directory")
+	}
+	var self *Peer
+	ids, addrs := make(map[string]bool), make(map[string]bool)
+	for i, p := range cfg.Peers {
+		if ids[p.ID] || addrs[p.Addr] {
+			return Peer{}, fmt.Errorf("duplicate raft peer %s@%s", p.ID, p.Addr)
+		}
+		ids[p.ID], addrs[p.Addr] = true, true
+		if p.ID == cfg.ID {
+			self = &cfg.Peers[i]
+		}
+	}
+	if self == nil {
+		return Peer{}, fmt.Errorf("raft node %s is not one of the peers", cfg.ID)
+	}
+	if cfg.Keys == nil {
+		return Peer{}, fmt.Errorf("raft node requires database keys to encrypt its log")
+	}
+	return *self, nil
+}
+
+// open starts a node listening on ln. Tests use it to run nodes with a faster rc.
+func open(cfg Config, ln net.Listener, rc *hraft.Config) (*RaftStore, error) {
+	self, err := cfg.self()
+	if err != nil {
+		return nil, err
+	}
+	serverTLS, clientTLS, err := cfg.tlsConfigs()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating path %s: %v", cfg.Dir, err)
+	}
+	logger := hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.Info, Output: logWriter{}, JSONFormat: true})
+	rc.LocalID = hraft.ServerID(cfg.ID)
+	rc.Logger = logger
+	// Snapshots compact the whole log, so deleted records do not remain in it. Followers that fall behind are sent
+	// a snapshot instead.
+	rc.TrailingLogs = 0
+
+	logs, err := openLogStore(filepath.Join(cfg.Dir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := hraft.NewFileSnapshotStoreWithLogger(cfg.Dir, retainSnapshots, logger)
+	if err != nil {
+		logs.Close()
+		return nil, fmt.Errorf("error opening raft snapshots: %v", err)
+	}
+	cache, err := hraft.NewLogCache(logCacheSize, logs)
+	if err != nil {
+		logs.Close()
+		return nil, err
+	}
+
+	s := &RaftStore{logs: logs, compactNow: make(chan struct{}, 1), stop: make(chan struct{})}
+	s.fsm = newFSM(cfg.Keys, func() {
+		select {
+		case s.compactNow <- struct{}{}:
+		default: // A compaction is already pending
+		}
+	})
+	s.stream = newListener(ln, self.Addr, serverTLS, clientTLS, s.serveForward)
+	s.transport = hraft.NewNetworkTransportWithConfig(&hraft.NetworkTransportConfig{
+		Stream:  s.stream,
+		MaxPool: 3,
+		Timeout: applyTimeout,
+		Logger:  logger,
+	})
+	existing, err := hraft.HasExistingState(cache, logs, snapshots)
+	if err == nil && !existing {
+		servers := make([]hraft.Server, len(cfg.Peers))
+		for i, p := range cfg.Peers {
+			servers[i] = hraft.Server{ID: hraft.ServerID(p.ID), Address: hraft.ServerAddress(p.Addr)}
+		}
+		err = hraft.BootstrapCluster(rc, cache, logs, snapshots, s.transport, hraft.Configuration{Servers: servers})
+	}
+	if err != nil {
+		s.transport.Close()
+		logs.Close()
+		return nil, fmt.Errorf("error bootstrapping raft cluster: %v", err)
+	}
+	if s.raft, err = hraft.NewRaft(rc, s.fsm, cache, logs, snapshots, s.transport); err != nil {
+		s.transport.Close()
+		logs.Close()
+		return nil, fmt.Errorf("error starting raft node: %v", err)
+	}
+	go s.runCompactor()
+	return s, nil
+}
+
+// runCompactor compacts the Raft log of the node whenever it deleted a record, until the node is closed.
+func (s *RaftStore) runCompactor() {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.compactNow:
+			if err := s.compact(); err != nil && !errors.Is(err, hraft.ErrRaftShutdown) {
+				log.Errorf("%v", err)
+			}
+		}
+	}
+}
+
+// compact takes a snapshot of the records of the node, which compacts its Raft log and replaces its previous snapshot.
+func (s *RaftStore) compact() error {
+	if err := s.raft.Snapshot().Error(); err != nil && !errors.Is(err, hraft.ErrNothingNewToSnapshot) {
+		return fmt.Errorf("error compacting raft log: %w", err)
+	}
+	return nil
+}
+
+// Close stops the node and closes the Raft log. A majority of the nodes must stay up for the cluster to accept
+// writes. After Close is called, all operations return ErrStoreClosed.
+func (s *RaftStore) Close() error {
+	var err error
+	s.shutdown.Do(func() {
+		atomic.StoreInt32(&s.closed, 1)
+		close(s.stop)
+		err = s.raft.Shutdown().Error()
+		if cerr := s.transport.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		if cerr := s.logs.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
+
+// Leader returns the address of the current leader, or an empty string if there is none.
+func (s *RaftStore) Leader() string {
+	return string(s.raft.Leader())
+}
+
+// State returns the Raft state of the node, like Leader or Follower.
+func (s *RaftStore) State() string {
+	return s.raft.State().String()
+}
+
+// local returns the records of the node.
+func (s *RaftStore) local() (*fsm, error) {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return nil, ErrStoreClosed
+	}
+	return s.fsm, nil
+}
+
+// apply replicates cmd and returns the record it resulted in. Followers forward cmd to the leader. During an
+// election, apply waits for a new leader until ctx is done or applyTimeout passed.
+func (s *RaftStore) apply(ctx context.Context, cmd command) (koda.Record, error) {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return koda.Record{}, ErrStoreClosed
+	}
+	ctx, cancel := context.WithTimeout(ctx, applyTimeout)
+	defer cancel()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return koda.Record{}, fmt.Errorf("error encoding command: %v", err)
+	}
+	for {
+		var r koda.Record
+		if s.raft.State() == hraft.Leader {
+			r, _, err = s.applyLocal(ctx, data)
+		} else if leader := s.raft.Leader(); leader != "" {
+			r, err = s.forward(ctx, string(leader), cmd)
+		} else {
+			err = errNotLeader
+		}
+		if !errors.Is(err, errNotLeader) && !errors.Is(err, hraft.ErrNotLeader) && !errors.Is(err, errUnreachable) {
+			return r, err
+		}
+		select {
+		case <-ctx.Done():
+			return koda.Record{}, fmt.Errorf("%w: %v", ErrNoLeader, err)
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// applyLocal encrypts data, appends it to the Raft log of the leader and waits until it has been applied. It returns
+// the result of the command and its index in the log.
+func (s *RaftStore) applyLocal(ctx context.Context, data []byte) (koda.Record, uint64, error) {
+	var timeout time.Duration
+	if d, ok := ctx.Deadline(); ok {
+		timeout = time.Until(d)
+	}
+	data, err := s.fsm.keys.Seal(data)
+	if err != nil {
+		return koda.Record{}, 0, fmt.Errorf("error encrypting write: %v", err)
+	}
+	f := s.raft.Apply(data, timeout)
+	if err := f.Error(); err != nil {
+		if err == hraft.ErrRaftShutdown {
+			return koda.Record{}, 0, ErrStoreClosed
+		}
+		return koda.Record{}, 0, fmt.Errorf("error replicating write: %w", err)
+	}
+	res := f.Response().(result)
+	return res.record, f.Index(), res.err
+}
+
+// forward sends cmd to the leader at addr. Once the leader applied cmd, forward waits until this node applied it as
+// well, so it reads its own writes. If ctx is done before, forward returns an error wrapping ctx.Err(), although the
+// write has been committed.
+func (s *RaftStore) forward(ctx context.Context, addr string, cmd command) (koda.Record, error) {
+	deadline, _ := ctx.Deadline()
+	c, err := s.stream.dial(addr, connForward, time.Until(deadline))
+	if err != nil {
+		return koda.Record{}, fmt.Errorf("%w: %v", errUnreachable, err)
+	}
+	defer c.Close()
+	c.SetDeadline(deadline)
+	if err := json.NewEncoder(c).Encode(forwardRequest{Command: cmd, Timeout: time.Until(deadline)}); err != nil {
+		return koda.Record{}, fmt.Errorf("error forwarding write to leader %s: %v", addr, err)
+	}
+	var resp forwardResponse
+	if err := json.NewDecoder(c).Decode(&resp); err != nil {
+		return koda.Record{}, fmt.Errorf("error reading reply of leader %s: %v", addr, err)
+	}
+	if resp.NotLeader {
+		return koda.Record{}, errNotLeader
+	}
+	// Failed commands are part of the log as well. Waiting for them lets a conflicting update be retried on the
+	// current record.
+	if err := s.fsm.waitApplied(ctx, resp.Index); err != nil {
+		return koda.Record{}, fmt.Errorf("write to %s is committed, but not yet applied on this node: %w", cmd.Key, err)
+	}
+	if resp.Error != "" {
+		return koda.Record{}, remoteError{msg: resp.Error, notFound: resp.NotFound, conflict: resp.Conflict}
+	}
+	return resp.Record, nil
+}
+
+// serveForward applies a command forwarded by a follower.
+func (s *RaftStore) serveForward(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(applyTimeout))
+	var req forwardRequest
+	if err := json.NewDecoder(c).Decode(&req); err != nil {
+		return
+	}
+	var resp forwardResponse
+	if s.raft.State() != hraft.Leader {
+		resp.NotLeader = true
+	} else if data, err := json.Marshal(req.Command); err != nil {
+		resp.Error = err.Error()
+	} else {
+		timeout := req.Timeout
+		if timeout <= 0 || timeout > applyTimeout {
+			timeout = applyTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		resp.Record, resp.Index, err = s.applyLocal(ctx, data)
+		cancel()
+		if errors.Is(err, hraft.ErrNotLeader) {
+			resp.NotLeader = true
+		} else if err != nil {
+			resp.Error = err.Error()
+			resp.NotFound = errors.Is(err, koda.ErrNotFound)
+			resp.Conflict = errors.Is(err, errConflict)
+		}
+	}
+	if err := json.NewEncoder(c).Encode(resp); err != nil {
+		log.Warnf("error replying to forwarded write: %v", err)
+	}
+}
+
+// Set replicates record to all nodes.
+func (s *RaftStore) Set(ctx context.Context, key koda.AccountKey, record koda.Record) error {
+	_, err := s.apply(ctx, command{Op: opSet, Key: key, Record: &record})
+	return err
+}
+
+// Get retrieves a record from the records of this node. It returns koda.ErrNotFound if the record does not exist.
+func (s *RaftStore) Get(ctx context.Context, key koda.AccountKey) (koda.Record, error) {
+	f, err := s.local()
+	if err != nil {
+		return koda.Record{}, err
+	}
+	return f.store().Get(ctx, key)
+}
+
+// Update replaces the record of key with the result of fn. fn is applied to the record of this node, the result is
+// only replicated if the leader still holds the same record. Otherwise fn is called again, once this node caught up
+// with the leader, until ctx is done or applyTimeout passed.
+func (s *RaftStore) Update(ctx context.Context, key koda.AccountKey, fn func(koda.Record) (koda.Record, error)) (koda.Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, applyTimeout)
+	defer cancel()
+	for {
+		current, err := s.Get(ctx, key)
+		if err != nil {
+			return koda.Record{}, fmt.Errorf("could not update key %s: %w", key, err)
+		}
+		r, err := fn(current.Clone())
+		if err != nil {
+			return koda.Record{}, fmt.Errorf("could not update key %s: %w", key, err)
+		}
+		r, err = s.apply(ctx, command{Op: opUpdate, Key: key, Expected: &current, Record: &r})
+		if !errors.Is(err, errConflict) {
+			return r, err
+		}
+		if ctx.Err() != nil {
+			return koda.Record{}, fmt.Errorf("could not update key %s: %w", key, err)
+		}
+	}
+}
+
+// Delete removes a record from all nodes. Every node compacts its Raft log afterwards, this node before Delete
+// returns. It returns koda.ErrNotFound if the record does not exist.
+func (s *RaftStore) Delete(ctx context.Context, key koda.AccountKey) error {
+	if _, err := s.apply(ctx, command{Op: opDelete, Key: key}); err != nil {
+		return err
+	}
+	if err := s.compact(); err != nil {
+		return fmt.Errorf("error erasing key %s from disk: %w", key, err)
+	}
+	return nil
+}
+
+// List returns up to limit AccountKeys greater than after in ascending order from the records of this node.
+func (s *RaftStore) List(ctx context.Context, after koda.AccountKey, limit int) ([]koda.AccountKey, error) {
+	f, err := s.local()
+	if err != nil {
+		return nil, err
+	}
+	return f.store().List(ctx, after, limit)
+}
+
+// Scan returns up to limit records with an AccountKey greater than after in ascending order from the records of
+// this node.
+func (s *RaftStore) Scan(ctx context.Context, after koda.AccountKey, limit int) ([]koda.Record, error) {
+	f, err := s.local()
+	if err != nil {
+		return nil, err
+	}
+	return f.store().Scan(ctx, after, limit)
+}
+
+// GetOrCreateServiceKey returns the record of key with a ServiceKey for service, as described by
+// koda.EnsureServiceKey. Existing ServiceKeys are returned without a write. Otherwise the leader applies the command
+// to its current record, so concurrent calls on different nodes never issue different ServiceKeys.
+func (s *RaftStore) GetOrCreateServiceKey(ctx context.Context, key koda.AccountKey, service string, newKey koda.ServiceKey) (koda.Record, error) {
+	if r, err := s.Get(ctx, key); err == nil {
+		if _, changed := koda.EnsureServiceKey(r, service, newKey); !changed {
+			return r, nil
+		}
+	}
+	return s.apply(ctx, command{Op: opServiceKey, Key: key, Service: service, ServiceKey: newKey})
+}
+
+// GetOrCreateSalt returns the record of key with a Salt and an epoch for service, as described by koda.EnsureSalt.
+// Like GetOrCreateServiceKey, it only writes if the record changes.
+func (s *RaftStore) GetOrCreateSalt(ctx context.Context, key koda.AccountKey, service string, salt []byte) (koda.Record, error) {
+	if r, err := s.Get(ctx, key); err == nil {
+		if _, changed := koda.EnsureSalt(r, service, salt); !changed {
+			return r, nil
+		}
+	}
+	return s.apply(ctx, command{Op: opSalt, Key: key, Service: service, Salt: salt})
+}
+
+// logWriter passes the JSON log lines of Raft to the koda logger.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	var entry map[string]interface{}
+	if err := json.Unmarshal(p, &entry); err != nil {
+		log.Infof("raft: %s", strings.TrimSpace(string(p)))
+		return len(p), nil
+	}
+	level, msg := entry["@level"], entry["@message"]
+	var fields []string
+	for k, v := range entry {
+		if !strings.HasPrefix(k, "@") {
+			fields = append(fields, fmt.Sprintf("%s=%v", k, v))
+		}
+	}
+	sort.Strings(fields)
+	line := strings.TrimSpace(fmt.Sprintf("raft: %v %s", msg, strings.Join(fields, " ")))
+	switch level {
+	case "error":
+		log.Errorf("%s", line)
+	case "warn":
+		log.Warnf("%s", line)
+	case "debug", "trace":
+		log.Debugf("%s", line)
+	default:
+		log.Infof("%s", line)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,405 @@
+package raft
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	hraft "github.com/hashicorp/raft"
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/store/localfile"
+	"github.com/mindtastic/koda/store/storetest"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCluster is an in-process cluster of nodes talking over the loopback interface.
+type testCluster struct {
+	t     *testing.T
+	ca    testCA
+	keys  *localfile.Keyring
+	peers []Peer
+	dirs  []string
+	nodes []*RaftStore // nil for stopped nodes
+}
+
+// fastConfig returns a Raft configuration with short timeouts, so elections finish quickly in tests.
+func fastConfig() *hraft.Config {
+	rc := hraft.DefaultConfig()
+	rc.HeartbeatTimeout = 100 * time.Millisecond
+	rc.ElectionTimeout = 100 * time.Millisecond
+	rc.LeaderLeaseTimeout = 50 * time.Millisecond
+	rc.CommitTimeout = 5 * time.Millisecond
+	return rc
+}
+
+func newTestCluster(t *testing.T, n int) *testCluster {
+	c := &testCluster{t: t, ca: newTestCA(t, t.TempDir()), keys: testKeys(t), nodes: make([]*RaftStore, n)}
+	lns := make([]net.Listener, n)
+	for i := range lns {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("error listening: %v", err)
+		}
+		lns[i] = ln
+		c.peers = append(c.peers, Peer{ID: fmt.Sprintf("node-%d", i), Addr: ln.Addr().String()})
+		c.dirs = append(c.dirs, t.TempDir())
+	}
+	for i, ln := range lns {
+		c.startOn(i, ln)
+	}
+	t.Cleanup(func() {
+		for i := range c.nodes {
+			c.stop(i)
+		}
+	})
+	return c
+}
+
+func (c *testCluster) startOn(i int, ln net.Listener) {
+	s, err := open(c.ca.secure(Config{ID: c.peers[i].ID, Dir: c.dirs[i], Peers: c.peers}, c.keys), ln, fastConfig())
+	if err != nil {
+		c.t.Fatalf("error starting node %d: %v", i, err)
+	}
+	c.nodes[i] = s
+}
+
+// start restarts a stopped node on its previous address and directory.
+func (c *testCluster) start(i int) {
+	ln, err := net.Listen("tcp", c.peers[i].Addr)
+	if err != nil {
+		c.t.Fatalf("error listening: %v", err)
+	}
+	c.startOn(i, ln)
+}
+
+func (c *testCluster) stop(i int) {
+	if c.nodes[i] != nil {
+		assert.NoError(c.t, c.nodes[i].Close())
+		c.nodes[i] = nil
+	}
+}
+
+// leader waits for a running node to become the leader and returns its index.
+func (c *testCluster) leader() int {
+	var leader int
+	if !eventually(func() bool {
+		for i, s := range c.nodes {
+			if s != nil && s.State() == hraft.Leader.String() {
+				leader = i
+				return true
+			}
+		}
+		return false
+	}) {
+		c.t.Fatalf("no leader elected")
+	}
+	return leader
+}
+
+// follower returns the index of a running node that is not the leader.
+func (c *testCluster) follower() int {
+	leader := c.leader()
+	for i, s := range c.nodes {
+		if s != nil && i != leader {
+			return i
+		}
+	}
+	c.t.Fatalf("no running follower")
+	return -1
+}
+
+// eventually polls cond for up to five seconds.
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return false
+}
+
+// replicated reports whether every running node has record.
+func (c *testCluster) replicated(record koda.Record) bool {
+	return eventually(func() bool {
+		for _, s := range c.nodes {
+			if s == nil {
+				continue
+			}
+			if r, err := s.Get(context.Background(), record.AccountKey); err != nil || !assert.ObjectsAreEqual(record, r) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestRaftStore(t *testing.T) {
+	c := newTestCluster(t, 3)
+	follower := c.nodes[c.follower()]
+	record := koda.Record{
+		AccountKey:  "testing",
+		ServiceKeys: map[string]koda.ServiceKey{"user-service": "key"},
+	}
+
+	_, err := follower.Get(context.Background(), record.AccountKey)
+	assert.True(t, errors.Is(err, koda.ErrNotFound))
+
+	// Followers forward writes and read their own writes
+	assert.NoError(t, follower.Set(context.Background(), record.AccountKey, record))
+	r, err := follower.Get(context.Background(), record.AccountKey)
+	assert.NoError(t, err)
+	assert.Equal(t, record, r)
+	assert.True(t, c.replicated(record))
+
+	keys, err := follower.List(context.Background(), "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.AccountKey{"testing"}, keys)
+	records, err := follower.Scan(context.Background(), "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.Record{record}, records)
+
+	assert.NoError(t, follower.Delete(context.Background(), record.AccountKey))
+	for _, s := range c.nodes {
+		assert.True(t, eventually(func() bool {
+			_, err := s.Get(context.Background(), record.AccountKey)
+			return errors.Is(err, koda.ErrNotFound)
+		}))
+	}
+	assert.True(t, errors.Is(follower.Delete(context.Background(), record.AccountKey), koda.ErrNotFound))
+	leader := c.nodes[c.leader()]
+	assert.True(t, errors.Is(leader.Delete(context.Background(), record.AccountKey), koda.ErrNotFound))
+
+	assert.NoError(t, follower.Close())
+	assert.ErrorIs(t, follower.Set(context.Background(), record.AccountKey, record), ErrStoreClosed)
+	_, err = follower.Get(context.Background(), record.AccountKey)
+	assert.ErrorIs(t, err, ErrStoreClosed)
+}
+
+func TestGetOrCreateServiceKey(t *testing.T) {
+	c := newTestCluster(t, 3)
+	const workers = 12
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		keys = make(map[koda.ServiceKey]bool)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := c.nodes[i%len(c.nodes)]
+			r, err := s.GetOrCreateServiceKey(context.Background(), "testing", "user-service", koda.ServiceKey(fmt.Sprintf("key-%d", i)))
+			assert.NoError(t, err)
+			mu.Lock()
+			keys[r.ServiceKeys["user-service"]] = true
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, keys, 1, fmt.Sprintf("issued keys: %v", keys))
+
+	r, err := c.nodes[0].GetOrCreateSalt(context.Background(), "testing", "user-service", []byte("salt"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("salt"), r.Salt)
+	assert.Equal(t, map[string]uint32{"user-service": 0}, r.Epochs)
+	assert.True(t, c.replicated(r))
+}
+
+func TestFailover(t *testing.T) {
+	c := newTestCluster(t, 3)
+	first := koda.Record{AccountKey: "first"}
+	assert.NoError(t, c.nodes[0].Set(context.Background(), first.AccountKey, first))
+	assert.True(t, c.replicated(first))
+
+	old := c.leader()
+	c.stop(old)
+	second := koda.Record{AccountKey: "second"}
+	assert.NoError(t, c.nodes[c.follower()].Set(context.Background(), second.AccountKey, second))
+	assert.NotEqual(t, old, c.leader())
+
+	// The old leader catches up after a restart
+	c.start(old)
+	assert.True(t, c.replicated(first))
+	assert.True(t, c.replicated(second))
+
+	// Without a majority, writes fail once their deadline passes
+	for i := range c.nodes {
+		if i != old {
+			c.stop(i)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, c.nodes[old].Set(ctx, "third", koda.Record{AccountKey: "third"}), ErrNoLeader)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	c := newTestCluster(t, 1)
+	c.leader()
+	first := koda.Record{AccountKey: "first", Salt: []byte("salt")}
+	assert.NoError(t, c.nodes[0].Set(context.Background(), first.AccountKey, first))
+	assert.NoError(t, c.nodes[0].raft.Snapshot().Error())
+	second := koda.Record{AccountKey: "second"}
+	assert.NoError(t, c.nodes[0].Set(context.Background(), second.AccountKey, second))
+
+	// Records are restored from the snapshot and the log following it
+	c.stop(0)
+	c.start(0)
+	assert.True(t, c.replicated(first))
+	assert.True(t, c.replicated(second))
+}
+
+func TestWaitApplied(t *testing.T) {
+	f := newFSM(testKeys(t), func() {})
+	f.setApplied(1)
+	assert.NoError(t, f.waitApplied(context.Background(), 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, f.waitApplied(ctx, 2), context.DeadlineExceeded)
+
+	go f.setApplied(2)
+	assert.NoError(t, f.waitApplied(context.Background(), 2))
+}
+
+func TestDeleteCompaction(t *testing.T) {
+	c := newTestCluster(t, 1)
+	c.leader()
+	deleted := koda.Record{AccountKey: "deleted-account", ServiceKeys: map[string]koda.ServiceKey{"diary": "deleted-service-key"}}
+	kept := koda.Record{AccountKey: "kept-account"}
+	assert.NoError(t, c.nodes[0].Set(context.Background(), deleted.AccountKey, deleted))
+	assert.NoError(t, c.nodes[0].Set(context.Background(), kept.AccountKey, kept))
+	assert.NoError(t, c.nodes[0].Delete(context.Background(), deleted.AccountKey))
+	c.stop(0)
+
+	// The log entries of the deleted record are compacted into a single snapshot
+	logs, err := openLogStore(filepath.Join(c.dirs[0], "raft.db"))
+	if assert.NoError(t, err) {
+		first, _ := logs.FirstIndex()
+		last, _ := logs.LastIndex()
+		for i := first; first > 0 && i <= last; i++ {
+			var l hraft.Log
+			assert.NoError(t, logs.GetLog(i, &l))
+			if l.Type == hraft.LogCommand {
+				data, err := c.keys.Open(l.Data)
+				assert.NoError(t, err)
+				assert.NotContains(t, string(data), deleted.AccountKey)
+			}
+		}
+		assert.NoError(t, logs.Close())
+	}
+	snapshots, err := os.ReadDir(filepath.Join(c.dirs[0], "snapshots"))
+	assert.NoError(t, err)
+	assert.Len(t, snapshots, 1)
+
+	// Nothing is written in plaintext
+	assert.NoError(t, filepath.Walk(c.dirs[0], func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		assert.NotContains(t, string(data), deleted.AccountKey, path)
+		assert.NotContains(t, string(data), kept.AccountKey, path)
+		assert.NotContains(t, string(data), "deleted-service-key", path)
+		return err
+	}))
+
+	// The compacted state is restored from the encrypted snapshot
+	c.start(0)
+	assert.True(t, c.replicated(kept))
+	_, err = c.nodes[0].Get(context.Background(), deleted.AccountKey)
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+}
+
+func TestOpenURI(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	dir := t.TempDir()
+	ca := newTestCA(t, t.TempDir())
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	assert.NoError(t, os.WriteFile(keyFile, []byte("1:"+base64.StdEncoding.EncodeToString(make([]byte, localfile.KeySize))), 0600))
+	security := "&cert=" + ca.certFile + "&key=" + ca.keyFile + "&ca=" + ca.caFile
+
+	s, err := koda.Open(context.Background(), "raft://"+dir+"?id=a&peers=a@"+addr+",b@127.0.0.1:1"+security+"&keyfile="+keyFile)
+	if assert.NoError(t, err) {
+		assert.NoError(t, s.(*RaftStore).Close())
+	}
+
+	testCases := []struct {
+		uri string
+		err string
+	}{
+		{uri: "raft://host/data", err: "raft store URI must have an absolute path"},
+		{uri: "raft://" + dir + "?peers=a@" + addr, err: "raft node has no ID"},
+		{uri: "raft://" + dir + "?id=c&peers=a@" + addr, err: "raft node c is not one of the peers"},
+		{uri: "raft://" + dir + "?id=a&peers=a@" + addr + ",a@other:7000", err: "duplicate raft peer a@other:7000"},
+		{uri: "raft://" + dir + "?id=a&peers=a", err: `invalid raft peer "a", must be id@address`},
+		{uri: "raft://" + dir + "?id=a&peers=a@" + addr + "&timeout=1s", err: `unknown raft store option "timeout"`},
+		{uri: "raft://" + dir + "?id=a&peers=a@" + addr + security, err: "raft node requires database keys to encrypt its log"},
+		{uri: "raft://" + dir + "?id=a&peers=a@" + addr + "&keyfile=" + keyFile, err: "raft node requires a TLS certificate, key and CA"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.uri, func(t *testing.T) {
+			_, err := koda.Open(context.Background(), tc.uri)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.err)
+			}
+		})
+	}
+}
+
+func TestConformance(t *testing.T) {
+	// Single node clusters, reopened on the address and directory they were first opened with
+	dir := t.TempDir()
+	ca, keys := newTestCA(t, t.TempDir()), testKeys(t)
+	addrs := make(map[string]string)
+	storetest.RunConformance(t, storetest.Factory{
+		Open: func(t *testing.T, name string) koda.Store {
+			addr, ok := addrs[name]
+			if !ok {
+				addr = "127.0.0.1:0"
+			}
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				t.Fatalf("error listening: %v", err)
+			}
+			addrs[name] = ln.Addr().String()
+			peers := []Peer{{ID: "node-0", Addr: ln.Addr().String()}}
+			s, err := open(ca.secure(Config{ID: "node-0", Dir: filepath.Join(dir, name), Peers: peers}, keys), ln, fastConfig())
+			if err != nil {
+				t.Fatalf("error starting node: %v", err)
+			}
+			t.Cleanup(func() { s.Close() })
+			if !eventually(func() bool { return s.State() == hraft.Leader.String() }) {
+				t.Fatalf("no leader elected")
+			}
+			// Wait for the log to be applied after a restart
+			if err := s.raft.Barrier(applyTimeout).Error(); err != nil {
+				t.Fatalf("error applying log: %v", err)
+			}
+			return s
+		},
+		Persistent: true,
+	})
+}
+
+func TestConformance_Follower(t *testing.T) {
+	storetest.RunConformance(t, storetest.Factory{
+		Open: func(t *testing.T, name string) koda.Store {
+			c := newTestCluster(t, 3)
+			return c.nodes[c.follower()]
+		},
+	})
+}
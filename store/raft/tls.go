@@ -0,0 +1,43 @@
+package raft
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// tlsConfigs loads the certificate of the node and the CA of the cluster. The server config requires every
+// connecting node to present a certificate signed by the CA, the client config verifies the other node against the CA
+// as well. Any holder of a certificate signed by the CA is a trusted node, so the CA must not sign anything else.
+func (cfg Config) tlsConfigs() (server, client *tls.Config, err error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" || cfg.CAFile == "" {
+		return nil, nil, errors.New("raft node requires a TLS certificate, key and CA")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading raft TLS certificate: %v", err)
+	}
+	pem, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading raft TLS CA: %v", err)
+	}
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(pem) {
+		return nil, nil, fmt.Errorf("no certificates in raft TLS CA %s", cfg.CAFile)
+	}
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca,
+		MinVersion:   tls.VersionTLS12,
+	}
+	client = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      ca,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return server, client, nil
+}
@@ -0,0 +1,136 @@
+package raft
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/store/localfile"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA holds the files of a CA and of a node certificate signed by it.
+type testCA struct {
+	certFile string
+	keyFile  string
+	caFile   string
+}
+
+// newTestCA creates a CA in dir and signs a certificate for nodes on 127.0.0.1 with it.
+func newTestCA(t *testing.T, dir string) testCA {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "koda raft CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	assert.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "koda raft node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	c := testCA{
+		certFile: filepath.Join(dir, "node.crt"),
+		keyFile:  filepath.Join(dir, "node.key"),
+		caFile:   filepath.Join(dir, "ca.crt"),
+	}
+	for path, block := range map[string]*pem.Block{
+		c.certFile: {Type: "CERTIFICATE", Bytes: der},
+		c.keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+		c.caFile:   {Type: "CERTIFICATE", Bytes: caDER},
+	} {
+		assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0600))
+	}
+	return c
+}
+
+// testKeys returns a Keyring with a single key.
+func testKeys(t *testing.T) *localfile.Keyring {
+	keys, err := localfile.ParseKeyring("1:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", localfile.KeySize))))
+	assert.NoError(t, err)
+	return keys
+}
+
+// secure returns cfg with the certificates of ca and keys.
+func (ca testCA) secure(cfg Config, keys *localfile.Keyring) Config {
+	cfg.CertFile, cfg.KeyFile, cfg.CAFile, cfg.Keys = ca.certFile, ca.keyFile, ca.caFile, keys
+	return cfg
+}
+
+func TestTLS(t *testing.T) {
+	c := newTestCluster(t, 1)
+	c.leader()
+	addr := c.peers[0].Addr
+
+	// Commands from anything but a node of the cluster are rejected
+	forward := func(conn net.Conn) {
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte{connForward})
+		json.NewEncoder(conn).Encode(forwardRequest{Command: command{Op: opSet, Key: "intruder", Record: &koda.Record{AccountKey: "intruder"}}})
+		io.Copy(io.Discard, conn)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if assert.NoError(t, err) {
+		forward(conn)
+	}
+
+	// A certificate of another CA is not accepted, even if the node is trusted
+	other := newTestCA(t, t.TempDir())
+	cert, err := tls.LoadX509KeyPair(other.certFile, other.keyFile)
+	assert.NoError(t, err)
+	ca, err := os.ReadFile(c.ca.caFile)
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	conn, err = tls.Dial("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool})
+	if err == nil {
+		forward(conn)
+	}
+
+	_, err = c.nodes[0].Get(context.Background(), "intruder")
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+
+	// Nodes require certificates and keys
+	_, err = open(Config{ID: "a", Dir: t.TempDir(), Peers: []Peer{{ID: "a", Addr: addr}}, Keys: testKeys(t)}, nil, fastConfig())
+	assert.EqualError(t, err, "raft node requires a TLS certificate, key and CA")
+	_, err = open(c.ca.secure(Config{ID: "a", Dir: t.TempDir(), Peers: []Peer{{ID: "a", Addr: addr}}}, nil), nil, fastConfig())
+	assert.EqualError(t, err, "raft node requires database keys to encrypt its log")
+}
@@ -0,0 +1,187 @@
+package raft
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	hraft "github.com/hashicorp/raft"
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/log"
+)
+
+// Connection types, sent as the first byte of every connection to a node.
+const (
+	connRaft    byte = 1
+	connForward byte = 2
+)
+
+// connTypeTimeout bounds the time until a new connection sends its type.
+const connTypeTimeout = 5 * time.Second
+
+var errListenerClosed = errors.New("listener is closed")
+
+// address is the advertised address of a node. It is not resolved, so it can be a host name.
+type address string
+
+func (a address) Network() string { return "tcp" }
+func (a address) String() string  { return string(a) }
+
+// listener accepts all connections to a node on a single address and dispatches them by their type. Raft RPCs are
+// returned by Accept, as listener is the hraft.StreamLayer of the Raft transport. Forwarded commands are passed to
+// forward. All connections use mutually authenticated TLS, so connections from anything but another node of the
+// cluster are rejected during the handshake.
+type listener struct {
+	ln        net.Listener
+	advertise address
+	server    *tls.Config
+	client    *tls.Config
+	forward   func(net.Conn)
+	raftConns chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Ensure that listener implements the hraft.StreamLayer interface
+var _ hraft.StreamLayer = (*listener)(nil)
+
+func newListener(ln net.Listener, advertise string, server, client *tls.Config, forward func(net.Conn)) *listener {
+	l := &listener{
+		ln:        ln,
+		advertise: address(advertise),
+		server:    server,
+		client:    client,
+		forward:   forward,
+		raftConns: make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *listener) run() {
+	for {
+		c, err := l.ln.Accept()
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			log.Warnf("error accepting connection: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go l.dispatch(tls.Server(c, l.server))
+	}
+}
+
+// dispatch authenticates c, reads its type and hands it to its handler.
+func (l *listener) dispatch(c *tls.Conn) {
+	var t [1]byte
+	c.SetReadDeadline(time.Now().Add(connTypeTimeout))
+	if err := c.Handshake(); err != nil {
+		log.Warnf("rejected raft connection from %s: %v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	if _, err := io.ReadFull(c, t[:]); err != nil {
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	switch t[0] {
+	case connRaft:
+		select {
+		case l.raftConns <- c:
+		case <-l.closed:
+			c.Close()
+		}
+	case connForward:
+		l.forward(c)
+	default:
+		c.Close()
+	}
+}
+
+// Accept returns the next Raft connection.
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.raftConns:
+		return c, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+// Close stops accepting connections. Open connections are closed by their handlers.
+func (l *listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.ln.Close()
+	})
+	return err
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.advertise
+}
+
+// Dial opens a Raft connection to another node.
+func (l *listener) Dial(addr hraft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return l.dial(string(addr), connRaft, timeout)
+}
+
+// dial opens a connection of type t to the node at addr, whose certificate must be valid for the host of addr.
+func (l *listener) dial(addr string, t byte, timeout time.Duration) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := l.client.Clone()
+	cfg.ServerName = host
+	c, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write([]byte{t}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// forwardRequest is a command sent by a follower to the leader.
+type forwardRequest struct {
+	Command command       `json:"command"`
+	Timeout time.Duration `json:"timeout"`
+}
+
+// forwardResponse is the reply of the leader to a forwardRequest.
+type forwardResponse struct {
+	Record    koda.Record `json:"record"`
+	Index     uint64      `json:"index"` // Index of the command in the Raft log
+	Error     string      `json:"error,omitempty"`
+	NotFound  bool        `json:"notFound,omitempty"`
+	Conflict  bool        `json:"conflict,omitempty"`
+	NotLeader bool        `json:"notLeader,omitempty"`
+}
+
+// remoteError is an error returned by the leader for a forwarded command.
+type remoteError struct {
+	msg      string
+	notFound bool
+	conflict bool
+}
+
+func (e remoteError) Error() string {
+	return e.msg
+}
+
+func (e remoteError) Is(target error) bool {
+	return (e.notFound && target == koda.ErrNotFound) || (e.conflict && target == errConflict)
+}
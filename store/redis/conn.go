@@ -0,0 +1,224 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxIdleConns is the number of connections kept open for reuse.
+	maxIdleConns = 8
+	dialTimeout  = 5 * time.Second
+)
+
+// errConflict is returned by transaction if a watched key has been modified by another client.
+var errConflict = errors.New("transaction aborted by concurrent modification")
+
+// dialer opens authenticated connections to a Redis server.
+type dialer struct {
+	addr     string
+	tls      *tls.Config // Only set for TLS connections
+	username string
+	password string
+	db       int
+}
+
+// conn is a single connection to a Redis server. It is not safe for concurrent use.
+type conn struct {
+	c      net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	broken bool // Set if reading or writing failed, the connection might be out of sync
+}
+
+func (d *dialer) dial(ctx context.Context) (*conn, error) {
+	nd := &net.Dialer{Timeout: dialTimeout}
+	var c net.Conn
+	var err error
+	if d.tls != nil {
+		c, err = (&tls.Dialer{NetDialer: nd, Config: d.tls}).DialContext(ctx, "tcp", d.addr)
+	} else {
+		c, err = nd.DialContext(ctx, "tcp", d.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+	if d.password != "" {
+		args := []string{"AUTH", d.password}
+		if d.username != "" {
+			args = []string{"AUTH", d.username, d.password}
+		}
+		if _, err := cn.do(ctx, args...); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("error authenticating: %v", err)
+		}
+	}
+	if d.db != 0 {
+		if _, err := cn.do(ctx, "SELECT", strconv.Itoa(d.db)); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("error selecting database %d: %v", d.db, err)
+		}
+	}
+	return cn, nil
+}
+
+// setDeadline bounds the following reads and writes by the deadline of ctx, if any.
+func (c *conn) setDeadline(ctx context.Context) error {
+	d, _ := ctx.Deadline()
+	return c.check(c.c.SetDeadline(d))
+}
+
+// check marks c as broken if err is not nil.
+func (c *conn) check(err error) error {
+	if err != nil {
+		c.broken = true
+	}
+	return err
+}
+
+// send buffers a command. It is written to the server by the next flush.
+func (c *conn) send(args ...string) error {
+	return c.check(writeCommand(c.w, args...))
+}
+
+func (c *conn) flush() error {
+	return c.check(c.w.Flush())
+}
+
+// receive reads the reply to the next sent command. An error reply is returned as respError.
+func (c *conn) receive() (interface{}, error) {
+	v, err := readReply(c.r)
+	if err != nil {
+		return nil, c.check(err)
+	}
+	if e, ok := v.(respError); ok {
+		return nil, e
+	}
+	return v, nil
+}
+
+// do sends a single command and returns its reply.
+func (c *conn) do(ctx context.Context, args ...string) (interface{}, error) {
+	if err := c.setDeadline(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+	return c.receive()
+}
+
+// transaction runs cmds in a MULTI/EXEC block and returns their replies. If keys have been watched with WATCH
+// before and any of them has been modified since, it returns errConflict.
+func (c *conn) transaction(ctx context.Context, cmds ...[]string) ([]interface{}, error) {
+	if err := c.setDeadline(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.send("MULTI"); err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		if err := c.send(cmd...); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.send("EXEC"); err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+	// Read all replies before returning an error, so the connection stays in sync.
+	var queueErr error
+	for i := 0; i <= len(cmds); i++ {
+		if _, err := c.receive(); err != nil && queueErr == nil {
+			queueErr = err
+		}
+	}
+	v, err := c.receive()
+	if queueErr != nil {
+		return nil, queueErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, errConflict
+	}
+	replies, ok := v.([]interface{})
+	if !ok || len(replies) != len(cmds) {
+		return nil, fmt.Errorf("%w: unexpected EXEC reply", errProtocol)
+	}
+	for _, r := range replies {
+		if e, ok := r.(respError); ok {
+			return nil, e
+		}
+	}
+	return replies, nil
+}
+
+// pool keeps idle connections for reuse. It is safe for concurrent use.
+type pool struct {
+	dialer *dialer
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+// get returns an idle connection or dials a new one.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrStoreClosed
+	}
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+	return p.dialer.dial(ctx)
+}
+
+// put returns c to the pool. Broken connections are closed.
+func (p *pool) put(c *conn) {
+	if c.broken {
+		c.c.Close()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || len(p.idle) >= maxIdleConns {
+		c.c.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+// close closes all idle connections. Connections in use are closed when they are returned.
+func (p *pool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	var err error
+	for _, c := range p.idle {
+		if cerr := c.c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	p.idle = nil
+	return err
+}
@@ -0,0 +1,308 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeServer is an in-process Redis server implementing the commands used by RedisStore, including WATCH/MULTI/EXEC
+// semantics. It keeps all data in memory and ignores SELECT.
+type fakeServer struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	hashes   map[string]map[string][]byte
+	zsets    map[string]map[string]struct{}
+	versions map[string]uint64 // Incremented on every write of a key, for WATCH
+	commands []string          // Names of all executed commands
+}
+
+// nullArray is the null array reply of an aborted EXEC.
+type nullArray struct{}
+
+func newFakeServer(t *testing.T, password string) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error starting fake redis server: %v", err)
+	}
+	s := &fakeServer{
+		ln:       ln,
+		password: password,
+		hashes:   make(map[string]map[string][]byte),
+		zsets:    make(map[string]map[string]struct{}),
+		versions: make(map[string]uint64),
+	}
+	var wg sync.WaitGroup
+	var connsMu sync.Mutex
+	var conns []net.Conn
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			connsMu.Lock()
+			conns = append(conns, c)
+			connsMu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serve(c)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		connsMu.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		connsMu.Unlock()
+		wg.Wait()
+	})
+	return s
+}
+
+func (s *fakeServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeServer) serve(c net.Conn) {
+	defer c.Close()
+	r, w := bufio.NewReader(c), bufio.NewWriter(c)
+	authenticated := s.password == ""
+	watched := make(map[string]uint64)
+	var multi bool
+	var queue [][]string
+
+	for {
+		v, err := readReply(r)
+		if err != nil {
+			return
+		}
+		parts, ok := v.([]interface{})
+		if !ok || len(parts) == 0 {
+			return
+		}
+		args := make([]string, len(parts))
+		for i, p := range parts {
+			b, _ := p.([]byte)
+			args[i] = string(b)
+		}
+
+		var reply interface{}
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			if args[len(args)-1] != s.password || s.password == "" {
+				reply = respError("WRONGPASS invalid username-password pair or user is disabled.")
+				break
+			}
+			authenticated = true
+			reply = "OK"
+		case !authenticated:
+			reply = respError("NOAUTH Authentication required.")
+		case cmd == "MULTI":
+			multi, queue = true, nil
+			reply = "OK"
+		case cmd == "EXEC":
+			if !multi {
+				reply = respError("ERR EXEC without MULTI")
+				break
+			}
+			s.mu.Lock()
+			reply = nullArray{}
+			if s.unchanged(watched) {
+				replies := make([]interface{}, len(queue))
+				for i, q := range queue {
+					replies[i] = s.exec(q)
+				}
+				reply = replies
+			}
+			s.mu.Unlock()
+			multi, queue, watched = false, nil, make(map[string]uint64)
+		case cmd == "DISCARD":
+			multi, queue, watched = false, nil, make(map[string]uint64)
+			reply = "OK"
+		case cmd == "WATCH" && !multi:
+			s.mu.Lock()
+			for _, k := range args[1:] {
+				watched[k] = s.versions[k]
+			}
+			s.mu.Unlock()
+			reply = "OK"
+		case cmd == "UNWATCH":
+			watched = make(map[string]uint64)
+			reply = "OK"
+		case multi:
+			queue = append(queue, args)
+			reply = "QUEUED"
+		default:
+			s.mu.Lock()
+			reply = s.exec(args)
+			s.mu.Unlock()
+		}
+		writeReply(w, reply)
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// unchanged reports whether none of the watched keys has been written. s.mu must be held.
+func (s *fakeServer) unchanged(watched map[string]uint64) bool {
+	for k, v := range watched {
+		if s.versions[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// exec executes a single command. s.mu must be held.
+func (s *fakeServer) exec(args []string) interface{} {
+	cmd := strings.ToUpper(args[0])
+	s.commands = append(s.commands, cmd)
+	wrongArgs := respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+	switch cmd {
+	case "PING":
+		return "PONG"
+	case "SELECT":
+		return "OK"
+	case "HGETALL":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		var fields []string
+		for f := range s.hashes[args[1]] {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		reply := []interface{}{}
+		for _, f := range fields {
+			reply = append(reply, []byte(f), s.hashes[args[1]][f])
+		}
+		return reply
+	case "HSET":
+		if len(args) < 4 || len(args)%2 != 0 {
+			return wrongArgs
+		}
+		h, ok := s.hashes[args[1]]
+		if !ok {
+			h = make(map[string][]byte)
+			s.hashes[args[1]] = h
+		}
+		var added int64
+		for i := 2; i < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				added++
+			}
+			h[args[i]] = []byte(args[i+1])
+		}
+		s.versions[args[1]]++
+		return added
+	case "DEL":
+		var deleted int64
+		for _, k := range args[1:] {
+			_, isHash := s.hashes[k]
+			_, isSet := s.zsets[k]
+			if isHash || isSet {
+				deleted++
+				delete(s.hashes, k)
+				delete(s.zsets, k)
+				s.versions[k]++
+			}
+		}
+		return deleted
+	case "ZADD":
+		if len(args) != 4 {
+			return wrongArgs
+		}
+		z, ok := s.zsets[args[1]]
+		if !ok {
+			z = make(map[string]struct{})
+			s.zsets[args[1]] = z
+		}
+		s.versions[args[1]]++
+		if _, ok := z[args[3]]; ok {
+			return int64(0)
+		}
+		z[args[3]] = struct{}{}
+		return int64(1)
+	case "ZREM":
+		if len(args) != 3 {
+			return wrongArgs
+		}
+		if _, ok := s.zsets[args[1]][args[2]]; !ok {
+			return int64(0)
+		}
+		delete(s.zsets[args[1]], args[2])
+		s.versions[args[1]]++
+		return int64(1)
+	case "ZRANGEBYLEX":
+		if len(args) != 7 || args[3] != "+" || strings.ToUpper(args[4]) != "LIMIT" {
+			return respError("ERR syntax error")
+		}
+		offset, _ := strconv.Atoi(args[5])
+		count, _ := strconv.Atoi(args[6])
+		var members []string
+		for m := range s.zsets[args[1]] {
+			switch min := args[2]; {
+			case min == "-":
+			case strings.HasPrefix(min, "(") && m > min[1:]:
+			case strings.HasPrefix(min, "[") && m >= min[1:]:
+			default:
+				continue
+			}
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		reply := []interface{}{}
+		for i, m := range members {
+			if i >= offset && (count < 0 || len(reply) < count) {
+				reply = append(reply, []byte(m))
+			}
+		}
+		return reply
+	}
+	return respError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+}
+
+// executed returns the names of all commands executed so far.
+func (s *fakeServer) executed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func writeReply(w *bufio.Writer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case respError:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case nil:
+		fmt.Fprint(w, "$-1\r\n")
+	case nullArray:
+		fmt.Fprint(w, "*-1\r\n")
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/mindtastic/koda"
+	"github.com/mindtastic/koda/store/storetest"
+	"github.com/stretchr/testify/assert"
+)
+
+// uriEnv points the tests to a Redis server instead of the in-process fake. Every test uses its own key prefix and
+// leaves its keys behind. A disposable server can be started with:
+//
+//	docker run --rm -p 6379:6379 redis:7
+//	KODA_REDIS_URI="redis://localhost:6379/15" go test ./store/redis
+const uriEnv = "KODA_REDIS_URI"
+
+func newTestStore(t *testing.T) *RedisStore {
+	uri := os.Getenv(uriEnv)
+	if uri == "" {
+		uri = "redis://" + newFakeServer(t, "").addr()
+	}
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		t.Fatalf("error generating prefix: %v", err)
+	}
+	s, err := Open(context.Background(), uri+"?prefix=koda-test-"+id+":")
+	if err != nil {
+		t.Fatalf("error opening store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestRedisStore(t *testing.T) {
+	s := newTestStore(t)
+	record := koda.Record{
+		AccountKey:  "testing",
+		ServiceKeys: map[string]koda.ServiceKey{"user-service": "key"},
+	}
+
+	_, err := s.Get(context.Background(), record.AccountKey)
+	assert.True(t, errors.Is(err, koda.ErrNotFound))
+
+	assert.NoError(t, s.Set(context.Background(), record.AccountKey, record))
+	r, err := s.Get(context.Background(), record.AccountKey)
+	assert.NoError(t, err)
+	assert.Equal(t, record, r)
+
+	// Set replaces the whole record, including removed services
+	record.ServiceKeys = map[string]koda.ServiceKey{"diary-service": "other"}
+	assert.NoError(t, s.Set(context.Background(), record.AccountKey, record))
+	r, err = s.Get(context.Background(), record.AccountKey)
+	assert.NoError(t, err)
+	assert.Equal(t, record, r)
+
+	assert.NoError(t, s.Delete(context.Background(), record.AccountKey))
+	_, err = s.Get(context.Background(), record.AccountKey)
+	assert.True(t, errors.Is(err, koda.ErrNotFound))
+	assert.True(t, errors.Is(s.Delete(context.Background(), record.AccountKey), koda.ErrNotFound))
+	keys, err := s.List(context.Background(), "", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, s.Set(ctx, record.AccountKey, record), context.Canceled)
+
+	assert.NoError(t, s.Close())
+	assert.ErrorIs(t, s.Set(context.Background(), record.AccountKey, record), ErrStoreClosed)
+}
+
+func TestEncodeRecord(t *testing.T) {
+	at := time.Date(2022, 5, 1, 12, 0, 0, 123, time.UTC)
+	record := koda.Record{
+		AccountKey:         "testing",
+		Inactive:           true,
+		DeactivatedAt:      &at,
+		DeactivationReason: "deletion requested",
+		ServiceKeys:        map[string]koda.ServiceKey{"user-service": "key", "service:with:colons": "other"},
+		KeyHistory:         []koda.RotatedKey{{Service: "user-service", Key: "old", RotatedAt: at, Reason: "leaked"}},
+		Salt:               []byte{0, 1, 2, '\r', '\n', 255},
+		Epochs:             map[string]uint32{"diary-service": 3},
+	}
+
+	fields := encodeRecord(record)
+	reply := make([]interface{}, len(fields))
+	for i, f := range fields {
+		reply[i] = []byte(f)
+	}
+	decoded, err := decodeRecord(reply)
+	assert.NoError(t, err)
+	assert.Equal(t, record, decoded)
+
+	_, err = decodeRecord([]interface{}{})
+	assert.ErrorIs(t, err, koda.ErrNotFound)
+	_, err = decodeRecord([]interface{}{[]byte(fieldEpochPrefix + "user-service"), []byte("-1")})
+	assert.Error(t, err)
+}
+
+func TestGetOrCreateServiceKey(t *testing.T) {
+	s := newTestStore(t)
+	const workers = 16
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		keys = make(map[koda.ServiceKey]bool)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := uuid.GenerateUUID()
+			assert.NoError(t, err)
+			r, err := s.GetOrCreateServiceKey(context.Background(), "testing", "user-service", koda.ServiceKey(id))
+			assert.NoError(t, err)
+			mu.Lock()
+			keys[r.ServiceKeys["user-service"]] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, keys, 1, fmt.Sprintf("issued keys: %v", keys))
+
+	r, err := s.Get(context.Background(), "testing")
+	assert.NoError(t, err)
+	assert.Equal(t, koda.AccountKey("testing"), r.AccountKey)
+	assert.True(t, keys[r.ServiceKeys["user-service"]])
+
+	// Inactive records do not get new ServiceKeys
+	r.Inactive = true
+	assert.NoError(t, s.Set(context.Background(), "testing", r))
+	r, err = s.GetOrCreateServiceKey(context.Background(), "testing", "diary-service", "new")
+	assert.NoError(t, err)
+	assert.NotContains(t, r.ServiceKeys, "diary-service")
+}
+
+func TestGetOrCreateSalt(t *testing.T) {
+	s := newTestStore(t)
+	r, err := s.GetOrCreateSalt(context.Background(), "testing", "user-service", []byte("first"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), r.Salt)
+	assert.Equal(t, map[string]uint32{"user-service": 0}, r.Epochs)
+
+	r, err = s.GetOrCreateSalt(context.Background(), "testing", "diary-service", []byte("second"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), r.Salt)
+	assert.Equal(t, map[string]uint32{"user-service": 0, "diary-service": 0}, r.Epochs)
+
+	stored, err := s.Get(context.Background(), "testing")
+	assert.NoError(t, err)
+	assert.Equal(t, r, stored)
+}
+
+func TestGetOrCreate_Unchanged(t *testing.T) {
+	fake := newFakeServer(t, "")
+	s, err := Open(context.Background(), "redis://"+fake.addr())
+	assert.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.GetOrCreateServiceKey(context.Background(), "testing", "user-service", "key")
+	assert.NoError(t, err)
+	before := len(fake.executed())
+	r, err := s.GetOrCreateServiceKey(context.Background(), "testing", "user-service", "other")
+	assert.NoError(t, err)
+	assert.Equal(t, koda.ServiceKey("key"), r.ServiceKeys["user-service"])
+	// Existing ServiceKeys are returned without writing
+	assert.Equal(t, []string{"HGETALL"}, fake.executed()[before:])
+}
+
+func TestList(t *testing.T) {
+	s := newTestStore(t)
+	// "B" sorts before "a" bytewise
+	for _, k := range []koda.AccountKey{"a", "B", "c"} {
+		assert.NoError(t, s.Set(context.Background(), k, koda.Record{AccountKey: k}))
+	}
+
+	keys, err := s.List(context.Background(), "", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.AccountKey{"B", "a"}, keys)
+	keys, err = s.List(context.Background(), "a", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.AccountKey{"c"}, keys)
+
+	records, err := s.Scan(context.Background(), "B", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.Record{{AccountKey: "a"}}, records)
+
+	var walked []koda.AccountKey
+	assert.NoError(t, koda.Walk(context.Background(), s, 2, func(r koda.Record) error {
+		walked = append(walked, r.AccountKey)
+		return nil
+	}))
+	assert.Equal(t, []koda.AccountKey{"B", "a", "c"}, walked)
+}
+
+func TestOpen(t *testing.T) {
+	fake := newFakeServer(t, "secret")
+
+	s, err := koda.Open(context.Background(), "redis://:secret@"+fake.addr()+"/2?prefix=custom:")
+	assert.NoError(t, err)
+	rs := s.(*RedisStore)
+	assert.Equal(t, "custom:", rs.prefix)
+	assert.Equal(t, 2, rs.pool.dialer.db)
+	assert.NoError(t, rs.Set(context.Background(), "testing", koda.Record{AccountKey: "testing"}))
+	assert.Contains(t, fake.hashes, "custom:record:testing")
+	assert.NoError(t, rs.Close())
+
+	s, err = koda.Open(context.Background(), "redis://secret@"+fake.addr())
+	assert.NoError(t, err)
+	assert.NoError(t, s.(*RedisStore).Close())
+
+	testCases := []struct {
+		uri string
+		err string
+	}{
+		{uri: "redis://" + fake.addr(), err: "error connecting to redis: NOAUTH Authentication required."},
+		{uri: "redis://:wrong@" + fake.addr(), err: "error connecting to redis: error authenticating: WRONGPASS"},
+		{uri: "redis:///0", err: "redis URI must have a host"},
+		{uri: "redis://" + fake.addr() + "/db", err: `invalid redis database "db"`},
+		{uri: "redis://" + fake.addr() + "?timeout=1s", err: `unknown redis store option "timeout"`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.uri, func(t *testing.T) {
+			_, err := koda.Open(context.Background(), tc.uri)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.err)
+			}
+		})
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	testCases := []struct {
+		name     string
+		data     string
+		expected interface{}
+		err      string
+	}{
+		{name: "simple string", data: "+OK\r\n", expected: "OK"},
+		{name: "error", data: "-ERR failed\r\n", expected: respError("ERR failed")},
+		{name: "integer", data: ":42\r\n", expected: int64(42)},
+		{name: "bulk string", data: "$5\r\na\r\nbc\r\n", expected: []byte("a\r\nbc")},
+		{name: "null bulk string", data: "$-1\r\n", expected: nil},
+		{name: "array", data: "*2\r\n:1\r\n$1\r\na\r\n", expected: []interface{}{int64(1), []byte("a")}},
+		{name: "null array", data: "*-1\r\n", expected: nil},
+		{name: "unknown type", data: "?\r\n", err: "redis protocol error: unknown reply type '?'"},
+		{name: "missing CR", data: "+OK\n", err: "redis protocol error: line not terminated by CRLF"},
+		{name: "invalid length", data: "$x\r\n", err: `redis protocol error: invalid bulk length "x"`},
+		{name: "unterminated bulk string", data: "$1\r\nab\r\n", err: "redis protocol error: unterminated bulk string"},
+		{name: "truncated", data: "*2\r\n:1\r\n", err: "EOF"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := readReply(bufio.NewReader(strings.NewReader(tc.data)))
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, v)
+		})
+	}
+}
+
+func TestConformance(t *testing.T) {
+	uri := os.Getenv(uriEnv)
+	if uri == "" {
+		uri = "redis://" + newFakeServer(t, "").addr()
+	}
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		t.Fatalf("error generating prefix: %v", err)
+	}
+	storetest.RunConformance(t, storetest.Factory{
+		Open: func(t *testing.T, name string) koda.Store {
+			s, err := Open(context.Background(), uri+"?prefix=koda-test-"+id+"-"+name+":")
+			if err != nil {
+				t.Fatalf("error opening store: %v", err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		},
+		Persistent: true,
+	})
+}
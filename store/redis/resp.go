@@ -0,0 +1,107 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// maxBulkSize limits the size of a single bulk string read from the server, to bound memory on a broken connection.
+const maxBulkSize = 64 << 20
+
+// errProtocol is returned if the server sends a malformed reply. The connection cannot be used afterwards.
+var errProtocol = errors.New("redis protocol error")
+
+// respError is an error reply of the server. Unlike other errors, it leaves the connection usable.
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+// writeCommand writes a command as a RESP array of bulk strings. Arguments are binary safe.
+func writeCommand(w *bufio.Writer, args ...string) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, a := range args {
+		if _, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readReply reads a single RESP reply. Simple strings are returned as string, integers as int64, bulk strings as
+// []byte and arrays as []interface{}. Null bulk strings and null arrays are returned as nil. Error replies are returned
+// as respError values, not as errors, so they can be part of an array.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("%w: empty reply", errProtocol)
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid integer %q", errProtocol, line[1:])
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < -1 || n > maxBulkSize {
+			return nil, fmt.Errorf("%w: invalid bulk length %q", errProtocol, line[1:])
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if b[n] != '\r' || b[n+1] != '\n' {
+			return nil, fmt.Errorf("%w: unterminated bulk string", errProtocol)
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("%w: invalid array length %q", errProtocol, line[1:])
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("%w: unknown reply type %q", errProtocol, line[0])
+}
+
+// readLine reads a line terminated by CRLF and returns it without the terminator.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("%w: line too long", errProtocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("%w: line not terminated by CRLF", errProtocol)
+	}
+	return line[:len(line)-2], nil
+}
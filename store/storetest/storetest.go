@@ -0,0 +1,475 @@
+// Package storetest implements a conformance test suite for koda.Store implementations.
+//
+// A backend runs the suite from its tests with a Factory opening its Stores:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.RunConformance(t, storetest.Factory{
+//			Open: func(t *testing.T, name string) koda.Store { ... },
+//		})
+//	}
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mindtastic/koda"
+	"github.com/stretchr/testify/assert"
+)
+
+// Factory opens the Stores under test.
+type Factory struct {
+	// Open opens the Store named name, failing t if it cannot. Every test uses a different name, which is unique
+	// within a run of RunConformance and safe to use as a file name. The Store must be empty when it is opened for
+	// the first time. Open should register a cleanup with t to close the Store, the suite closes some Stores itself, so
+	// closing must be idempotent.
+	Open func(t *testing.T, name string) koda.Store
+
+	// Persistent is set if a Store that has been closed and opened again with the same name returns the same
+	// records. Persistence is only tested if it is set.
+	Persistent bool
+}
+
+// RunConformance runs the conformance tests as subtests of t. Records are compared leniently: empty and nil maps and
+// slices are equal, as are equal times in different locations.
+func RunConformance(t *testing.T, f Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s koda.Store)
+	}{
+		{name: "NotFound", fn: testNotFound},
+		{name: "SetGet", fn: testSetGet},
+		{name: "Overwrite", fn: testOverwrite},
+		{name: "Delete", fn: testDelete},
+		{name: "Isolation", fn: testIsolation},
+		{name: "ListScan", fn: testListScan},
+		{name: "GetOrCreateServiceKey", fn: testGetOrCreateServiceKey},
+		{name: "GetOrCreateSalt", fn: testGetOrCreateSalt},
+		{name: "Update", fn: testUpdate},
+		{name: "Concurrency", fn: testConcurrency},
+		{name: "Closed", fn: testClosed},
+	}
+	for i, tc := range tests {
+		name := fmt.Sprintf("conformance-%d", i)
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, f.Open(t, name))
+		})
+	}
+	t.Run("Persistence", func(t *testing.T) {
+		if !f.Persistent {
+			t.Skip("store is not persistent")
+		}
+		testPersistence(t, f, fmt.Sprintf("conformance-%d", len(tests)))
+	})
+}
+
+// testRecord returns a record with every field set.
+func testRecord(key koda.AccountKey) koda.Record {
+	at := time.Date(2022, 6, 1, 12, 0, 0, 123000, time.UTC)
+	return koda.Record{
+		AccountKey:         key,
+		Inactive:           true,
+		DeactivatedAt:      &at,
+		DeactivationReason: "deletion requested",
+		ServiceKeys:        map[string]koda.ServiceKey{"user-service": "key", "diary-service": "other"},
+		KeyHistory:         []koda.RotatedKey{{Service: "user-service", Key: "old", RotatedAt: at, Reason: "leaked"}},
+		Salt:               []byte{0, 1, 2, '\n', 255},
+		Epochs:             map[string]uint32{"chat-service": 2},
+	}
+}
+
+// normalize returns a copy of r with empty maps and slices set to nil and all times in UTC.
+func normalize(r koda.Record) koda.Record {
+	r = r.Clone()
+	if len(r.ServiceKeys) == 0 {
+		r.ServiceKeys = nil
+	}
+	if len(r.Epochs) == 0 {
+		r.Epochs = nil
+	}
+	if len(r.KeyHistory) == 0 {
+		r.KeyHistory = nil
+	}
+	if len(r.Salt) == 0 {
+		r.Salt = nil
+	}
+	if r.DeactivatedAt != nil {
+		at := r.DeactivatedAt.UTC().Round(0)
+		r.DeactivatedAt = &at
+	}
+	for i := range r.KeyHistory {
+		r.KeyHistory[i].RotatedAt = r.KeyHistory[i].RotatedAt.UTC().Round(0)
+	}
+	return r
+}
+
+// assertRecord asserts that actual equals expected, compared leniently.
+func assertRecord(t *testing.T, expected, actual koda.Record) bool {
+	t.Helper()
+	return assert.Equal(t, normalize(expected), normalize(actual))
+}
+
+// assertStored asserts that s holds expected.
+func assertStored(t *testing.T, s koda.Store, expected koda.Record) bool {
+	t.Helper()
+	r, err := s.Get(context.Background(), expected.AccountKey)
+	return assert.NoError(t, err) && assertRecord(t, expected, r)
+}
+
+// closeStore closes s. It reports false if s cannot be closed.
+func closeStore(s koda.Store) (bool, error) {
+	switch c := s.(type) {
+	case interface{ Shutdown() error }:
+		return true, c.Shutdown()
+	case io.Closer:
+		return true, c.Close()
+	}
+	return false, nil
+}
+
+func testNotFound(t *testing.T, s koda.Store) {
+	ctx := context.Background()
+	_, err := s.Get(ctx, "missing")
+	assert.True(t, errors.Is(err, koda.ErrNotFound), "Get of a missing record must return ErrNotFound, got %v", err)
+	err = s.Delete(ctx, "missing")
+	assert.True(t, errors.Is(err, koda.ErrNotFound), "Delete of a missing record must return ErrNotFound, got %v", err)
+	keys, err := s.List(ctx, "", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+	records, err := s.Scan(ctx, "", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+func testSetGet(t *testing.T, s koda.Store) {
+	record := testRecord("testing")
+	assert.NoError(t, s.Set(context.Background(), record.AccountKey, record))
+	assertStored(t, s, record)
+
+	minimal := koda.Record{AccountKey: "minimal"}
+	assert.NoError(t, s.Set(context.Background(), minimal.AccountKey, minimal))
+	assertStored(t, s, minimal)
+
+	// AccountKeys are binary safe
+	odd := koda.Record{AccountKey: "with spaces:and/slashes\x00"}
+	assert.NoError(t, s.Set(context.Background(), odd.AccountKey, odd))
+	assertStored(t, s, odd)
+}
+
+func testOverwrite(t *testing.T, s koda.Store) {
+	record := testRecord("testing")
+	assert.NoError(t, s.Set(context.Background(), record.AccountKey, record))
+
+	// Set replaces the whole record, fields missing in the new record are removed
+	replaced := koda.Record{AccountKey: "testing", ServiceKeys: map[string]koda.ServiceKey{"other-service": "new"}}
+	assert.NoError(t, s.Set(context.Background(), replaced.AccountKey, replaced))
+	assertStored(t, s, replaced)
+	keys, err := s.List(context.Background(), "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.AccountKey{"testing"}, keys)
+}
+
+func testDelete(t *testing.T, s koda.Store) {
+	ctx := context.Background()
+	for _, k := range []koda.AccountKey{"a", "b"} {
+		assert.NoError(t, s.Set(ctx, k, koda.Record{AccountKey: k}))
+	}
+	assert.NoError(t, s.Delete(ctx, "a"))
+	_, err := s.Get(ctx, "a")
+	assert.True(t, errors.Is(err, koda.ErrNotFound), "Get of a deleted record must return ErrNotFound, got %v", err)
+	assert.True(t, errors.Is(s.Delete(ctx, "a"), koda.ErrNotFound))
+	assertStored(t, s, koda.Record{AccountKey: "b"})
+	keys, err := s.List(ctx, "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.AccountKey{"b"}, keys)
+}
+
+func testIsolation(t *testing.T, s koda.Store) {
+	ctx := context.Background()
+	record := testRecord("testing")
+	assert.NoError(t, s.Set(ctx, record.AccountKey, record))
+
+	// Modifying the record passed to Set does not modify the stored record
+	record.ServiceKeys["user-service"] = "modified"
+	record.Epochs["chat-service"] = 9
+	record.Salt[0] = 'x'
+	record.KeyHistory[0].Key = "modified"
+	assertStored(t, s, testRecord("testing"))
+
+	// Modifying returned records does not modify the stored record
+	modify := func(r koda.Record) {
+		r.ServiceKeys["user-service"] = "modified"
+		r.Epochs["chat-service"] = 9
+		r.Salt[0] = 'x'
+		r.KeyHistory[0].Key = "modified"
+	}
+	r, err := s.Get(ctx, "testing")
+	if assert.NoError(t, err) {
+		modify(r)
+	}
+	records, err := s.Scan(ctx, "", 10)
+	if assert.NoError(t, err) && assert.Len(t, records, 1) {
+		modify(records[0])
+	}
+	r, err = s.GetOrCreateServiceKey(ctx, "testing", "user-service", "new")
+	if assert.NoError(t, err) {
+		modify(r)
+	}
+	assertStored(t, s, testRecord("testing"))
+}
+
+func testListScan(t *testing.T, s koda.Store) {
+	ctx := context.Background()
+	// Keys are ordered bytewise, "B" sorts before "a"
+	for _, k := range []koda.AccountKey{"c", "a", "B", "ab"} {
+		assert.NoError(t, s.Set(ctx, k, koda.Record{AccountKey: k}))
+	}
+
+	testCases := []struct {
+		after    koda.AccountKey
+		limit    int
+		expected []koda.AccountKey
+	}{
+		{after: "", limit: 10, expected: []koda.AccountKey{"B", "a", "ab", "c"}},
+		{after: "", limit: 2, expected: []koda.AccountKey{"B", "a"}},
+		{after: "a", limit: 2, expected: []koda.AccountKey{"ab", "c"}},
+		{after: "aa", limit: 10, expected: []koda.AccountKey{"ab", "c"}},
+		{after: "c", limit: 10, expected: nil},
+	}
+	for _, tc := range testCases {
+		keys, err := s.List(ctx, tc.after, tc.limit)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprint(tc.expected), fmt.Sprint(keys), "List(%q, %d)", tc.after, tc.limit)
+
+		records, err := s.Scan(ctx, tc.after, tc.limit)
+		assert.NoError(t, err)
+		scanned := make([]koda.AccountKey, len(records))
+		for i, r := range records {
+			scanned[i] = r.AccountKey
+		}
+		assert.Equal(t, fmt.Sprint(tc.expected), fmt.Sprint(scanned), "Scan(%q, %d)", tc.after, tc.limit)
+	}
+
+	var walked []koda.AccountKey
+	assert.NoError(t, koda.Walk(ctx, s, 1, func(r koda.Record) error {
+		walked = append(walked, r.AccountKey)
+		return nil
+	}))
+	assert.Equal(t, []koda.AccountKey{"B", "a", "ab", "c"}, walked)
+}
+
+func testGetOrCreateServiceKey(t *testing.T, s koda.Store) {
+	ctx := context.Background()
+	const workers = 16
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		keys = make(map[koda.ServiceKey]bool)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err := s.GetOrCreateServiceKey(ctx, "testing", "user-service", koda.ServiceKey(fmt.Sprintf("key-%d", i)))
+			if assert.NoError(t, err) {
+				mu.Lock()
+				keys[r.ServiceKeys["user-service"]] = true
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, keys, 1, "concurrent calls must issue a single ServiceKey, issued %v", keys)
+
+	r, err := s.Get(ctx, "testing")
+	if assert.NoError(t, err) {
+		assert.Equal(t, koda.AccountKey("testing"), r.AccountKey)
+		assert.True(t, keys[r.ServiceKeys["user-service"]])
+	}
+
+	// Other services get their own key, inactive records get none
+	r, err = s.GetOrCreateServiceKey(ctx, "testing", "diary-service", "diary")
+	assert.NoError(t, err)
+	assert.Equal(t, koda.ServiceKey("diary"), r.ServiceKeys["diary-service"])
+	assert.Len(t, r.ServiceKeys, 2)
+	r.Deactivate("deletion requested", time.Now().UTC())
+	assert.NoError(t, s.Set(ctx, "testing", r))
+	r, err = s.GetOrCreateServiceKey(ctx, "testing", "chat-service", "chat")
+	assert.NoError(t, err)
+	assert.NotContains(t, r.ServiceKeys, "chat-service")
+	stored, err := s.Get(ctx, "testing")
+	assert.NoError(t, err)
+	assert.NotContains(t, stored.ServiceKeys, "chat-service")
+}
+
+func testGetOrCreateSalt(t *testing.T, s koda.Store) {
+	ctx := context.Background()
+	r, err := s.GetOrCreateSalt(ctx, "testing", "user-service", []byte("first"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), r.Salt)
+	assert.Equal(t, map[string]uint32{"user-service": 0}, r.Epochs)
+
+	// The Salt is kept, other services get an epoch
+	r, err = s.GetOrCreateSalt(ctx, "testing", "diary-service", []byte("second"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), r.Salt)
+	assert.Equal(t, map[string]uint32{"user-service": 0, "diary-service": 0}, r.Epochs)
+	assertStored(t, s, r)
+}
+
+func testUpdate(t *testing.T, s koda.Store) {
+	ctx := context.Background()
+	_, err := s.Update(ctx, "unknown", func(r koda.Record) (koda.Record, error) {
+		t.Error("fn must not be called for a missing record")
+		return r, nil
+	})
+	assert.True(t, errors.Is(err, koda.ErrNotFound), "expected ErrNotFound, got %v", err)
+	_, err = s.Get(ctx, "unknown")
+	assert.True(t, errors.Is(err, koda.ErrNotFound), "Update must not create records, got %v", err)
+
+	record := testRecord("testing")
+	assert.NoError(t, s.Set(ctx, record.AccountKey, record))
+	r, err := s.Update(ctx, record.AccountKey, func(r koda.Record) (koda.Record, error) {
+		assertRecord(t, record, r)
+		r.ServiceKeys["chat-service"] = "chat"
+		r.Reactivate()
+		return r, nil
+	})
+	assert.NoError(t, err)
+	expected := record.Clone()
+	expected.ServiceKeys["chat-service"] = "chat"
+	expected.Reactivate()
+	assertRecord(t, expected, r)
+	assertStored(t, s, expected)
+
+	// Errors of fn are returned and leave the record unchanged
+	errAbort := errors.New("abort")
+	_, err = s.Update(ctx, record.AccountKey, func(r koda.Record) (koda.Record, error) {
+		r.ServiceKeys = nil
+		return r, errAbort
+	})
+	assert.True(t, errors.Is(err, errAbort), "expected the error of fn, got %v", err)
+	assertStored(t, s, expected)
+
+	// Concurrent updates and get-or-create calls never overwrite each other
+	const workers, updates = 4, 5
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				_, err := s.Update(ctx, record.AccountKey, func(r koda.Record) (koda.Record, error) {
+					r.KeyHistory = append(r.KeyHistory, koda.RotatedKey{Service: fmt.Sprintf("worker-%d", w), Key: koda.ServiceKey(fmt.Sprint(i))})
+					return r, nil
+				})
+				assert.NoError(t, err)
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			service := fmt.Sprintf("service-%d", w)
+			_, err := s.GetOrCreateServiceKey(ctx, record.AccountKey, service, koda.ServiceKey(service))
+			assert.NoError(t, err)
+		}(w)
+	}
+	wg.Wait()
+	r, err = s.Get(ctx, record.AccountKey)
+	if assert.NoError(t, err) {
+		assert.Len(t, r.KeyHistory, len(record.KeyHistory)+workers*updates)
+		for w := 0; w < workers; w++ {
+			service := fmt.Sprintf("service-%d", w)
+			assert.Equal(t, koda.ServiceKey(service), r.ServiceKeys[service])
+		}
+	}
+}
+
+func testConcurrency(t *testing.T, s koda.Store) {
+	ctx := context.Background()
+	const workers, writes = 8, 20
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				key := koda.AccountKey(fmt.Sprintf("worker-%d-%02d", w, i))
+				record := koda.Record{AccountKey: key, ServiceKeys: map[string]koda.ServiceKey{"user-service": koda.ServiceKey(key)}}
+				assert.NoError(t, s.Set(ctx, key, record))
+				assertStored(t, s, record)
+				// Read a record of another worker, which might not exist yet
+				other := koda.AccountKey(fmt.Sprintf("worker-%d-%02d", (w+1)%workers, i))
+				if _, err := s.Get(ctx, other); err != nil && !errors.Is(err, koda.ErrNotFound) {
+					assert.NoError(t, err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	var n int
+	assert.NoError(t, koda.Walk(ctx, s, 0, func(r koda.Record) error {
+		assert.Equal(t, koda.ServiceKey(r.AccountKey), r.ServiceKeys["user-service"])
+		n++
+		return nil
+	}))
+	assert.Equal(t, workers*writes, n)
+}
+
+func testClosed(t *testing.T, s koda.Store) {
+	ctx := context.Background()
+	assert.NoError(t, s.Set(ctx, "testing", koda.Record{AccountKey: "testing"}))
+	closable, err := closeStore(s)
+	if !closable {
+		t.Skip("store cannot be closed")
+	}
+	assert.NoError(t, err)
+
+	// Operations on a closed store fail, but do not panic
+	_, err = s.Get(ctx, "testing")
+	assert.Error(t, err)
+	assert.Error(t, s.Set(ctx, "testing", koda.Record{AccountKey: "testing"}))
+	assert.Error(t, s.Delete(ctx, "testing"))
+	_, err = s.GetOrCreateServiceKey(ctx, "testing", "user-service", "key")
+	assert.Error(t, err)
+	_, err = s.Update(ctx, "testing", func(r koda.Record) (koda.Record, error) { return r, nil })
+	assert.Error(t, err)
+	_, err = s.List(ctx, "", 10)
+	assert.Error(t, err)
+	_, err = s.Scan(ctx, "", 10)
+	assert.Error(t, err)
+}
+
+func testPersistence(t *testing.T, f Factory, name string) {
+	ctx := context.Background()
+	s := f.Open(t, name)
+	record := testRecord("testing")
+	assert.NoError(t, s.Set(ctx, record.AccountKey, record))
+	for _, k := range []koda.AccountKey{"a", "b"} {
+		assert.NoError(t, s.Set(ctx, k, koda.Record{AccountKey: k}))
+	}
+	assert.NoError(t, s.Delete(ctx, "a"))
+	salted, err := s.GetOrCreateSalt(ctx, "b", "user-service", []byte("salt"))
+	assert.NoError(t, err)
+	closable, err := closeStore(s)
+	if !closable {
+		t.Fatalf("persistent store cannot be closed")
+	}
+	assert.NoError(t, err)
+
+	s = f.Open(t, name)
+	assertStored(t, s, record)
+	assertStored(t, s, salted)
+	_, err = s.Get(ctx, "a")
+	assert.True(t, errors.Is(err, koda.ErrNotFound), "deleted record must stay deleted, got %v", err)
+	keys, err := s.List(ctx, "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []koda.AccountKey{"b", "testing"}, keys)
+}
@@ -0,0 +1,31 @@
+package koda
+
+import "context"
+
+// DefaultPageSize is the number of records Walk fetches at a time if no positive page size is given.
+const DefaultPageSize = 500
+
+// Walk calls fn for every record in s in ascending order of AccountKeys. Records are fetched from s with Scan, pageSize
+// records at a time. Records written or deleted during the walk might or might not be visited, but no record is
+// visited twice. Walk stops at the first error returned by s or fn and returns it.
+func Walk(ctx context.Context, s Store, pageSize int, fn func(Record) error) error {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	var after AccountKey
+	for {
+		records, err := s.Scan(ctx, after, pageSize)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		if len(records) < pageSize {
+			return nil
+		}
+		after = records[len(records)-1].AccountKey
+	}
+}